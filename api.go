@@ -0,0 +1,456 @@
+package shtnr
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Machine readable error codes returned in API error responses
+const (
+	apiErrInvalidBody          = "invalid_body"
+	apiErrInvalidURL           = "invalid_url"
+	apiErrInvalidShortCode     = "invalid_short_code"
+	apiErrInvalidTag           = "invalid_tag"
+	apiErrInvalidUTM           = "invalid_utm"
+	apiErrInvalidParameter     = "invalid_parameter"
+	apiErrUnauthorized         = "unauthorized"
+	apiErrNotFound             = "not_found"
+	apiErrConflict             = "conflict"
+	apiErrIdempotencyKeyReused = "idempotency_key_reused"
+	apiErrBatchFailed          = "batch_failed"
+	apiErrNotCreated           = "not_created"
+	apiErrInternal             = "internal_error"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+	maxBatchSize    = 500
+)
+
+// apiError is the body of every API error response:
+//
+//	{"error": {"code": "not_found", "message": "Link not found"}}
+type apiError struct {
+	Error apiErrorDetail `json:"error"`
+}
+
+type apiErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// LinkList is a page of links returned by the list endpoint
+type LinkList struct {
+	Links  []Link `json:"links"`
+	Total  int    `json:"total"`
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
+}
+
+// LinkBatchResult reports what happened to each link in a batch creation request
+type LinkBatchResult struct {
+	Error   *apiErrorDetail `json:"error,omitempty"`
+	Results []LinkBatchItem `json:"results"`
+	Created int             `json:"created"`
+	Failed  int             `json:"failed"`
+}
+
+// LinkBatchItem is the outcome for one link of a batch, in the order they were sent
+type LinkBatchItem struct {
+	Index  int             `json:"index"`
+	Status int             `json:"status"`
+	Link   *Link           `json:"link,omitempty"`
+	Error  *apiErrorDetail `json:"error,omitempty"`
+}
+
+func (b *LinkBatchResult) fail(i, status int, code, message string) {
+	b.Results[i].Status = status
+	b.Results[i].Error = &apiErrorDetail{Code: code, Message: message}
+	b.Failed++
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Println("Failed to marshal response body: ", err)
+		writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	data, _ := json.Marshal(apiError{apiErrorDetail{Code: code, Message: message}})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
+
+// writeLinkSaveError reports a failure to insert or update a link
+func writeLinkSaveError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errShortCodeTaken) {
+		writeAPIError(w, http.StatusConflict, apiErrConflict, "Short code is already in use")
+		return
+	}
+	log.Println("Failed to save Link: ", err)
+	writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+}
+
+// apiLink loads the link named in the URL, writing an error response if it can't
+func (app *App) apiLink(w http.ResponseWriter, r *http.Request) (Link, bool) {
+	link, err := app.getLinkByShortCode(chi.URLParam(r, "shortCode"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeAPIError(w, http.StatusNotFound, apiErrNotFound, "Link not found")
+		return link, false
+	}
+	if err != nil {
+		log.Println("Failed to get Link: ", err)
+		writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+		return link, false
+	}
+	return link, true
+}
+
+// queryInt reads a non-negative integer query parameter
+func queryInt(r *http.Request, name string, fallback int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, errors.New(name + " must be a non-negative integer")
+	}
+	return n, nil
+}
+
+// queryBool reads an optional true/false query parameter
+func queryBool(r *http.Request, name string) (bool, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New(name + " must be true or false")
+	}
+	return b, nil
+}
+
+// queryLinkPage reads the parameters shared by the endpoints that list links: limit,
+// offset and sort
+func queryLinkPage(r *http.Request) (linkQuery, error) {
+	limit, err := queryInt(r, "limit", defaultPageSize)
+	if err == nil && (limit == 0 || limit > maxPageSize) {
+		err = errors.New("limit must be between 1 and " + strconv.Itoa(maxPageSize))
+	}
+	if err != nil {
+		return linkQuery{}, err
+	}
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		return linkQuery{}, err
+	}
+	q := linkQuery{Limit: limit, Offset: offset}
+	if sort := r.URL.Query().Get("sort"); sort != "" && !q.setSort(sort) {
+		return linkQuery{}, errors.New("cannot sort by " + strings.TrimPrefix(sort, "-"))
+	}
+	return q, nil
+}
+
+// writeLinkList responds with a page of links
+func writeLinkList(w http.ResponseWriter, q linkQuery, links []Link, total int) {
+	if links == nil {
+		links = []Link{}
+	}
+	writeJSON(w, http.StatusOK, LinkList{Links: links, Total: total, Limit: q.Limit, Offset: q.Offset})
+}
+
+// ListLinksApi lists links a page at a time. The optional q parameter searches short
+// codes, destinations, titles, descriptions and notes, tag limits the links to those
+// with that tag, created_from and created_to limit when the links were created,
+// archived lists the archived links instead of the others, and sort takes a column
+// name, prefixed with - to reverse it.
+func (app *App) ListLinksApi(w http.ResponseWriter, r *http.Request) {
+	q, err := queryLinkPage(r)
+	if err == nil {
+		err = q.setCreatedRange(r.URL.Query().Get("created_from"), r.URL.Query().Get("created_to"))
+	}
+	if err == nil {
+		q.Archived, err = queryBool(r, "archived")
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidParameter, err.Error())
+		return
+	}
+	q.Search = r.URL.Query().Get("q")
+	q.Tag = strings.ToLower(r.URL.Query().Get("tag"))
+
+	links, total, err := app.listLinks(q)
+	if err != nil {
+		log.Println("Failed to list links: ", err)
+		writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+		return
+	}
+	writeLinkList(w, q, links, total)
+}
+
+// GetLinkApi returns a single link
+func (app *App) GetLinkApi(w http.ResponseWriter, r *http.Request) {
+	link, ok := app.apiLink(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, link)
+}
+
+// UpdateLinkApi changes the short code, destination, tags, title, description, notes,
+// fallback and/or what is passed on when following a link. Fields left out of the
+// body are not changed.
+func (app *App) UpdateLinkApi(w http.ResponseWriter, r *http.Request) {
+	type requestType struct {
+		URL         *string   `json:"url"`
+		ShortCode   *string   `json:"short_code"`
+		Tags        *[]string `json:"tags"`
+		Title       *string   `json:"title"`
+		Description *string   `json:"description"`
+		Notes       *string   `json:"notes"`
+		Archived    *bool     `json:"archived"`
+		// QueryPassthrough and PathPassthrough choose what is passed on when the
+		// link is followed
+		QueryPassthrough *string `json:"query_passthrough"`
+		PathPassthrough  *bool   `json:"path_passthrough"`
+		FallbackURL      *string `json:"fallback_url"`
+	}
+	var req requestType
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		log.Println("Failed to decode body: ", err)
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidBody, "Cannot parse body")
+		return
+	}
+
+	before, ok := app.apiLink(w, r)
+	if !ok {
+		return
+	}
+	after := before
+	if req.URL != nil {
+		if !isValidURL(*req.URL) {
+			writeAPIError(w, http.StatusBadRequest, apiErrInvalidURL, "Invalid URL")
+			return
+		}
+		if err = validatePlaceholders(*req.URL); err != nil {
+			writeAPIError(w, http.StatusBadRequest, apiErrInvalidURL, err.Error())
+			return
+		}
+		after.LongLink = *req.URL
+	}
+	if req.FallbackURL != nil {
+		if err = validateFallbackURL(*req.FallbackURL); err != nil {
+			writeAPIError(w, http.StatusBadRequest, apiErrInvalidURL, err.Error())
+			return
+		}
+		after.FallbackURL = *req.FallbackURL
+	}
+	if req.ShortCode != nil {
+		if !isValidShortCode(*req.ShortCode) {
+			writeAPIError(w, http.StatusBadRequest, apiErrInvalidShortCode, invalidShortCodeMessage)
+			return
+		}
+		after.ShortCode = *req.ShortCode
+	}
+	if req.Tags != nil {
+		if after.Tags, err = normalizeTags(*req.Tags); err != nil {
+			writeAPIError(w, http.StatusBadRequest, apiErrInvalidTag, err.Error())
+			return
+		}
+	}
+
+	textChanged := req.Title != nil || req.Description != nil || req.Notes != nil
+	if req.Title != nil {
+		after.Title = *req.Title
+	}
+	if req.Description != nil {
+		after.Description = *req.Description
+	}
+	if req.Notes != nil {
+		after.Notes = *req.Notes
+	}
+	if err = validateLinkText(after); err != nil {
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidBody, err.Error())
+		return
+	}
+	if req.QueryPassthrough != nil {
+		if after.QueryPassthrough, err = normalizeQueryPassthrough(*req.QueryPassthrough); err != nil {
+			writeAPIError(w, http.StatusBadRequest, apiErrInvalidBody, err.Error())
+			return
+		}
+	}
+	if req.PathPassthrough != nil {
+		after.PathPassthrough = *req.PathPassthrough
+	}
+	passthroughChanged := req.QueryPassthrough != nil || req.PathPassthrough != nil
+
+	if req.URL != nil || req.ShortCode != nil || req.Tags != nil || req.FallbackURL != nil || textChanged || passthroughChanged {
+		if err = app.updateLink(after); err != nil {
+			writeLinkSaveError(w, err)
+			return
+		}
+		after, err = app.getLinkByID(int64(after.ID))
+		if err != nil {
+			log.Println("Failed to retrieve full Link: ", err)
+			writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+			return
+		}
+		app.audit(r, "link.update", after.ShortCode, before, after)
+	}
+	if req.Archived != nil && *req.Archived != (after.ArchivedAt != nil) {
+		action := "unarchive"
+		if *req.Archived {
+			action = "archive"
+		}
+		if after, err = app.applyLinkAction(r, action, after); err != nil {
+			log.Println("Failed to "+action+" Link: ", err)
+			writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, after)
+}
+
+// DeleteLinkApi removes a link
+func (app *App) DeleteLinkApi(w http.ResponseWriter, r *http.Request) {
+	link, ok := app.apiLink(w, r)
+	if !ok {
+		return
+	}
+	if err := app.deleteLink(link.ShortCode); err != nil {
+		log.Println("Failed to delete Link: ", err)
+		writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+		return
+	}
+	app.audit(r, "link.delete", link.ShortCode, link, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateLinksBatchApi creates many links in one request. By default the batch is
+// atomic: either every link is created or, if any of them fails, none are. With
+// "atomic": false each link is created independently and the response reports which
+// ones failed.
+func (app *App) CreateLinksBatchApi(w http.ResponseWriter, r *http.Request) {
+	type requestType struct {
+		Links []struct {
+			URL       string   `json:"url"`
+			ShortCode string   `json:"short_code"`
+			Tags      []string `json:"tags"`
+			utmParams
+		} `json:"links"`
+		Atomic *bool `json:"atomic"`
+	}
+	var req requestType
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		log.Println("Failed to decode body: ", err)
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidBody, "Cannot parse body")
+		return
+	}
+	if len(req.Links) == 0 || len(req.Links) > maxBatchSize {
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidBody, "A batch must have between 1 and "+strconv.Itoa(maxBatchSize)+" links")
+		return
+	}
+	atomic := req.Atomic == nil || *req.Atomic
+
+	result := LinkBatchResult{Results: make([]LinkBatchItem, len(req.Links))}
+	links := make([]Link, 0, len(req.Links))
+	indexes := make([]int, 0, len(req.Links))
+	for i, l := range req.Links {
+		result.Results[i].Index = i
+		tags, tagErr := normalizeTags(l.Tags)
+		placeholderErr := validatePlaceholders(l.URL)
+		utmErr := l.utmParams.validate()
+		switch {
+		case !isValidURL(l.URL):
+			result.fail(i, http.StatusBadRequest, apiErrInvalidURL, "Invalid URL")
+		case placeholderErr != nil:
+			result.fail(i, http.StatusBadRequest, apiErrInvalidURL, placeholderErr.Error())
+		case l.ShortCode != "" && !isValidShortCode(l.ShortCode):
+			result.fail(i, http.StatusBadRequest, apiErrInvalidShortCode, invalidShortCodeMessage)
+		case tagErr != nil:
+			result.fail(i, http.StatusBadRequest, apiErrInvalidTag, tagErr.Error())
+		case utmErr != nil:
+			result.fail(i, http.StatusBadRequest, apiErrInvalidUTM, utmErr.Error())
+		default:
+			links = append(links, Link{ShortCode: l.ShortCode, LongLink: l.utmParams.addTo(l.URL), Tags: tags})
+			indexes = append(indexes, i)
+		}
+	}
+
+	ids := make([]int64, len(links))
+	if atomic {
+		if result.Failed == 0 {
+			var failed int
+			ids, failed, err = app.insertLinksAtomically(links)
+			if errors.Is(err, errShortCodeTaken) {
+				result.fail(indexes[failed], http.StatusConflict, apiErrConflict, "Short code is already in use")
+			} else if err != nil {
+				log.Println("Failed to insert batch of Links: ", err)
+				writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+				return
+			}
+		}
+		if result.Failed > 0 {
+			for _, i := range indexes {
+				if result.Results[i].Error == nil {
+					result.fail(i, http.StatusFailedDependency, apiErrNotCreated, "Not created because another link in the batch failed")
+				}
+			}
+			result.Error = &apiErrorDetail{Code: apiErrBatchFailed, Message: "No links were created because at least one of them is invalid"}
+			writeJSON(w, http.StatusUnprocessableEntity, result)
+			return
+		}
+	} else {
+		for j := range links {
+			ids[j], err = app.insertLink(&links[j])
+			if errors.Is(err, errShortCodeTaken) {
+				result.fail(indexes[j], http.StatusConflict, apiErrConflict, "Short code is already in use")
+			} else if err != nil {
+				log.Println("Failed to insert Link: ", err)
+				result.fail(indexes[j], http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+			}
+		}
+	}
+
+	for j, id := range ids {
+		i := indexes[j]
+		if result.Results[i].Error != nil {
+			continue
+		}
+		link, err := app.getLinkByID(id)
+		if err != nil {
+			log.Println("Failed to retrieve full Link: ", err)
+			link = links[j]
+			link.ID = int(id)
+		}
+		app.audit(r, "link.create", link.ShortCode, nil, link)
+		result.Results[i].Status = http.StatusCreated
+		result.Results[i].Link = &link
+		result.Created++
+	}
+
+	if result.Failed > 0 {
+		writeJSON(w, http.StatusMultiStatus, result)
+		return
+	}
+	writeJSON(w, http.StatusCreated, result)
+}
@@ -0,0 +1,323 @@
+package shtnr
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// apiRequest sends an authenticated request through the full router
+func apiRequest(method, path, body string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req, _ := http.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-KEY", "testapikey")
+	rr := httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, req)
+	return rr
+}
+
+// assertAPIError checks the status and error code of an API error response
+func assertAPIError(t *testing.T, rr *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	if rr.Code != status {
+		t.Errorf("Expected status %d, got %d", status, rr.Code)
+	}
+	var body apiError
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Expected a JSON error body, got %q", rr.Body.String())
+	}
+	if body.Error.Code != code || body.Error.Message == "" {
+		t.Errorf("Expected error code %s, got %+v", code, body.Error)
+	}
+}
+
+func TestCreateLinkApiConflict(t *testing.T) {
+	clearTable()
+
+	rr := apiRequest("POST", "/api/v1/links", `{"url": "http://one.com", "short_code": "taken"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d", http.StatusCreated, rr.Code)
+	}
+
+	rr = apiRequest("POST", "/api/v1/links", `{"url": "http://two.com", "short_code": "taken"}`)
+	assertAPIError(t, rr, http.StatusConflict, apiErrConflict)
+
+	rr = apiRequest("POST", "/api/shorten", `{"url": "http://two.com", "short_code": "taken"}`)
+	assertAPIError(t, rr, http.StatusConflict, apiErrConflict)
+
+	rr = apiRequest("POST", "/api/v1/links", `{"url": "http://two.com", "short_code": "has/slash"}`)
+	assertAPIError(t, rr, http.StatusBadRequest, apiErrInvalidShortCode)
+
+	rr = apiRequest("POST", "/api/v1/links", `{"url": "http://two.com", "short_code": "login"}`)
+	assertAPIError(t, rr, http.StatusBadRequest, apiErrInvalidShortCode)
+
+	rr = apiRequest("POST", "/api/v1/links", `not json`)
+	assertAPIError(t, rr, http.StatusBadRequest, apiErrInvalidBody)
+}
+
+func TestGetLinkApi(t *testing.T) {
+	clearTable()
+	_, _ = app.insertLink(&Link{ShortCode: "getme", LongLink: "http://getme.com"})
+
+	rr := apiRequest("GET", "/api/v1/links/getme", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	var link Link
+	_ = json.Unmarshal(rr.Body.Bytes(), &link)
+	if link.ShortCode != "getme" || link.LongLink != "http://getme.com" {
+		t.Errorf("Unexpected link: %+v", link)
+	}
+	// Looking a link up through the API is not a visit
+	if link, _ = app.getLinkByShortCode("getme"); link.TimesAccessed != 0 {
+		t.Errorf("Expected no visits to be counted, got %d", link.TimesAccessed)
+	}
+
+	rr = apiRequest("GET", "/api/v1/links/missing", "")
+	assertAPIError(t, rr, http.StatusNotFound, apiErrNotFound)
+}
+
+func TestListLinksApi(t *testing.T) {
+	clearTable()
+	_, _ = app.insertLink(&Link{ShortCode: "alpha", LongLink: "http://example.com/a"})
+	_, _ = app.insertLink(&Link{ShortCode: "bravo", LongLink: "http://example.org/b"})
+	id, _ := app.insertLink(&Link{ShortCode: "charlie", LongLink: "http://example.com/c"})
+	_ = app.setVisitNumberToLink(int(id), 7)
+
+	list := func(query string) LinkList {
+		t.Helper()
+		rr := apiRequest("GET", "/api/v1/links"+query, "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected status %d, got %d", query, http.StatusOK, rr.Code)
+		}
+		var body LinkList
+		_ = json.Unmarshal(rr.Body.Bytes(), &body)
+		return body
+	}
+
+	body := list("")
+	if body.Total != 3 || len(body.Links) != 3 || body.Limit != defaultPageSize {
+		t.Errorf("Unexpected list: %+v", body)
+	}
+
+	body = list("?q=example.com")
+	if body.Total != 2 {
+		t.Errorf("Expected 2 search results, got %d", body.Total)
+	}
+
+	body = list("?sort=-clicks&limit=1")
+	if body.Total != 3 || len(body.Links) != 1 || body.Links[0].ShortCode != "charlie" {
+		t.Errorf("Expected most clicked link first, got %+v", body)
+	}
+
+	body = list("?sort=short_code&limit=2&offset=2")
+	if len(body.Links) != 1 || body.Links[0].ShortCode != "charlie" {
+		t.Errorf("Expected the last page to hold charlie, got %+v", body)
+	}
+
+	// Wildcards in the search are matched literally
+	if body = list("?q=%25"); body.Total != 0 {
+		t.Errorf("Expected %% to match nothing, got %d", body.Total)
+	}
+	if body = list("?q=nothing"); body.Links == nil {
+		t.Error("Expected an empty array rather than null")
+	}
+
+	assertAPIError(t, apiRequest("GET", "/api/v1/links?sort=long_link", ""), http.StatusBadRequest, apiErrInvalidParameter)
+	assertAPIError(t, apiRequest("GET", "/api/v1/links?limit=1000", ""), http.StatusBadRequest, apiErrInvalidParameter)
+	assertAPIError(t, apiRequest("GET", "/api/v1/links?offset=-1", ""), http.StatusBadRequest, apiErrInvalidParameter)
+}
+
+func TestListLinksApiCreatedRange(t *testing.T) {
+	clearTable()
+	for code, created := range map[string]string{
+		"jan": "2024-01-15 12:00:00",
+		"feb": "2024-02-01 00:00:00",
+		"mar": "2024-03-31 23:59:59",
+	} {
+		id, _ := app.insertLink(&Link{ShortCode: code, LongLink: "http://example.com/" + code})
+		_, _ = app.db.Exec(`UPDATE links SET created_at = ? WHERE id = ?`, created, id)
+	}
+
+	codes := func(query string) []string {
+		t.Helper()
+		rr := apiRequest("GET", "/api/v1/links?sort=created"+query, "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected status %d, got %d", query, http.StatusOK, rr.Code)
+		}
+		var body LinkList
+		_ = json.Unmarshal(rr.Body.Bytes(), &body)
+		var codes []string
+		for _, l := range body.Links {
+			codes = append(codes, l.ShortCode)
+		}
+		return codes
+	}
+
+	for query, want := range map[string]string{
+		"":                                   "jan feb mar",
+		"&created_from=2024-02-01":           "feb mar",
+		"&created_to=2024-03-31":             "jan feb mar",
+		"&created_to=2024-01-31":             "jan",
+		"&created_to=2024-02-01T00:00:00Z":   "jan feb",
+		"&created_from=2024-01-15T12:00:01Z": "feb mar",
+		"&created_from=2024-02-01&created_to=2024-02-29": "feb",
+	} {
+		if got := strings.Join(codes(query), " "); got != want {
+			t.Errorf("%s: expected %q, got %q", query, want, got)
+		}
+	}
+
+	rr := apiRequest("GET", "/api/v1/links?q=jan", "")
+	var body LinkList
+	_ = json.Unmarshal(rr.Body.Bytes(), &body)
+	if len(body.Links) != 1 || body.Links[0].CreatedAt.Format(time.RFC3339) != "2024-01-15T12:00:00Z" {
+		t.Errorf("Expected the creation time in the link, got %+v", body.Links)
+	}
+
+	assertAPIError(t, apiRequest("GET", "/api/v1/links?created_from=yesterday", ""), http.StatusBadRequest, apiErrInvalidParameter)
+	assertAPIError(t, apiRequest("GET", "/api/v1/links?created_to=2024-13-01", ""), http.StatusBadRequest, apiErrInvalidParameter)
+}
+
+func TestUpdateLinkApi(t *testing.T) {
+	clearTable()
+	_, _ = app.insertLink(&Link{ShortCode: "before", LongLink: "http://before.com"})
+	_, _ = app.insertLink(&Link{ShortCode: "other", LongLink: "http://other.com"})
+
+	rr := apiRequest("PATCH", "/api/v1/links/before", `{"url": "http://after.com"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	link, _ := app.getLinkByShortCode("before")
+	if link.LongLink != "http://after.com" {
+		t.Errorf("Expected destination to change, got %s", link.LongLink)
+	}
+
+	rr = apiRequest("PATCH", "/api/v1/links/before", `{"short_code": "renamed"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	if link, _ = app.getLinkByShortCode("renamed"); link.LongLink != "http://after.com" {
+		t.Errorf("Expected the link to be renamed, got %+v", link)
+	}
+
+	events, _ := app.listAuditEvents(auditFilter{Action: "link.update", Target: "renamed", Limit: 1})
+	if len(events) != 1 || events[0].Actor != "api-key" || !strings.Contains(string(events[0].Before), `"before"`) {
+		t.Errorf("Expected the update to be audited, got %+v", events)
+	}
+
+	assertAPIError(t, apiRequest("PATCH", "/api/v1/links/renamed", `{"short_code": "other"}`), http.StatusConflict, apiErrConflict)
+	assertAPIError(t, apiRequest("PATCH", "/api/v1/links/renamed", `{"url": "nope"}`), http.StatusBadRequest, apiErrInvalidURL)
+	assertAPIError(t, apiRequest("PATCH", "/api/v1/links/missing", `{"url": "http://x.com"}`), http.StatusNotFound, apiErrNotFound)
+}
+
+func TestDeleteLinkApi(t *testing.T) {
+	clearTable()
+	_, _ = app.insertLink(&Link{ShortCode: "goner", LongLink: "http://goner.com"})
+
+	rr := apiRequest("DELETE", "/api/v1/links/goner", "")
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, rr.Code)
+	}
+	assertAPIError(t, apiRequest("DELETE", "/api/v1/links/goner", ""), http.StatusNotFound, apiErrNotFound)
+}
+
+func TestApiRequiresKey(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/api/v1/links", nil)
+	rr := httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, req)
+	assertAPIError(t, rr, http.StatusUnauthorized, apiErrUnauthorized)
+}
+
+// batchStatuses creates a batch of links and returns the status of each item
+func batchStatuses(t *testing.T, body string, status int) []int {
+	t.Helper()
+	rr := apiRequest("POST", "/api/v1/links/batch", body)
+	if rr.Code != status {
+		t.Fatalf("Expected status %d, got %d: %s", status, rr.Code, rr.Body.String())
+	}
+	var result LinkBatchResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	statuses := make([]int, len(result.Results))
+	for i, item := range result.Results {
+		statuses[i] = item.Status
+	}
+	return statuses
+}
+
+func countLinks(t *testing.T) int {
+	t.Helper()
+	links, err := app.getAllLinks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(links)
+}
+
+func TestCreateLinksBatchApi(t *testing.T) {
+	clearTable()
+
+	statuses := batchStatuses(t, `{"links": [
+		{"url": "http://one.com", "short_code": "one"},
+		{"url": "http://two.com"}
+	]}`, http.StatusCreated)
+	if !slices.Equal(statuses, []int{201, 201}) || countLinks(t) != 2 {
+		t.Errorf("Expected both links to be created, got %v", statuses)
+	}
+
+	assertAPIError(t, apiRequest("POST", "/api/v1/links/batch", `{"links": []}`), http.StatusBadRequest, apiErrInvalidBody)
+}
+
+func TestCreateLinksBatchApiAtomic(t *testing.T) {
+	clearTable()
+	_, _ = app.insertLink(&Link{ShortCode: "taken", LongLink: "http://taken.com"})
+
+	statuses := batchStatuses(t, `{"links": [
+		{"url": "http://one.com", "short_code": "one"},
+		{"url": "http://two.com", "short_code": "taken"}
+	]}`, http.StatusUnprocessableEntity)
+	if !slices.Equal(statuses, []int{424, 409}) || countLinks(t) != 1 {
+		t.Errorf("Expected nothing to be created, got %v", statuses)
+	}
+
+	statuses = batchStatuses(t, `{"links": [
+		{"url": "http://one.com", "short_code": "dup"},
+		{"url": "http://two.com", "short_code": "dup"}
+	]}`, http.StatusUnprocessableEntity)
+	if !slices.Equal(statuses, []int{424, 409}) || countLinks(t) != 1 {
+		t.Errorf("Expected duplicates within the batch to fail it, got %v", statuses)
+	}
+
+	statuses = batchStatuses(t, `{"links": [
+		{"url": "http://one.com", "short_code": "one"},
+		{"url": "not a url"}
+	]}`, http.StatusUnprocessableEntity)
+	if !slices.Equal(statuses, []int{424, 400}) || countLinks(t) != 1 {
+		t.Errorf("Expected an invalid link to fail the batch, got %v", statuses)
+	}
+}
+
+func TestCreateLinksBatchApiNonAtomic(t *testing.T) {
+	clearTable()
+	_, _ = app.insertLink(&Link{ShortCode: "taken", LongLink: "http://taken.com"})
+
+	statuses := batchStatuses(t, `{"atomic": false, "links": [
+		{"url": "http://one.com", "short_code": "one"},
+		{"url": "not a url"},
+		{"url": "http://two.com", "short_code": "taken"}
+	]}`, http.StatusMultiStatus)
+	if !slices.Equal(statuses, []int{201, 400, 409}) || countLinks(t) != 2 {
+		t.Errorf("Expected only the valid link to be created, got %v", statuses)
+	}
+}
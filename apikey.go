@@ -0,0 +1,48 @@
+package shtnr
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+)
+
+// apiKeyPrefix makes keys easy to recognise, for example by secret scanners
+const apiKeyPrefix = "shtnr_"
+
+// generateAPIKey returns a new random API key
+func generateAPIKey() (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + token, nil
+}
+
+// hashAPIKey is how keys are stored, so that a copy of the database can't be used
+// to call the API
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyActor checks a key against the API_KEY setting and the stored keys, returning
+// the name it is recorded under in the audit log
+func (app *App) apiKeyActor(key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(app.config.apiKey)) == 1 {
+		return "api-key", true
+	}
+	name, err := app.getAPIKeyName(hashAPIKey(key))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Println("Failed to look up API key:", err)
+		}
+		return "", false
+	}
+	return "api-key:" + name, true
+}
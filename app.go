@@ -0,0 +1,370 @@
+package shtnr
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/gorilla/securecookie"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/gobuffalo/envy"
+)
+
+// Option configures an App. Options are applied in the order they are given to New.
+type Option func(*App)
+
+// WithEnv reads the settings from environment variables, as the shortner command does.
+// Settings whose variable isn't set keep the value they already have.
+func WithEnv() Option {
+	return func(app *App) {
+		c := app.config
+		c.baseUrl = strings.TrimSuffix(envy.Get("BASE_URL", c.baseUrl), "/")
+		c.port = envy.Get("PORT", c.port)
+		c.isDevelopment = envy.Get("IS_DEV", strconv.FormatBool(c.isDevelopment)) == "true"
+		c.defaultAdminUser = envy.Get("ADMIN_USERNAME", cmp.Or(c.defaultAdminUser, "admin"))
+		c.defaultAdminPassword = envy.Get("ADMIN_PASSWORD", cmp.Or(c.defaultAdminPassword, "password"))
+		c.apiKey = envy.Get("API_KEY", cmp.Or(c.apiKey, "123456"))
+		c.loginMaxAttempts = envInt("LOGIN_MAX_ATTEMPTS", c.loginMaxAttempts)
+		c.loginLockout = envDuration("LOGIN_LOCKOUT_MINUTES", time.Minute, c.loginLockout)
+		c.mfaRequiredRoles = envList("MFA_REQUIRED_ROLES", strings.Join(c.mfaRequiredRoles, ","))
+		c.oidcIssuer = envy.Get("OIDC_ISSUER", c.oidcIssuer)
+		c.oidcClientID = envy.Get("OIDC_CLIENT_ID", c.oidcClientID)
+		c.oidcClientSecret = envy.Get("OIDC_CLIENT_SECRET", c.oidcClientSecret)
+		c.oidcRedirectURL = envy.Get("OIDC_REDIRECT_URL", c.oidcRedirectURL)
+		c.oidcScopes = envList("OIDC_SCOPES", strings.Join(c.oidcScopes, ","))
+		if pairs := envList("OIDC_GROUP_ROLES", ""); pairs != nil {
+			c.oidcGroupRoles = parseGroupRoles(pairs)
+		}
+		c.oidcDefaultRole = envy.Get("OIDC_DEFAULT_ROLE", c.oidcDefaultRole)
+		c.idempotencyWindow = envDuration("IDEMPOTENCY_WINDOW_HOURS", time.Hour, c.idempotencyWindow)
+		c.assetsDir = envy.Get("ASSETS_DIR", c.assetsDir)
+		c.trashRetention = envDuration("TRASH_RETENTION_DAYS", 24*time.Hour, c.trashRetention)
+		c.fetchTitles = envy.Get("FETCH_TITLES", strconv.FormatBool(c.fetchTitles)) == "true"
+	}
+}
+
+// WithStore keeps links, users and the audit log in the given SQLite database. By
+// default ./data/local.sqlite is used.
+func WithStore(db *sql.DB) Option {
+	return func(app *App) {
+		app.db = db
+	}
+}
+
+// WithBaseURL sets the public address that short links are served from. In
+// development mode the port is added to it unless it has one already.
+func WithBaseURL(baseURL string) Option {
+	return func(app *App) {
+		app.config.baseUrl = strings.TrimSuffix(baseURL, "/")
+	}
+}
+
+// WithAPIKey sets a key that is accepted by the API alongside the keys created with
+// "shortner apikey create". Without it only created keys work.
+func WithAPIKey(key string) Option {
+	return func(app *App) {
+		app.config.apiKey = key
+	}
+}
+
+// WithAdmin sets the admin user that is created when the app starts serving. Without
+// it no admin is created.
+func WithAdmin(username, password string) Option {
+	return func(app *App) {
+		app.config.defaultAdminUser = username
+		app.config.defaultAdminPassword = password
+	}
+}
+
+// WithAssetsDir reads templates and static files from dir when they exist there, so
+// the pages can be themed. It has the same layout as the embedded assets: views/*.html
+// and static/*. In development mode templates are read again for every page.
+func WithAssetsDir(dir string) Option {
+	return func(app *App) {
+		app.config.assetsDir = dir
+	}
+}
+
+// WithTrashRetention sets how long deleted links stay in the trash before they are
+// deleted for good, 30 days by default. Zero keeps them until they are deleted by hand.
+// Expired links are purged in the background until the context given to WithContext
+// is done.
+func WithTrashRetention(d time.Duration) Option {
+	return func(app *App) {
+		app.config.trashRetention = d
+	}
+}
+
+// WithContext ties the app's background work, such as purging the trash, to ctx. It
+// stops once ctx is done. By default it runs for as long as the process does.
+func WithContext(ctx context.Context) Option {
+	return func(app *App) {
+		app.ctx = ctx
+	}
+}
+
+// WithTitleFetching gives links created without a title the title of their
+// destination page. It is off by default, as it makes the server request any URL
+// that is shortened. Only public addresses are requested, never the server's own
+// network.
+func WithTitleFetching(enabled bool) Option {
+	return func(app *App) {
+		app.config.fetchTitles = enabled
+	}
+}
+
+// New creates an App. It doesn't touch the database, so the schema can be migrated
+// by Run.
+func New(opts ...Option) (*App, error) {
+	app := &App{
+		ctx: context.Background(),
+		config: &Config{
+			baseUrl:           "http://localhost",
+			port:              "3001",
+			loginMaxAttempts:  5,
+			loginLockout:      15 * time.Minute,
+			oidcScopes:        []string{"openid", "email", "profile"},
+			idempotencyWindow: 24 * time.Hour,
+			trashRetention:    30 * 24 * time.Hour,
+		},
+	}
+	for _, opt := range opts {
+		opt(app)
+	}
+	config := app.config
+
+	if config.defaultAdminPassword != "" {
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(config.defaultAdminPassword), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash password: %w", err)
+		}
+		app.hashPassword = string(hashedPassword)
+	}
+	hashKey := securecookie.GenerateRandomKey(32)  // 32 bytes = 256 bits
+	blockKey := securecookie.GenerateRandomKey(32) // 32 bytes = 256 bits
+	app.sc = securecookie.New(hashKey, blockKey)
+	app.loginThrottle = newLoginThrottle(config.loginMaxAttempts, config.loginLockout)
+	app.oidc = newOIDCProvider(config)
+	if err := app.loadTemplates(); err != nil {
+		return nil, err
+	}
+
+	if app.db == nil {
+		var err error
+		if app.db, err = openDatabase(defaultDatabaseFile); err != nil {
+			return nil, err
+		}
+	}
+	return app, nil
+}
+
+// NewHandler creates an App and returns its routes, ready to be mounted in another
+// server. The database schema is migrated and the admin user created first, and
+// expired links are purged from the trash until the context given to WithContext is
+// done.
+func NewHandler(opts ...Option) (http.Handler, error) {
+	app, err := New(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err = app.setup(); err != nil {
+		return nil, err
+	}
+	return app.routes(), nil
+}
+
+// setup brings the database schema up to date, creates the admin user and starts
+// purging expired links from the trash
+func (app *App) setup() error {
+	if err := migrate(app.db); err != nil {
+		return err
+	}
+	if app.hashPassword != "" {
+		if err := app.ensureUser(app.config.defaultAdminUser, app.hashPassword, "admin"); err != nil {
+			return err
+		}
+	}
+	if app.config.trashRetention > 0 {
+		go app.purgeTrashPeriodically(app.ctx, trashPurgeInterval)
+	}
+	return nil
+}
+
+// routes builds the application's router
+func (app *App) routes() *chi.Mux {
+	r := chi.NewRouter()
+
+	// Middleware
+	r.Use(middleware.Logger)
+	r.Use(ContentSecurityPolicyMiddleware)
+
+	// Serve static files
+	r.Handle("/static/*", http.StripPrefix("/static/", http.FileServer(http.FS(app.staticFS()))))
+
+	r.Get("/login", app.LoginPageHandler)
+
+	// Public route
+	r.Post("/login", app.LoginHandler)
+	r.Get("/login/oidc", app.OIDCLoginHandler)
+	r.Get("/login/oidc/callback", app.OIDCCallbackHandler)
+	r.Get("/login/mfa", app.MFAPageHandler)
+	r.Post("/login/mfa", app.MFAHandler)
+	// Reachable with either a session or a pending login that must enrol first
+	r.Get("/mfa/setup", app.MFASetupPageHandler)
+	r.Post("/mfa/setup", app.MFASetupHandler)
+	r.Get("/logout", app.LogoutHandler)
+	r.Get("/favicon.ico", http.NotFound) // just to stop errors
+
+	r.Get("/api/openapi.json", app.OpenAPIHandler)
+	r.With(app.ApiKeyAuthMiddleware).Group(func(r chi.Router) {
+		r.Post("/api/shorten", app.ShortenURLApi)
+
+		r.Route("/api/v1/links", func(r chi.Router) {
+			r.Get("/", app.ListLinksApi)
+			r.Post("/", app.ShortenURLApi)
+			r.Post("/batch", app.CreateLinksBatchApi)
+			r.Post("/bulk", app.BulkLinksApi)
+			r.Get("/{shortCode}", app.GetLinkApi)
+			r.Patch("/{shortCode}", app.UpdateLinkApi)
+			r.Delete("/{shortCode}", app.DeleteLinkApi)
+			r.Get("/{shortCode}/revisions", app.LinkRevisionsApi)
+			r.Post("/{shortCode}/rollback", app.RollbackLinkApi)
+		})
+		r.Route("/api/v1/trash", func(r chi.Router) {
+			r.Get("/", app.ListTrashApi)
+			r.Post("/{shortCode}/restore", app.RestoreLinkApi)
+			r.Delete("/{shortCode}", app.PurgeLinkApi)
+		})
+		r.Get("/api/v1/tags", app.TagsApi)
+		r.Get("/api/v1/reports/stale", app.StaleLinksApi)
+		r.Get("/api/v1/reports/campaigns", app.CampaignsApi)
+		r.Get("/api/v1/export", app.ExportLinksApi)
+		r.Post("/api/v1/import", app.ImportLinksApi)
+	})
+
+	// Protected routes
+	r.With(app.AuthMiddleware).Group(func(r chi.Router) {
+		r.Get("/shortlinks", app.ShortLinksHandler)
+		r.Post("/shorten", app.ShortenURL)
+		r.Get("/shortlinks/stale", app.StaleLinksHandler)
+		r.Post("/shortlinks/stale", app.StaleLinksActionHandler)
+		r.Post("/{shortURL}/delete", app.DeleteShortLink)
+		r.Post("/{shortURL}/unarchive", app.UnarchiveShortLink)
+		r.Get("/shortlinks/trash", app.TrashHandler)
+		r.Get("/shortlinks/campaigns", app.CampaignsHandler)
+		r.Post("/{shortURL}/restore", app.RestoreShortLink)
+		r.Post("/{shortURL}/purge", app.PurgeShortLink)
+		// under /shortlinks so they don't hide the paths that links pass on
+		r.Get("/shortlinks/{shortURL}/info", app.LinkInfoHandler)
+		r.Post("/shortlinks/{shortURL}/edit", app.EditShortLink)
+		r.Post("/shortlinks/{shortURL}/rollback", app.RollbackShortLink)
+		r.Post("/mfa/disable", app.MFADisableHandler)
+
+		r.With(app.RoleMiddleware("admin")).Group(func(r chi.Router) {
+			r.Get("/audit", app.AuditLogHandler)
+			r.Get("/audit/export", app.AuditExportHandler)
+			r.Get("/shortlinks/export", app.ExportLinksHandler)
+			r.Post("/shortlinks/import", app.ImportLinksHandler)
+		})
+	},
+	)
+
+	// last routes to catch all, the second for links that pass on extra paths
+	r.Get("/{shortURL}", app.FollowShortURL)
+	r.Get("/{shortURL}/*", app.FollowShortURL)
+
+	return r
+}
+
+// envInt reads an integer from the environment, falling back to the default when the
+// variable is unset or not a number
+func envInt(key string, fallback int) int {
+	value, err := strconv.Atoi(envy.Get(key, strconv.Itoa(fallback)))
+	if err != nil {
+		log.Printf("Invalid value for %s, using default %d", key, fallback)
+		return fallback
+	}
+	return value
+}
+
+// envDuration reads a whole number of units from the environment, keeping fallback
+// when the variable isn't set
+func envDuration(key string, unit, fallback time.Duration) time.Duration {
+	if envy.Get(key, "") == "" {
+		return fallback
+	}
+	return time.Duration(envInt(key, int(fallback/unit))) * unit
+}
+
+// envList reads a comma separated list from the environment
+func envList(key, fallback string) []string {
+	var values []string
+	for _, v := range strings.Split(envy.Get(key, fallback), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// contentSecurityPolicy only lets pages load scripts, styles and fonts from this
+// server. The QR code shown when setting up two-factor authentication is a data URL.
+const contentSecurityPolicy = "default-src 'self'; script-src 'self'; style-src 'self'; img-src 'self' data:; " +
+	"object-src 'none'; base-uri 'none'; frame-ancestors 'none'; form-action 'self'"
+
+// ContentSecurityPolicyMiddleware stops the browser running third-party or inline
+// scripts on any page
+func ContentSecurityPolicyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", contentSecurityPolicy)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AuthMiddleware is the middleware for authentication
+func (app *App) AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := app.sessionUsername(r); !ok {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (app *App) ApiKeyAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := app.apiKeyActor(r.Header.Get("X-API-KEY"))
+		if !ok {
+			writeAPIError(w, http.StatusUnauthorized, apiErrUnauthorized, "Missing or invalid X-API-KEY header")
+			return
+		}
+		next.ServeHTTP(w, withActor(r, actor))
+	})
+}
+
+// RoleMiddleware only lets logged-in users with one of the given roles through. It
+// must be used after AuthMiddleware.
+func (app *App) RoleMiddleware(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			username, _ := app.sessionUsername(r)
+			u, err := app.getUserByUsername(username)
+			if err != nil || !slices.Contains(roles, u.role) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package shtnr
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobuffalo/envy"
+)
+
+// newTestHandler creates an App with its own database, as an embedding service would
+func newTestHandler(t *testing.T, apiKey string) http.Handler {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "shtnr.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	h, err := NewHandler(WithStore(db), WithContext(ctx), WithBaseURL("https://sho.rt"), WithAPIKey(apiKey), WithAdmin("admin", "secret"))
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+	return h
+}
+
+func TestNewHandlerInstancesAreIndependent(t *testing.T) {
+	for i := range 3 {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			t.Parallel()
+			apiKey := fmt.Sprintf("key-%d", i)
+			h := newTestHandler(t, apiKey)
+
+			req := httptest.NewRequest("POST", "/api/v1/links", strings.NewReader(`{"url": "https://example.com", "short_code": "same"}`))
+			req.Header.Set("X-API-KEY", apiKey)
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			if rr.Code != http.StatusCreated {
+				t.Fatalf("Expected each instance to create the same short code, got %d: %s", rr.Code, rr.Body)
+			}
+
+			req = httptest.NewRequest("GET", "/api/v1/links", nil)
+			req.Header.Set("X-API-KEY", fmt.Sprintf("key-%d", i+1))
+			rr = httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			if rr.Code != http.StatusUnauthorized {
+				t.Errorf("Expected another instance's API key to be refused, got %d", rr.Code)
+			}
+
+			rr = httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("GET", "/same", nil))
+			if rr.Code != http.StatusTemporaryRedirect || rr.Header().Get("Location") != "https://example.com" {
+				t.Errorf("Expected a redirect to the link, got %d %s", rr.Code, rr.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func TestNewHandlerPurgesTrash(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "shtnr.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err = migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`INSERT INTO links (short_code, long_link, deleted_at) VALUES ('old', 'http://example.com', ?)`,
+		time.Now().AddDate(0, 0, -60).UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if _, err = NewHandler(WithStore(db), WithContext(ctx)); err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+	var count int
+	for range 100 {
+		_ = db.QueryRow(`SELECT COUNT(*) FROM links`).Scan(&count)
+		if count == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Expected the expired link to be purged in the background, got %d links", count)
+}
+
+func TestWithEnvKeepsEarlierOptions(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "shtnr.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	envy.Temp(func() {
+		envy.Set("PORT", "4000")
+		envy.Set("IS_DEV", "true")
+		a, err := New(WithStore(db), WithAPIKey("from-option"), WithTrashRetention(time.Hour), WithEnv(), WithBaseURL("http://localhost"))
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		if a.config.apiKey != "from-option" || a.config.trashRetention != time.Hour || a.config.port != "4000" {
+			t.Errorf("Expected the environment to only change the settings it has, got %+v", a.config)
+		}
+		if !a.config.isDevelopment || a.config.siteURL() != "http://localhost:4000" {
+			t.Errorf("Expected development mode to add the port, got %s", a.config.siteURL())
+		}
+		a.config.baseUrl = "http://localhost:8080"
+		if a.config.siteURL() != "http://localhost:8080" {
+			t.Errorf("Expected a base URL with a port to be used as it is, got %s", a.config.siteURL())
+		}
+	})
+}
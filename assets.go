@@ -0,0 +1,175 @@
+package shtnr
+
+import (
+	"crypto/sha512"
+	"embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// assets holds the page templates and static files, so the binary runs from any
+// directory. Files in the assets directory setting take precedence over them.
+//
+//go:embed views static
+var assets embed.FS
+
+// overlayFS reads files from the override directory when they exist there, and from
+// the embedded assets otherwise
+type overlayFS struct {
+	override fs.FS
+	base     fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if o.override != nil {
+		f, err := o.override.Open(name)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return o.base.Open(name)
+}
+
+// ReadDir lists the files in both, so that listing a directory finds the embedded
+// files that aren't overridden
+func (o overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(o.base, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if o.override != nil {
+		overrides, overrideErr := fs.ReadDir(o.override, name)
+		if overrideErr != nil && !errors.Is(overrideErr, fs.ErrNotExist) {
+			return nil, overrideErr
+		}
+		if overrideErr == nil {
+			err = nil
+		}
+		for _, entry := range overrides {
+			i := slices.IndexFunc(entries, func(e fs.DirEntry) bool { return e.Name() == entry.Name() })
+			if i >= 0 {
+				entries[i] = entry
+			} else {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+// assetFS returns the assets with any overrides applied
+func (app *App) assetFS() fs.FS {
+	if app.config.assetsDir == "" {
+		return assets
+	}
+	return overlayFS{override: os.DirFS(app.config.assetsDir), base: assets}
+}
+
+// staticFS returns the files served under /static
+func (app *App) staticFS() fs.FS {
+	static, _ := fs.Sub(app.assetFS(), "static")
+	return static
+}
+
+// liveReload reports whether templates are read again for every page, so changes to
+// the overrides show without a restart. It is only done in development mode.
+func (app *App) liveReload() bool {
+	return app.config.isDevelopment && app.config.assetsDir != ""
+}
+
+// parseTemplates parses every page template
+func (app *App) parseTemplates() (map[string]*template.Template, error) {
+	names, err := fs.Glob(assets, "views/*.html")
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := integrityHashes(app.staticFS())
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash static files: %w", err)
+	}
+	fsys := app.assetFS()
+	templates := make(map[string]*template.Template, len(names))
+	for _, name := range names {
+		tmpl, err := parseTemplate(fsys, name, hashes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse template: %w", err)
+		}
+		templates[path.Base(name)] = tmpl
+	}
+	return templates, nil
+}
+
+// parseTemplate parses a page template, giving it the functions pages can use. The
+// integrity function looks static files up in hashes.
+func parseTemplate(fsys fs.FS, name string, hashes map[string]string) (*template.Template, error) {
+	integrity := func(file string) (string, error) {
+		hash, ok := hashes[file]
+		if !ok {
+			return "", fmt.Errorf("no static file %s", file)
+		}
+		return hash, nil
+	}
+	funcs := template.FuncMap{"integrity": integrity, "join": strings.Join}
+	return template.New(path.Base(name)).Funcs(funcs).ParseFS(fsys, name)
+}
+
+// integrityHashes returns the subresource integrity hash of every static file, so
+// browsers refuse a file if it has been changed on the way to them. They are worked
+// out along with the templates rather than for every page.
+func integrityHashes(static fs.FS) (map[string]string, error) {
+	hashes := make(map[string]string)
+	err := fs.WalkDir(static, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(static, name)
+		if err != nil {
+			return err
+		}
+		sum := sha512.Sum384(data)
+		hashes[name] = "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+		return nil
+	})
+	return hashes, err
+}
+
+// loadTemplates parses the page templates once, when the app is created
+func (app *App) loadTemplates() error {
+	templates, err := app.parseTemplates()
+	if err != nil {
+		return err
+	}
+	app.templates = templates
+	return nil
+}
+
+// template returns the page template with the given file name. With live reload a
+// template that fails to parse is logged and the last good one is used.
+func (app *App) template(name string) *template.Template {
+	if app.liveReload() {
+		hashes, err := integrityHashes(app.staticFS())
+		if err == nil {
+			var tmpl *template.Template
+			if tmpl, err = parseTemplate(app.assetFS(), "views/"+name, hashes); err == nil {
+				return tmpl
+			}
+		}
+		log.Println("Failed to reload template:", err)
+	}
+	return app.templates[name]
+}
@@ -0,0 +1,163 @@
+package shtnr
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"html"
+	"html/template"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// getPage requests a page from an App's router
+func getPage(t *testing.T, a *App, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	a.routes().ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d for %s, got %d", http.StatusOK, path, rr.Code)
+	}
+	return rr
+}
+
+// writeAsset writes a file into an assets override directory
+func writeAsset(t *testing.T, dir, name, content string) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEmbeddedAssets(t *testing.T) {
+	a, err := New(WithStore(testApp.db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr := getPage(t, a, "/login"); !strings.Contains(rr.Body.String(), `name="password"`) {
+		t.Errorf("Expected the embedded login page, got %q", rr.Body.String())
+	}
+	embedded, _ := assets.ReadFile("static/styles.css")
+	if rr := getPage(t, a, "/static/styles.css"); rr.Body.String() != string(embedded) {
+		t.Error("Expected the embedded stylesheet")
+	}
+}
+
+func TestAssetsDirOverrides(t *testing.T) {
+	dir := t.TempDir()
+	writeAsset(t, dir, "views/login.html", "custom login v1")
+	writeAsset(t, dir, "static/styles.css", "body { color: hotpink; }")
+
+	a, err := New(WithStore(testApp.db), WithAssetsDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr := getPage(t, a, "/login"); rr.Body.String() != "custom login v1" {
+		t.Errorf("Expected the overridden login page, got %q", rr.Body.String())
+	}
+	if rr := getPage(t, a, "/static/styles.css"); rr.Body.String() != "body { color: hotpink; }" {
+		t.Errorf("Expected the overridden stylesheet, got %q", rr.Body.String())
+	}
+	if a.template("mfa.html") == nil {
+		t.Error("Expected templates that aren't overridden to come from the embedded assets")
+	}
+
+	// outside development mode templates are only parsed once
+	writeAsset(t, dir, "views/login.html", "custom login v2")
+	if rr := getPage(t, a, "/login"); rr.Body.String() != "custom login v1" {
+		t.Errorf("Expected the template parsed at startup, got %q", rr.Body.String())
+	}
+
+	a.config.isDevelopment = true
+	if rr := getPage(t, a, "/login"); rr.Body.String() != "custom login v2" {
+		t.Errorf("Expected the template to be reloaded in development mode, got %q", rr.Body.String())
+	}
+	writeAsset(t, dir, "views/login.html", "{{ .Broken")
+	if rr := getPage(t, a, "/login"); rr.Body.String() != "custom login v1" {
+		t.Errorf("Expected a template that fails to parse to fall back, got %q", rr.Body.String())
+	}
+}
+
+func TestAssetsDirInvalidTemplate(t *testing.T) {
+	dir := t.TempDir()
+	writeAsset(t, dir, "views/login.html", "{{ .Broken")
+	if _, err := New(WithStore(testApp.db), WithAssetsDir(dir)); err == nil {
+		t.Error("Expected New to fail on a template that doesn't parse")
+	}
+}
+
+// assetPattern matches the scripts and stylesheets a page loads
+var assetPattern = regexp.MustCompile(`<(?:script src|link rel="stylesheet" href)="([^"]*)" integrity="([^"]*)"`)
+
+func TestPagesLoadSelfHostedAssets(t *testing.T) {
+	for _, path := range []string{"/login", "/shortlinks", "/audit"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.AddCookie(sessionCookie(t, "testadmin"))
+		rr := httptest.NewRecorder()
+		app.routes().ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status %d for %s, got %d", http.StatusOK, path, rr.Code)
+		}
+		if csp := rr.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "script-src 'self'") {
+			t.Errorf("Expected %s to forbid third-party scripts, got %q", path, csp)
+		}
+
+		body := rr.Body.String()
+		if strings.Contains(body, "<style") || strings.Contains(body, "<script>") {
+			t.Errorf("Expected %s to have no inline styles or scripts", path)
+		}
+		matches := assetPattern.FindAllStringSubmatch(body, -1)
+		if len(matches) == 0 || strings.Count(body, "<script")+strings.Count(body, "<link") != len(matches) {
+			t.Errorf("Expected every script and stylesheet of %s to have an integrity hash", path)
+		}
+		for _, m := range matches {
+			if !strings.HasPrefix(m[1], "/static/") {
+				t.Errorf("Expected %s to load %s from /static", path, m[1])
+				continue
+			}
+			served := getPage(t, app, m[1]).Body.Bytes()
+			sum := sha512.Sum384(served)
+			if want := "sha384-" + base64.StdEncoding.EncodeToString(sum[:]); html.UnescapeString(m[2]) != want {
+				t.Errorf("Expected the integrity of %s to be %s, got %s", m[1], want, html.UnescapeString(m[2]))
+			}
+		}
+	}
+}
+
+func TestIntegrityHashes(t *testing.T) {
+	dir := t.TempDir()
+	writeAsset(t, dir, "static/app.js", "console.log('hi')")
+	a, err := New(WithStore(testApp.db), WithAssetsDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashes, err := integrityHashes(a.staticFS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha512.Sum384([]byte("console.log('hi')"))
+	if want := "sha384-" + base64.StdEncoding.EncodeToString(sum[:]); hashes["app.js"] != want {
+		t.Errorf("Expected the hash of the overridden script %s, got %s", want, hashes["app.js"])
+	}
+	if hashes["tailwind.css"] == "" {
+		t.Error("Expected the embedded stylesheet to be hashed")
+	}
+
+	tmpl, err := parseTemplate(os.DirFS(dir), "static/app.js", hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = template.Must(tmpl.New("missing").Parse(`{{integrity "missing.js"}}`)).Execute(io.Discard, nil); err == nil {
+		t.Error("Expected a static file that doesn't exist to fail the page")
+	}
+}
@@ -0,0 +1,165 @@
+package shtnr
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type contextKey string
+
+// actorContextKey holds the name used in the audit log for requests that are not
+// made with a session, such as API calls
+const actorContextKey contextKey = "actor"
+
+const auditPageSize = 50
+
+// requestActor returns who is making the request, for the audit log
+func (app *App) requestActor(r *http.Request) string {
+	if username, ok := app.sessionUsername(r); ok {
+		return username
+	}
+	if actor, ok := r.Context().Value(actorContextKey).(string); ok {
+		return actor
+	}
+	return "anonymous"
+}
+
+// withActor returns a copy of the request that is attributed to the actor in the audit log
+func withActor(r *http.Request, actor string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), actorContextKey, actor))
+}
+
+// audit records an action taken by the user making the request
+func (app *App) audit(r *http.Request, action, target string, before, after any) {
+	app.auditAs(r, app.requestActor(r), action, target, before, after)
+}
+
+// auditAs records an action on behalf of a named actor, for when the request is not
+// (yet) logged in. Failing to write the audit log is logged rather than returned so
+// that it never blocks the action being audited.
+func (app *App) auditAs(r *http.Request, actor, action, target string, before, after any) {
+	e := AuditEvent{
+		Actor:  actor,
+		Action: action,
+		Target: target,
+		IP:     clientIP(r),
+		Before: auditSnapshot(before),
+		After:  auditSnapshot(after),
+	}
+	if err := app.insertAuditEvent(e); err != nil {
+		log.Printf("Failed to record %s in audit log: %s", action, err)
+	}
+}
+
+// auditSnapshot serialises a value for the before/after columns of the audit log
+func auditSnapshot(v any) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Println("Failed to marshal audit snapshot:", err)
+		return nil
+	}
+	return data
+}
+
+// parseAuditFilter reads the audit log filters from the query string
+func parseAuditFilter(query url.Values) auditFilter {
+	f := auditFilter{
+		Actor:  query.Get("actor"),
+		Action: query.Get("action"),
+		Target: query.Get("target"),
+	}
+	if from, err := time.Parse("2006-01-02", query.Get("from")); err == nil {
+		f.From = from
+	}
+	if to, err := time.Parse("2006-01-02", query.Get("to")); err == nil {
+		// include the whole of the last day
+		f.To = to.AddDate(0, 0, 1)
+	}
+	return f
+}
+
+// AuditLogHandler shows the audit log, filtered by the query string
+func (app *App) AuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	f := parseAuditFilter(r.URL.Query())
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	// fetch one extra to find out whether there is another page
+	f.Limit = auditPageSize + 1
+	f.Offset = (page - 1) * auditPageSize
+
+	events, err := app.listAuditEvents(f)
+	if err != nil {
+		log.Println("Failed to list audit events:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	hasMore := len(events) > auditPageSize
+	if hasMore {
+		events = events[:auditPageSize]
+	}
+
+	pageURL := func(p int) string {
+		query := r.URL.Query()
+		query.Set("page", strconv.Itoa(p))
+		return "/audit?" + query.Encode()
+	}
+	exportQuery := r.URL.Query()
+	exportQuery.Del("page")
+
+	type ViewModel struct {
+		Events    []AuditEvent
+		Query     url.Values
+		PrevURL   string
+		NextURL   string
+		ExportURL string
+	}
+	vm := ViewModel{
+		Events:    events,
+		Query:     r.URL.Query(),
+		ExportURL: "/audit/export?" + exportQuery.Encode(),
+	}
+	if page > 1 {
+		vm.PrevURL = pageURL(page - 1)
+	}
+	if hasMore {
+		vm.NextURL = pageURL(page + 1)
+	}
+
+	tmpl := app.template("audit.html")
+	err = tmpl.Execute(w, vm)
+	if err != nil {
+		log.Println("Failed to execute template:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// AuditExportHandler downloads the filtered audit log as JSON lines
+func (app *App) AuditExportHandler(w http.ResponseWriter, r *http.Request) {
+	events, err := app.listAuditEvents(parseAuditFilter(r.URL.Query()))
+	if err != nil {
+		log.Println("Failed to list audit events:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit-log.jsonl"`)
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		if err = enc.Encode(e); err != nil {
+			log.Println("Failed to write audit export:", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package shtnr
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// sessionCookie returns a session cookie logging the request in as the user
+func sessionCookie(t *testing.T, username string) *http.Cookie {
+	t.Helper()
+	encoded, err := app.sc.Encode("session", map[string]string{"username": username, "token": "authenticated"})
+	if err != nil {
+		t.Fatalf("Failed to encode session: %v", err)
+	}
+	return &http.Cookie{Name: "session_token", Value: encoded}
+}
+
+func TestAuditLinkChanges(t *testing.T) {
+	clearTable()
+	cookie := sessionCookie(t, "testadmin")
+
+	rr := postForm(app.ShortenURL, "/shorten", url.Values{"url": {"http://audited.com"}, "shortURL": {"audited"}}, []*http.Cookie{cookie})
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("Expected status %d, got %d", http.StatusSeeOther, rr.Code)
+	}
+
+	r := chi.NewRouter()
+	r.Post("/{shortURL}/delete", app.DeleteShortLink)
+	req, _ := http.NewRequest("POST", "/audited/delete", nil)
+	req.AddCookie(cookie)
+	req.RemoteAddr = "198.51.100.7:5000"
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	events, err := app.listAuditEvents(auditFilter{Target: "audited"})
+	if err != nil {
+		t.Fatalf("listAuditEvents failed: %v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(events))
+	}
+
+	deleted, created := events[0], events[1]
+	if created.Action != "link.create" || created.Actor != "testadmin" || created.Before != nil {
+		t.Errorf("Unexpected create event: %+v", created)
+	}
+	var after Link
+	if err = json.Unmarshal(created.After, &after); err != nil || after.LongLink != "http://audited.com" {
+		t.Errorf("Expected the created link in the after value, got %s", created.After)
+	}
+	if deleted.Action != "link.delete" || deleted.IP != "198.51.100.7" || deleted.After != nil {
+		t.Errorf("Unexpected delete event: %+v", deleted)
+	}
+	if !strings.Contains(string(deleted.Before), "http://audited.com") {
+		t.Errorf("Expected the deleted link in the before value, got %s", deleted.Before)
+	}
+}
+
+func TestAuditFilter(t *testing.T) {
+	_ = app.insertAuditEvent(AuditEvent{Actor: "filter-alice", Action: "link.create", Target: "f1"})
+	_ = app.insertAuditEvent(AuditEvent{Actor: "filter-alice", Action: "login", Target: "filter-alice"})
+	_ = app.insertAuditEvent(AuditEvent{Actor: "filter-bob", Action: "link.delete", Target: "f1"})
+
+	events, _ := app.listAuditEvents(auditFilter{Actor: "filter-alice"})
+	if len(events) != 2 {
+		t.Errorf("Expected 2 events for actor, got %d", len(events))
+	}
+	events, _ = app.listAuditEvents(auditFilter{Action: "link.", Target: "f1"})
+	if len(events) != 2 {
+		t.Errorf("Expected 2 link events, got %d", len(events))
+	}
+	// wildcards typed into the filter are matched as they are
+	events, _ = app.listAuditEvents(auditFilter{Action: "link_", Target: "f1"})
+	if len(events) != 0 {
+		t.Errorf("Expected _ not to be a wildcard, got %d events", len(events))
+	}
+	events, _ = app.listAuditEvents(auditFilter{Action: "%create", Target: "f1"})
+	if len(events) != 0 {
+		t.Errorf("Expected %% not to be a wildcard, got %d events", len(events))
+	}
+	events, _ = app.listAuditEvents(auditFilter{Actor: "filter-alice", Limit: 1})
+	if len(events) != 1 || events[0].Action != "login" {
+		t.Errorf("Expected only the newest event, got %+v", events)
+	}
+	events, _ = app.listAuditEvents(auditFilter{Actor: "filter-alice", From: time.Now().Add(time.Hour)})
+	if len(events) != 0 {
+		t.Errorf("Expected no events in the future, got %d", len(events))
+	}
+}
+
+func TestAuditLogIsAppendOnly(t *testing.T) {
+	_ = app.insertAuditEvent(AuditEvent{Actor: "tamper", Action: "login"})
+	if _, err := testApp.db.Exec("UPDATE audit_log SET actor = 'someone-else' WHERE actor = 'tamper'"); err == nil {
+		t.Error("Expected audit log updates to be refused")
+	}
+	if _, err := testApp.db.Exec("DELETE FROM audit_log WHERE actor = 'tamper'"); err == nil {
+		t.Error("Expected audit log deletes to be refused")
+	}
+}
+
+func TestAuditExportHandler(t *testing.T) {
+	_ = app.insertAuditEvent(AuditEvent{Actor: "export-test", Action: "link.create", Target: "exp", After: json.RawMessage(`{"short_code":"exp"}`)})
+
+	req, _ := http.NewRequest("GET", "/audit/export?actor=export-test", nil)
+	rr := httptest.NewRecorder()
+	app.AuditExportHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	if rr.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("Unexpected content type %s", rr.Header().Get("Content-Type"))
+	}
+	scanner := bufio.NewScanner(rr.Body)
+	lines := 0
+	for scanner.Scan() {
+		var e AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("Export line is not JSON: %v", err)
+		}
+		if e.Actor != "export-test" || string(e.After) != `{"short_code":"exp"}` {
+			t.Errorf("Unexpected exported event: %+v", e)
+		}
+		lines++
+	}
+	if lines != 1 {
+		t.Errorf("Expected 1 exported line, got %d", lines)
+	}
+}
+
+func TestAuditLogHandlerRequiresAdmin(t *testing.T) {
+	createTestUser(t, "audit-editor", "editor")
+	r := chi.NewRouter()
+	r.With(app.AuthMiddleware, app.RoleMiddleware("admin")).Get("/audit", app.AuditLogHandler)
+
+	req, _ := http.NewRequest("GET", "/audit", nil)
+	req.AddCookie(sessionCookie(t, "audit-editor"))
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d for editor, got %d", http.StatusForbidden, rr.Code)
+	}
+
+	_ = app.insertAuditEvent(AuditEvent{Actor: "page-test", Action: "link.create", Target: "page"})
+	req, _ = http.NewRequest("GET", "/audit?actor=page-test", nil)
+	req.AddCookie(sessionCookie(t, "testadmin"))
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d for admin, got %d", http.StatusOK, rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "page-test") {
+		t.Error("Expected the audit page to list the event")
+	}
+}
@@ -0,0 +1,514 @@
+package shtnr
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const cliUsage = `Usage: shortner [command]
+
+Commands:
+  serve                                start the web server (the default)
+  migrate                              bring the database schema up to date
+  user add [-role ROLE] USERNAME       add a user, reading the password from standard input
+  user passwd USERNAME                 change a user's password, reading it from standard input
+  apikey create NAME                   create an API key and print it
+  apikey revoke NAME                   stop an API key from working
+  apikey list                          list the API keys that have not been revoked
+  link create [-code CODE] URL         create a short link
+  link list [-q TEXT] [-from DATE] [-to DATE] [-archived] [-sort COLUMN] [-limit N] [-offset N]
+                                       list short links
+  link delete CODE                     move a short link to the trash
+  link restore CODE                    take a short link back out of the trash
+  export [-format json|csv] [-o FILE]  export every link
+  import [-format FORMAT] [-mode skip|overwrite] [-dry-run] FILE
+                                       import links from a file
+
+Flags go before arguments. Run "shortner COMMAND -h" to see the flags of a command.
+`
+
+// userRoles are the roles that can be given to users added from the command line
+var userRoles = []string{"admin", "editor"}
+
+// Run runs one of the shortner command's subcommands, given as args. Every command
+// except serve works directly on the database, so maintenance can be scripted without
+// going through the API.
+func (app *App) Run(args []string, in io.Reader, out io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(out, cliUsage)
+		return errors.New("a command is needed")
+	}
+	if args[0] != "migrate" {
+		if err := migrate(app.db); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	switch args[0] {
+	case "serve":
+		err = app.serveCommand(args[1:], out)
+	case "migrate":
+		err = app.migrateCommand(args[1:], out)
+	case "user":
+		err = app.userCommand(args[1:], in, out)
+	case "apikey":
+		err = app.apiKeyCommand(args[1:], out)
+	case "link":
+		err = app.linkCommand(args[1:], out)
+	case "export":
+		err = app.exportCommand(args[1:], out)
+	case "import":
+		err = app.importCommand(args[1:], out)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(out, cliUsage)
+	default:
+		fmt.Fprint(out, cliUsage)
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	return err
+}
+
+func newFlagSet(name, usage string, out io.Writer) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.Usage = func() {
+		fmt.Fprintf(out, "Usage: shortner %s\n", usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parseFlags parses the arguments of a command and checks it was given the right
+// number of arguments after its flags
+func parseFlags(flags *flag.FlagSet, args []string, nargs int) error {
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != nargs {
+		flags.Usage()
+		return fmt.Errorf("%s takes %d argument(s)", flags.Name(), nargs)
+	}
+	return nil
+}
+
+// subcommand returns the name of a command's subcommand, such as add in "user add"
+func subcommand(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
+
+// auditCLI records an action taken from the command line in the audit log
+func (app *App) auditCLI(action, target string, before, after any) error {
+	err := app.insertAuditEvent(AuditEvent{
+		Actor:  "cli",
+		Action: action,
+		Target: target,
+		Before: auditSnapshot(before),
+		After:  auditSnapshot(after),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record %s in audit log: %w", action, err)
+	}
+	return nil
+}
+
+// readPassword reads a password from the first line of the input
+func readPassword(in io.Reader, out io.Writer) (string, error) {
+	fmt.Fprint(out, "Password: ")
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	fmt.Fprintln(out)
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("password must not be empty")
+	}
+	return password, nil
+}
+
+// serveCommand starts the web server
+func (app *App) serveCommand(args []string, out io.Writer) error {
+	if err := parseFlags(newFlagSet("serve", "serve", out), args, 0); err != nil {
+		return err
+	}
+	if err := app.setup(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "Server started at :", app.config.port)
+	return http.ListenAndServe(fmt.Sprintf(":%s", app.config.port), app.routes())
+}
+
+// migrateCommand applies any migrations that haven't been run yet
+func (app *App) migrateCommand(args []string, out io.Writer) error {
+	if err := parseFlags(newFlagSet("migrate", "migrate", out), args, 0); err != nil {
+		return err
+	}
+	before, err := schemaVersion(app.db)
+	if err != nil {
+		return err
+	}
+	if err = migrate(app.db); err != nil {
+		return err
+	}
+	after, err := schemaVersion(app.db)
+	if err != nil {
+		return err
+	}
+	if after == before {
+		fmt.Fprintf(out, "Database schema is up to date at version %d\n", after)
+	} else {
+		fmt.Fprintf(out, "Migrated database schema from version %d to %d\n", before, after)
+	}
+	return nil
+}
+
+// userCommand adds users and changes their passwords
+func (app *App) userCommand(args []string, in io.Reader, out io.Writer) error {
+	switch subcommand(args) {
+	case "add":
+		flags := newFlagSet("user add", "user add [-role ROLE] USERNAME", out)
+		role := flags.String("role", "editor", "role of the user: "+strings.Join(userRoles, " or "))
+		if err := parseFlags(flags, args[1:], 1); err != nil {
+			return err
+		}
+		if !slices.Contains(userRoles, *role) {
+			return fmt.Errorf("role must be one of %s", strings.Join(userRoles, ", "))
+		}
+		username := flags.Arg(0)
+		password, err := readPassword(in, out)
+		if err != nil {
+			return err
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return fmt.Errorf("failed to hash password: %w", err)
+		}
+		if err = app.createUser(username, string(hash), *role); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Added %s as %s\n", username, *role)
+		return app.auditCLI("user.create", username, nil, map[string]string{"role": *role})
+
+	case "passwd":
+		flags := newFlagSet("user passwd", "user passwd USERNAME", out)
+		if err := parseFlags(flags, args[1:], 1); err != nil {
+			return err
+		}
+		username := flags.Arg(0)
+		password, err := readPassword(in, out)
+		if err != nil {
+			return err
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return fmt.Errorf("failed to hash password: %w", err)
+		}
+		err = app.setUserPassword(username, string(hash))
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("no user called %s", username)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Changed the password of %s\n", username)
+		return app.auditCLI("user.password", username, nil, nil)
+
+	default:
+		fmt.Fprint(out, cliUsage)
+		return errors.New("user needs a subcommand: add or passwd")
+	}
+}
+
+// apiKeyCommand creates, revokes and lists API keys
+func (app *App) apiKeyCommand(args []string, out io.Writer) error {
+	switch subcommand(args) {
+	case "create":
+		flags := newFlagSet("apikey create", "apikey create NAME", out)
+		if err := parseFlags(flags, args[1:], 1); err != nil {
+			return err
+		}
+		name := flags.Arg(0)
+		key, err := generateAPIKey()
+		if err != nil {
+			return err
+		}
+		if err = app.createAPIKey(name, hashAPIKey(key)); err != nil {
+			return err
+		}
+		if err = app.auditCLI("apikey.create", name, nil, nil); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Created API key %s. It won't be shown again:\n%s\n", name, key)
+		return nil
+
+	case "revoke":
+		flags := newFlagSet("apikey revoke", "apikey revoke NAME", out)
+		if err := parseFlags(flags, args[1:], 1); err != nil {
+			return err
+		}
+		name := flags.Arg(0)
+		err := app.revokeAPIKey(name)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("no API key called %s", name)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Revoked API key %s\n", name)
+		return app.auditCLI("apikey.revoke", name, nil, nil)
+
+	case "list":
+		if err := parseFlags(newFlagSet("apikey list", "apikey list", out), args[1:], 0); err != nil {
+			return err
+		}
+		keys, err := app.listAPIKeys()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tCREATED (UTC)")
+		for _, k := range keys {
+			fmt.Fprintf(tw, "%s\t%s\n", k.name, k.createdAt.UTC().Format(sqliteTimeFormat))
+		}
+		return tw.Flush()
+
+	default:
+		fmt.Fprint(out, cliUsage)
+		return errors.New("apikey needs a subcommand: create, revoke or list")
+	}
+}
+
+// linkCommand creates, lists and deletes links
+func (app *App) linkCommand(args []string, out io.Writer) error {
+	switch subcommand(args) {
+	case "create":
+		flags := newFlagSet("link create", "link create [-code CODE] URL", out)
+		code := flags.String("code", "", "short code to use (default: a random one)")
+		if err := parseFlags(flags, args[1:], 1); err != nil {
+			return err
+		}
+		link := Link{ShortCode: *code, LongLink: flags.Arg(0)}
+		if !isValidURL(link.LongLink) {
+			return errors.New("invalid URL")
+		}
+		if err := validatePlaceholders(link.LongLink); err != nil {
+			return err
+		}
+		if link.ShortCode != "" && !isValidShortCode(link.ShortCode) {
+			return errors.New(invalidShortCodeMessage)
+		}
+		id, err := app.insertLink(&link)
+		if err != nil {
+			return err
+		}
+		link.ID = int(id)
+		fmt.Fprintf(out, "%s/%s\n", app.config.siteURL(), link.ShortCode)
+		return app.auditCLI("link.create", link.ShortCode, nil, link)
+
+	case "list":
+		flags := newFlagSet("link list", "link list [-q TEXT] [-from DATE] [-to DATE] [-archived] [-sort COLUMN] [-limit N] [-offset N]", out)
+		q := linkQuery{}
+		flags.StringVar(&q.Search, "q", "", "only list links whose short code, URL, title, description or notes contain the text")
+		from := flags.String("from", "", "only list links created on or after the date (YYYY-MM-DD) or time")
+		to := flags.String("to", "", "only list links created on or before the date (YYYY-MM-DD) or time")
+		flags.BoolVar(&q.Archived, "archived", false, "list the archived links instead of the ones in use")
+		sort := flags.String("sort", "id", "column to sort by: id, short_code, clicks, created, updated or visited, prefixed with - to reverse it")
+		flags.IntVar(&q.Limit, "limit", defaultPageSize, "number of links to list")
+		flags.IntVar(&q.Offset, "offset", 0, "number of links to skip")
+		if err := parseFlags(flags, args[1:], 0); err != nil {
+			return err
+		}
+		if !q.setSort(*sort) {
+			return fmt.Errorf("cannot sort by %s", strings.TrimPrefix(*sort, "-"))
+		}
+		if err := q.setCreatedRange(*from, *to); err != nil {
+			return err
+		}
+		links, total, err := app.listLinks(q)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tSHORT CODE\tURL\tCLICKS\tCREATED")
+		for _, l := range links {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%s\n", l.ID, l.ShortCode, l.LongLink, l.TimesAccessed, l.CreatedAt.UTC().Format(time.DateTime))
+		}
+		if err = tw.Flush(); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%d of %d links\n", len(links), total)
+		return nil
+
+	case "delete":
+		flags := newFlagSet("link delete", "link delete CODE", out)
+		if err := parseFlags(flags, args[1:], 1); err != nil {
+			return err
+		}
+		link, err := app.getLinkByShortCode(flags.Arg(0))
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("no link with short code %s", flags.Arg(0))
+		}
+		if err != nil {
+			return err
+		}
+		if err = app.deleteLink(link.ShortCode); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Moved %s to the trash\n", link.ShortCode)
+		return app.auditCLI("link.delete", link.ShortCode, link, nil)
+
+	case "restore":
+		flags := newFlagSet("link restore", "link restore CODE", out)
+		if err := parseFlags(flags, args[1:], 1); err != nil {
+			return err
+		}
+		before, err := app.getTrashedLink(flags.Arg(0))
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("no link with short code %s in the trash", flags.Arg(0))
+		}
+		if err != nil {
+			return err
+		}
+		if err = app.restoreLink(before.ShortCode); err != nil {
+			return err
+		}
+		after, err := app.getLinkByID(int64(before.ID))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Restored %s\n", after.ShortCode)
+		return app.auditCLI("link.restore", after.ShortCode, before, after)
+
+	default:
+		fmt.Fprint(out, cliUsage)
+		return errors.New("link needs a subcommand: create, list, delete or restore")
+	}
+}
+
+// exportCommand writes every link to standard output or a file
+func (app *App) exportCommand(args []string, out io.Writer) error {
+	flags := newFlagSet("export", "export [-format json|csv] [-o FILE]", out)
+	format := flags.String("format", "json", "format to export: json or csv")
+	path := flags.String("o", "", "file to write (default: standard output)")
+	if err := parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+	if *format != "json" && *format != "csv" {
+		return errors.New("format must be json or csv")
+	}
+	links, err := app.getAllLinks()
+	if err != nil {
+		return err
+	}
+
+	w := out
+	if *path != "" {
+		file, err := os.Create(*path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	if *format == "csv" {
+		err = encodeLinksCSV(w, links)
+	} else {
+		err = encodeLinksJSON(w, links)
+	}
+	if err != nil {
+		return err
+	}
+	if *path != "" {
+		fmt.Fprintf(out, "Exported %d links to %s\n", len(links), *path)
+	}
+	return nil
+}
+
+// importCommand imports links from a file exported by Shtnr or another shortener
+func (app *App) importCommand(args []string, out io.Writer) error {
+	flags := newFlagSet("import", "import [-format FORMAT] [-mode skip|overwrite] [-dry-run] FILE", out)
+	format := flags.String("format", "", "format of the file: csv, json, yourls-sql, yourls-json or bitly-csv (default: from the file extension)")
+	mode := flags.String("mode", importModeSkip, "what to do with short codes that are already in use: skip or overwrite")
+	dryRun := flags.Bool("dry-run", false, "report what would be imported without saving anything")
+	if err := parseFlags(flags, args, 1); err != nil {
+		return err
+	}
+	if *mode != importModeSkip && *mode != importModeOverwrite {
+		return fmt.Errorf("mode must be %s or %s", importModeSkip, importModeOverwrite)
+	}
+
+	path := flags.Arg(0)
+	if *format == "" {
+		*format = strings.TrimPrefix(filepath.Ext(path), ".")
+		if *format == "sql" {
+			*format = "yourls-sql"
+		}
+	}
+	decode, ok := linkDecoders[*format]
+	if !ok {
+		return fmt.Errorf("unsupported format %q", *format)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	records, err := decode(file)
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %w", path, err)
+	}
+	report, err := app.importRecords(records, *mode, *dryRun)
+	if err != nil {
+		return fmt.Errorf("failed to import links: %w", err)
+	}
+	if !report.DryRun {
+		if err = app.auditCLI("link.import", report.Mode, nil, report.summary()); err != nil {
+			return err
+		}
+	}
+	return printImportReport(out, report)
+}
+
+// printImportReport lists the rows that weren't simply created, then the totals
+func printImportReport(out io.Writer, report ImportReport) error {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROW\tSTATUS\tSHORT CODE\tURL\tMESSAGE")
+	for _, row := range report.Rows {
+		if row.Status != importCreated {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", row.Row, row.Status, row.ShortCode, row.LongLink, row.Message)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	verb := "Imported"
+	if report.DryRun {
+		verb = "Dry run, nothing saved. Would import"
+	}
+	_, err := fmt.Fprintf(out, "%s %d of %d links: %d created, %d overwritten, %d conflicts, %d invalid\n",
+		verb, report.Created+report.Updated, len(report.Rows), report.Created, report.Updated, report.Conflict, report.Invalid)
+	return err
+}
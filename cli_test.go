@@ -0,0 +1,183 @@
+package shtnr
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestImportCommand(t *testing.T) {
+	clearTable()
+	_, _ = app.insertLink(&Link{ShortCode: "taken", LongLink: "http://taken.com"})
+
+	path := filepath.Join(t.TempDir(), "bitly.csv")
+	export := "Bitlink,Long URL,Clicks\nbit.ly/fresh,https://example.com/fresh,5\nbit.ly/taken,https://example.com/taken,9\nbit.ly/bad,nope,1\n"
+	if err := os.WriteFile(path, []byte(export), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := app.Run([]string{"import", "-format", "bitly-csv", "-dry-run", path}, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Would import 1 of 3 links: 1 created, 0 overwritten, 1 conflicts, 1 invalid") {
+		t.Errorf("Expected a dry run report, got:\n%s", out.String())
+	}
+	if countLinks(t) != 1 {
+		t.Error("Expected a dry run not to save anything")
+	}
+
+	out.Reset()
+	if err := app.Run([]string{"import", "-format", "bitly-csv", "-mode", "overwrite", path}, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Imported 2 of 3 links: 1 created, 1 overwritten") {
+		t.Errorf("Expected an import report, got:\n%s", out.String())
+	}
+	if link, _ := app.getLinkByShortCode("fresh"); link.TimesAccessed != 5 {
+		t.Errorf("Expected the click count to be imported, got %+v", link)
+	}
+	if link, _ := app.getLinkByShortCode("taken"); link.LongLink != "https://example.com/taken" {
+		t.Errorf("Expected the existing link to be overwritten, got %+v", link)
+	}
+
+	if err := app.Run([]string{"import", path}, nil, &out); err == nil {
+		t.Error("Expected an error when reading a Bitly export as a Shtnr CSV")
+	}
+}
+
+// runTestCommand runs a subcommand, failing the test if it returns an error
+func runTestCommand(t *testing.T, input string, args ...string) string {
+	t.Helper()
+	var out bytes.Buffer
+	if err := app.Run(args, strings.NewReader(input), &out); err != nil {
+		t.Fatalf("%v failed: %v\n%s", args, err, out.String())
+	}
+	return out.String()
+}
+
+func TestUnknownCommand(t *testing.T) {
+	var out bytes.Buffer
+	if err := app.Run([]string{"frobnicate"}, nil, &out); err == nil {
+		t.Error("Expected an error for an unknown command")
+	}
+	if err := app.Run([]string{"link"}, nil, &out); err == nil {
+		t.Error("Expected an error for a missing subcommand")
+	}
+	out.Reset()
+	if err := app.Run(nil, nil, &out); err == nil || !strings.Contains(out.String(), "Usage") {
+		t.Errorf("Expected the usage and an error without a command, got %v:\n%s", err, out.String())
+	}
+	if err := app.Run([]string{"link", "delete", "-h"}, nil, &out); err != nil {
+		t.Errorf("Expected asking for help not to be an error, got %v", err)
+	}
+}
+
+func TestMigrateCommand(t *testing.T) {
+	out := runTestCommand(t, "", "migrate")
+	if !strings.Contains(out, fmt.Sprintf("up to date at version %d", len(migrations))) {
+		t.Errorf("Expected the schema to be reported as up to date, got %q", out)
+	}
+}
+
+func TestUserCommands(t *testing.T) {
+	runTestCommand(t, "first-password\n", "user", "add", "-role", "admin", "cli-user")
+	u, err := app.getUserByUsername("cli-user")
+	if err != nil || u.role != "admin" || bcrypt.CompareHashAndPassword([]byte(u.passwordHashed), []byte("first-password")) != nil {
+		t.Fatalf("Expected the user to be added, got %+v, %v", u, err)
+	}
+
+	runTestCommand(t, "second-password\n", "user", "passwd", "cli-user")
+	u, _ = app.getUserByUsername("cli-user")
+	if bcrypt.CompareHashAndPassword([]byte(u.passwordHashed), []byte("second-password")) != nil {
+		t.Error("Expected the password to be changed")
+	}
+
+	var out bytes.Buffer
+	if err = app.Run([]string{"user", "add", "cli-user"}, strings.NewReader("x\n"), &out); !errors.Is(err, errUserExists) {
+		t.Errorf("Expected adding an existing user to fail, got %v", err)
+	}
+	if err = app.Run([]string{"user", "add", "-role", "owner", "cli-owner"}, strings.NewReader("x\n"), &out); err == nil {
+		t.Error("Expected an unknown role to be rejected")
+	}
+	if err = app.Run([]string{"user", "passwd", "nobody"}, strings.NewReader("x\n"), &out); err == nil {
+		t.Error("Expected changing the password of a missing user to fail")
+	}
+}
+
+func TestAPIKeyCommands(t *testing.T) {
+	out := runTestCommand(t, "", "apikey", "create", "ci")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	key := lines[len(lines)-1]
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		t.Fatalf("Expected the key to be printed, got %q", out)
+	}
+	if out = runTestCommand(t, "", "apikey", "list"); !strings.Contains(out, "ci") {
+		t.Errorf("Expected the key to be listed, got %q", out)
+	}
+
+	request := func() int {
+		req, _ := http.NewRequest("GET", "/api/v1/links", nil)
+		req.Header.Set("X-API-KEY", key)
+		rr := httptest.NewRecorder()
+		app.routes().ServeHTTP(rr, req)
+		return rr.Code
+	}
+	if code := request(); code != http.StatusOK {
+		t.Errorf("Expected the new key to work, got status %d", code)
+	}
+
+	runTestCommand(t, "", "apikey", "revoke", "ci")
+	if code := request(); code != http.StatusUnauthorized {
+		t.Errorf("Expected the revoked key to be rejected, got status %d", code)
+	}
+	// the name can be used again once the old key is revoked
+	runTestCommand(t, "", "apikey", "create", "ci")
+	runTestCommand(t, "", "apikey", "revoke", "ci")
+}
+
+func TestLinkCommands(t *testing.T) {
+	clearTable()
+
+	out := runTestCommand(t, "", "link", "create", "-code", "cli", "http://cli.com")
+	if strings.TrimSpace(out) != app.config.siteURL()+"/cli" {
+		t.Errorf("Expected the short link to be printed, got %q", out)
+	}
+	runTestCommand(t, "", "link", "create", "http://random.com")
+
+	out = runTestCommand(t, "", "link", "list", "-q", "cli")
+	if !strings.Contains(out, "http://cli.com") || strings.Contains(out, "random") || !strings.Contains(out, "1 of 1 links") {
+		t.Errorf("Expected only the matching link to be listed, got:\n%s", out)
+	}
+
+	out = runTestCommand(t, "", "export", "-format", "csv")
+	if !strings.HasPrefix(out, strings.Join(linkCSVHeader, ",")+"\n") || !strings.Contains(out, ",cli,http://cli.com,0,") {
+		t.Errorf("Expected a CSV export, got:\n%s", out)
+	}
+
+	runTestCommand(t, "", "link", "delete", "cli")
+	if _, err := app.getLinkByShortCode("cli"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected the link to be deleted, got %v", err)
+	}
+	events, _ := app.listAuditEvents(auditFilter{Action: "link.delete", Target: "cli", Limit: 1})
+	if len(events) != 1 || events[0].Actor != "cli" {
+		t.Errorf("Expected the deletion to be audited, got %+v", events)
+	}
+
+	out = runTestCommand(t, "", "link", "restore", "cli")
+	if !strings.Contains(out, "Restored cli") {
+		t.Errorf("Expected the link to be restored, got:\n%s", out)
+	}
+	if _, err := app.getLinkByShortCode("cli"); err != nil {
+		t.Errorf("Expected the restored link to be found, got %v", err)
+	}
+}
@@ -0,0 +1,558 @@
+// Package client is a Go client for the shtnr API. It creates, looks up, lists,
+// updates, rolls back, deletes and restores short links, and finds and archives the
+// ones nobody uses, retrying requests that fail for temporary reasons.
+//
+//	c := client.New("https://sho.rt", os.Getenv("SHTNR_API_KEY"))
+//	link, err := c.CreateLink(ctx, client.CreateLinkParams{URL: "https://example.com"})
+//	if errors.Is(err, client.ErrConflict) {
+//		// the short code is taken
+//	}
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Link is a short link and the long URL it redirects to
+type Link struct {
+	ID            int       `json:"id"`
+	ShortCode     string    `json:"short_code"`
+	LongLink      string    `json:"long_link"`
+	TimesAccessed int       `json:"times_accessed"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	// LastAccessedAt is nil when the link has not been visited since visits
+	// started being timed
+	LastAccessedAt *time.Time `json:"last_accessed_at"`
+	// ArchivedAt is set while the link is archived
+	ArchivedAt *time.Time `json:"archived_at"`
+	// DeletedAt is set while the link is in the trash
+	DeletedAt *time.Time `json:"deleted_at"`
+	// Tags group related links, in alphabetical order
+	Tags []string `json:"tags"`
+	// Title, Description and Notes say what the link is for
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Notes       string `json:"notes"`
+	// QueryPassthrough is what happens to the query string the link is followed
+	// with: "off", "keep", "override" or "append"
+	QueryPassthrough string `json:"query_passthrough"`
+	// PathPassthrough appends any path after the short code to the long URL
+	PathPassthrough bool `json:"path_passthrough"`
+	// FallbackURL is where a template goes when it is missing a value for one of
+	// its placeholders
+	FallbackURL string `json:"fallback_url"`
+}
+
+// LinkList is a page of links
+type LinkList struct {
+	Links  []Link `json:"links"`
+	Total  int    `json:"total"`
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
+}
+
+// TagStats is how much the links with a tag are used between them
+type TagStats struct {
+	Tag    string `json:"tag"`
+	Links  int    `json:"links"`
+	Clicks int    `json:"clicks"`
+}
+
+// CampaignStats is how much the links of a UTM campaign are used between them
+type CampaignStats struct {
+	Campaign string   `json:"campaign"`
+	Links    int      `json:"links"`
+	Clicks   int      `json:"clicks"`
+	Sources  []string `json:"sources"`
+	Mediums  []string `json:"mediums"`
+}
+
+// Revision is a version of everything about a link that can be edited
+type Revision struct {
+	Revision         int       `json:"revision"`
+	ShortCode        string    `json:"short_code"`
+	LongLink         string    `json:"long_link"`
+	Tags             []string  `json:"tags"`
+	Title            string    `json:"title"`
+	Description      string    `json:"description"`
+	Notes            string    `json:"notes"`
+	QueryPassthrough string    `json:"query_passthrough"`
+	PathPassthrough  bool      `json:"path_passthrough"`
+	FallbackURL      string    `json:"fallback_url"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// ListOptions filter, sort and page the links returned by ListLinks. Zero values
+// leave the server defaults in place.
+type ListOptions struct {
+	// Query only returns links whose short code, long URL, title, description or
+	// notes contain it
+	Query string
+	// Sort is a column such as "clicks" or "created", prefixed with "-" for descending
+	Sort string
+	// CreatedFrom and CreatedTo only return links created in that range, when set.
+	// Both ends are inclusive.
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	// Tag only returns links with this tag
+	Tag string
+	// Archived lists the archived links instead of the ones in use
+	Archived bool
+	Limit    int
+	Offset   int
+}
+
+// StaleOptions choose which links StaleLinks reports
+type StaleOptions struct {
+	// Days without a visit before a link is stale, 90 when zero
+	Days int
+	// NeverVisited only reports links that have never been visited
+	NeverVisited bool
+	Limit        int
+	Offset       int
+}
+
+// CreateLinkParams describe a link to create. A short code is generated when
+// ShortCode is empty.
+type CreateLinkParams struct {
+	URL       string   `json:"url"`
+	ShortCode string   `json:"short_code,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	// Title is filled in from the destination page when it is empty and the server
+	// fetches titles
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Notes       string `json:"notes,omitempty"`
+	// QueryPassthrough is "off" when empty
+	QueryPassthrough string `json:"query_passthrough,omitempty"`
+	PathPassthrough  bool   `json:"path_passthrough,omitempty"`
+	// URL can have placeholders such as {repo}, which make the link a template.
+	// FallbackURL is where it goes when one of them is not given a value.
+	FallbackURL string `json:"fallback_url,omitempty"`
+	// The UTM parameters are added to URL. UTMSource, UTMMedium and UTMCampaign
+	// must all be set when any of them are.
+	UTMSource   string `json:"utm_source,omitempty"`
+	UTMMedium   string `json:"utm_medium,omitempty"`
+	UTMCampaign string `json:"utm_campaign,omitempty"`
+	UTMTerm     string `json:"utm_term,omitempty"`
+	UTMContent  string `json:"utm_content,omitempty"`
+	// IdempotencyKey makes it safe to retry the request. One is generated when it
+	// is empty, so retries made by the client never create the link twice.
+	IdempotencyKey string `json:"-"`
+}
+
+// UpdateLinkParams change a link. Nil fields are left as they are.
+type UpdateLinkParams struct {
+	URL       *string `json:"url,omitempty"`
+	ShortCode *string `json:"short_code,omitempty"`
+	// Tags replaces all of the link's tags. An empty slice removes them.
+	Tags        *[]string `json:"tags,omitempty"`
+	Title       *string   `json:"title,omitempty"`
+	Description *string   `json:"description,omitempty"`
+	Notes       *string   `json:"notes,omitempty"`
+	// QueryPassthrough is "off", "keep", "override" or "append"
+	QueryPassthrough *string `json:"query_passthrough,omitempty"`
+	PathPassthrough  *bool   `json:"path_passthrough,omitempty"`
+	FallbackURL      *string `json:"fallback_url,omitempty"`
+	// Archived archives the link when true and brings it back when false
+	Archived *bool `json:"archived,omitempty"`
+}
+
+// BulkResult reports what a bulk action did
+type BulkResult struct {
+	Action   string `json:"action"`
+	Affected int    `json:"affected"`
+	// NotFound lists the short codes that did not match a link
+	NotFound []string `json:"not_found"`
+}
+
+// Stats are the usage figures for a link
+type Stats struct {
+	ShortCode     string
+	TimesAccessed int
+	// LastAccessedAt is nil when the link has not been visited since visits
+	// started being timed
+	LastAccessedAt *time.Time
+}
+
+// Client calls the shtnr API. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+	retries    int
+	retryWait  time.Duration
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient sets the http.Client used to send requests
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// WithRetries sets how many times a failed request is retried and how long to wait
+// before the first retry. The wait doubles after each attempt. Zero retries turns
+// retrying off.
+func WithRetries(retries int, wait time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.retryWait = wait
+	}
+}
+
+// New returns a client for the server at baseURL, such as https://sho.rt,
+// authenticating with the given API key. By default failed requests are retried
+// three times.
+func New(baseURL, apiKey string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		apiKey:     apiKey,
+		httpClient: http.DefaultClient,
+		retries:    3,
+		retryWait:  500 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// CreateLink creates a short link
+func (c *Client) CreateLink(ctx context.Context, params CreateLinkParams) (*Link, error) {
+	key := params.IdempotencyKey
+	if key == "" {
+		key = newIdempotencyKey()
+	}
+	var link Link
+	header := http.Header{"Idempotency-Key": {key}}
+	if err := c.do(ctx, http.MethodPost, "/api/v1/links", nil, header, params, &link); err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// GetLink looks up a link by its short code
+func (c *Client) GetLink(ctx context.Context, shortCode string) (*Link, error) {
+	var link Link
+	if err := c.do(ctx, http.MethodGet, linkPath(shortCode), nil, nil, nil, &link); err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// ListLinks returns a page of links
+func (c *Client) ListLinks(ctx context.Context, opts ListOptions) (*LinkList, error) {
+	query := url.Values{}
+	if opts.Query != "" {
+		query.Set("q", opts.Query)
+	}
+	if opts.Sort != "" {
+		query.Set("sort", opts.Sort)
+	}
+	if !opts.CreatedFrom.IsZero() {
+		query.Set("created_from", opts.CreatedFrom.Format(time.RFC3339))
+	}
+	if !opts.CreatedTo.IsZero() {
+		query.Set("created_to", opts.CreatedTo.Format(time.RFC3339))
+	}
+	if opts.Tag != "" {
+		query.Set("tag", opts.Tag)
+	}
+	if opts.Archived {
+		query.Set("archived", "true")
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Offset > 0 {
+		query.Set("offset", strconv.Itoa(opts.Offset))
+	}
+	var list LinkList
+	if err := c.do(ctx, http.MethodGet, "/api/v1/links", query, nil, nil, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// UpdateLink changes the fields of a link that are set in params
+func (c *Client) UpdateLink(ctx context.Context, shortCode string, params UpdateLinkParams) (*Link, error) {
+	var link Link
+	if err := c.do(ctx, http.MethodPatch, linkPath(shortCode), nil, nil, params, &link); err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// Revisions lists every version of a link, newest first
+func (c *Client) Revisions(ctx context.Context, shortCode string) ([]Revision, error) {
+	var list struct {
+		Revisions []Revision `json:"revisions"`
+	}
+	if err := c.do(ctx, http.MethodGet, linkPath(shortCode)+"/revisions", nil, nil, nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Revisions, nil
+}
+
+// RollbackLink gives a link everything it had at an earlier revision, apart from its
+// visits and times
+func (c *Client) RollbackLink(ctx context.Context, shortCode string, revision int) (*Link, error) {
+	body := struct {
+		Revision int `json:"revision"`
+	}{revision}
+	var link Link
+	if err := c.do(ctx, http.MethodPost, linkPath(shortCode)+"/rollback", nil, nil, body, &link); err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// DeleteLink moves a link to the trash, where it can be restored until it is purged
+func (c *Client) DeleteLink(ctx context.Context, shortCode string) error {
+	return c.do(ctx, http.MethodDelete, linkPath(shortCode), nil, nil, nil, nil)
+}
+
+// Tags lists every tag in use, with how many links have it and how many clicks they
+// have had between them
+func (c *Client) Tags(ctx context.Context) ([]TagStats, error) {
+	var list struct {
+		Tags []TagStats `json:"tags"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/v1/tags", nil, nil, nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Tags, nil
+}
+
+// Campaigns adds up the clicks on links for each utm_campaign in their long URLs,
+// most clicked first
+func (c *Client) Campaigns(ctx context.Context) ([]CampaignStats, error) {
+	var list struct {
+		Campaigns []CampaignStats `json:"campaigns"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/v1/reports/campaigns", nil, nil, nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Campaigns, nil
+}
+
+// ListTrash returns a page of the links in the trash, most recently deleted first
+// unless opts.Sort says otherwise. The date and archive options are ignored.
+func (c *Client) ListTrash(ctx context.Context, opts ListOptions) (*LinkList, error) {
+	query := url.Values{}
+	if opts.Query != "" {
+		query.Set("q", opts.Query)
+	}
+	if opts.Sort != "" {
+		query.Set("sort", opts.Sort)
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Offset > 0 {
+		query.Set("offset", strconv.Itoa(opts.Offset))
+	}
+	var list LinkList
+	if err := c.do(ctx, http.MethodGet, "/api/v1/trash", query, nil, nil, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// RestoreLink takes a link back out of the trash
+func (c *Client) RestoreLink(ctx context.Context, shortCode string) (*Link, error) {
+	var link Link
+	if err := c.do(ctx, http.MethodPost, trashPath(shortCode)+"/restore", nil, nil, nil, &link); err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// PurgeLink deletes a link in the trash for good
+func (c *Client) PurgeLink(ctx context.Context, shortCode string) error {
+	return c.do(ctx, http.MethodDelete, trashPath(shortCode), nil, nil, nil, nil)
+}
+
+// Stats returns the usage figures for a link
+func (c *Client) Stats(ctx context.Context, shortCode string) (*Stats, error) {
+	link, err := c.GetLink(ctx, shortCode)
+	if err != nil {
+		return nil, err
+	}
+	return &Stats{ShortCode: link.ShortCode, TimesAccessed: link.TimesAccessed, LastAccessedAt: link.LastAccessedAt}, nil
+}
+
+// StaleLinks lists the links that have not been visited for a while, least recently
+// visited first. Archived links are left out.
+func (c *Client) StaleLinks(ctx context.Context, opts StaleOptions) (*LinkList, error) {
+	query := url.Values{}
+	if opts.Days > 0 {
+		query.Set("days", strconv.Itoa(opts.Days))
+	}
+	if opts.NeverVisited {
+		query.Set("never_visited", "true")
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Offset > 0 {
+		query.Set("offset", strconv.Itoa(opts.Offset))
+	}
+	var list LinkList
+	if err := c.do(ctx, http.MethodGet, "/api/v1/reports/stale", query, nil, nil, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// ArchiveLinks archives links. Archived links still redirect but are left out of
+// lists and reports.
+func (c *Client) ArchiveLinks(ctx context.Context, shortCodes ...string) (*BulkResult, error) {
+	return c.bulk(ctx, "archive", shortCodes)
+}
+
+// UnarchiveLinks brings links back from the archive
+func (c *Client) UnarchiveLinks(ctx context.Context, shortCodes ...string) (*BulkResult, error) {
+	return c.bulk(ctx, "unarchive", shortCodes)
+}
+
+// DeleteLinks moves links to the trash
+func (c *Client) DeleteLinks(ctx context.Context, shortCodes ...string) (*BulkResult, error) {
+	return c.bulk(ctx, "delete", shortCodes)
+}
+
+func (c *Client) bulk(ctx context.Context, action string, shortCodes []string) (*BulkResult, error) {
+	body := struct {
+		Action     string   `json:"action"`
+		ShortCodes []string `json:"short_codes"`
+	}{action, shortCodes}
+	var result BulkResult
+	if err := c.do(ctx, http.MethodPost, "/api/v1/links/bulk", nil, nil, body, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func linkPath(shortCode string) string {
+	return "/api/v1/links/" + url.PathEscape(shortCode)
+}
+
+func trashPath(shortCode string) string {
+	return "/api/v1/trash/" + url.PathEscape(shortCode)
+}
+
+// newIdempotencyKey returns a random key for a creation request
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// do sends a request, retrying it while it fails for temporary reasons, and decodes
+// a successful response into out
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, header http.Header, in, out any) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return fmt.Errorf("cannot encode request: %w", err)
+		}
+	}
+	endpoint := c.baseURL + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	// without an idempotency key a POST that timed out may have been applied
+	retryable := method != http.MethodPost || header.Get("Idempotency-Key") != ""
+
+	wait := c.retryWait
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, method, endpoint, header, body)
+		if err == nil && resp.StatusCode < 300 {
+			defer resp.Body.Close()
+			if out == nil {
+				return nil
+			}
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				return fmt.Errorf("cannot decode response: %w", err)
+			}
+			return nil
+		}
+
+		var delay time.Duration
+		if err == nil {
+			err = readError(resp)
+			delay = retryAfter(resp)
+			if !temporaryStatus(resp.StatusCode) {
+				return err
+			}
+		} else if ctx.Err() != nil {
+			return err
+		}
+		if !retryable || attempt >= c.retries {
+			return err
+		}
+
+		if delay == 0 {
+			delay = wait
+		}
+		wait *= 2
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, endpoint string, header http.Header, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-API-KEY", c.apiKey)
+	return c.httpClient.Do(req)
+}
+
+// temporaryStatus reports whether a request that got this status may succeed if
+// it is sent again. A 409 is not retried, as the only conflict that clears by
+// itself is an idempotent request still in progress.
+func temporaryStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// retryAfter reads the Retry-After header, in seconds, of a response
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
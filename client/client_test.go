@@ -0,0 +1,184 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a client for a server that handles every request with h and
+// retries without waiting long
+func newTestClient(t *testing.T, h http.HandlerFunc) *Client {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return New(srv.URL+"/", "secret", WithRetries(2, time.Millisecond))
+}
+
+func TestCreateLinkRequest(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v1/links" {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("X-API-KEY") != "secret" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected headers %v", r.Header)
+		}
+		if key := r.Header.Get("Idempotency-Key"); !regexp.MustCompile(`^[0-9a-f]{32}$`).MatchString(key) {
+			t.Errorf("Expected a generated Idempotency-Key, got %q", key)
+		}
+		var body map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if len(body) != 2 || body["url"] != "https://example.com" || body["short_code"] != "ex" {
+			t.Errorf("Expected only the fields that are set, got %v", body)
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"id": 1, "short_code": "ex", "long_link": "https://example.com", "tags": ["docs"]}`))
+	})
+
+	link, err := c.CreateLink(context.Background(), CreateLinkParams{URL: "https://example.com", ShortCode: "ex"})
+	if err != nil || link.ID != 1 || link.ShortCode != "ex" || len(link.Tags) != 1 {
+		t.Errorf("Unexpected link %+v, %v", link, err)
+	}
+}
+
+func TestListLinksQuery(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		want := "archived=true&created_from=2024-01-02T00%3A00%3A00Z&limit=5&offset=10&q=docs&sort=-clicks&tag=team"
+		if r.URL.Path != "/api/v1/links" || r.URL.RawQuery != want {
+			t.Errorf("Expected %s, got %s?%s", want, r.URL.Path, r.URL.RawQuery)
+		}
+		_, _ = w.Write([]byte(`{"links": [], "total": 0, "limit": 5, "offset": 10}`))
+	})
+
+	opts := ListOptions{
+		Query:       "docs",
+		Sort:        "-clicks",
+		CreatedFrom: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+		Tag:         "team",
+		Archived:    true,
+		Limit:       5,
+		Offset:      10,
+	}
+	if list, err := c.ListLinks(context.Background(), opts); err != nil || list.Limit != 5 || list.Offset != 10 {
+		t.Errorf("Unexpected list %+v, %v", list, err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/links/taken":
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(`{"error": {"code": "conflict", "message": "Short code is already in use"}}`))
+		default:
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		}
+	})
+	ctx := context.Background()
+
+	_, err := c.GetLink(ctx, "taken")
+	var apiErr *Error
+	if !errors.Is(err, ErrConflict) || !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusConflict || apiErr.Message != "Short code is already in use" {
+		t.Errorf("Expected a 409 conflict, got %v", err)
+	}
+	if errors.Is(err, ErrNotFound) {
+		t.Error("Expected errors with different codes not to match")
+	}
+
+	// responses without an error envelope still give an *Error
+	_, err = c.GetLink(ctx, "other")
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden || apiErr.Message != "Forbidden" || apiErr.Code != "" {
+		t.Errorf("Expected a 403 error, got %v", err)
+	}
+}
+
+func TestInvalidTag(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error": {"code": "invalid_tag", "message": "Tags may only contain lowercase letters"}}`))
+	})
+
+	_, err := c.CreateLink(context.Background(), CreateLinkParams{URL: "https://example.com", Tags: []string{"Not OK"}})
+	if !errors.Is(err, ErrInvalidTag) {
+		t.Errorf("Expected ErrInvalidTag, got %v", err)
+	}
+}
+
+func TestInvalidUTM(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error": {"code": "invalid_utm", "message": "utm_source, utm_medium and utm_campaign are needed"}}`))
+	})
+
+	_, err := c.CreateLink(context.Background(), CreateLinkParams{URL: "https://example.com", UTMCampaign: "spring"})
+	if !errors.Is(err, ErrInvalidUTM) {
+		t.Errorf("Expected ErrInvalidUTM, got %v", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var requests atomic.Int32
+	var keys []string
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"short_code": "ex"}`))
+	})
+
+	if _, err := c.CreateLink(context.Background(), CreateLinkParams{URL: "https://example.com"}); err != nil {
+		t.Fatalf("Expected the retry to succeed, got %v", err)
+	}
+	if len(keys) != 2 || keys[0] != keys[1] {
+		t.Errorf("Expected the retry to send the same Idempotency-Key, got %q", keys)
+	}
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	var requests atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error": {"code": "invalid_url", "message": "Invalid URL"}}`))
+	})
+
+	if _, err := c.CreateLink(context.Background(), CreateLinkParams{URL: "nope"}); !errors.Is(err, ErrInvalidURL) {
+		t.Errorf("Expected ErrInvalidURL, got %v", err)
+	}
+	if requests.Load() != 1 {
+		t.Errorf("Expected a bad request not to be retried, got %d requests", requests.Load())
+	}
+}
+
+func TestGivesUp(t *testing.T) {
+	var requests atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+	})
+
+	_, err := c.GetLink(context.Background(), "any")
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected a 503 error, got %v", err)
+	}
+	if requests.Load() != 3 {
+		t.Errorf("Expected 1 request and 2 retries, got %d requests", requests.Load())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = c.GetLink(ctx, "any"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Error codes returned by the API, see the ErrorDetail schema in openapi.json
+const (
+	CodeInvalidBody          = "invalid_body"
+	CodeInvalidURL           = "invalid_url"
+	CodeInvalidShortCode     = "invalid_short_code"
+	CodeInvalidTag           = "invalid_tag"
+	CodeInvalidUTM           = "invalid_utm"
+	CodeInvalidParameter     = "invalid_parameter"
+	CodeUnauthorized         = "unauthorized"
+	CodeNotFound             = "not_found"
+	CodeConflict             = "conflict"
+	CodeIdempotencyKeyReused = "idempotency_key_reused"
+	// CodeBatchFailed is given to an atomic batch that created nothing, and
+	// CodeNotCreated to the valid links in it
+	CodeBatchFailed = "batch_failed"
+	CodeNotCreated  = "not_created"
+	CodeInternal    = "internal_error"
+)
+
+// Sentinel errors to compare API errors against with errors.Is
+var (
+	ErrUnauthorized         = &Error{Code: CodeUnauthorized}
+	ErrNotFound             = &Error{Code: CodeNotFound}
+	ErrConflict             = &Error{Code: CodeConflict}
+	ErrInvalidURL           = &Error{Code: CodeInvalidURL}
+	ErrInvalidShortCode     = &Error{Code: CodeInvalidShortCode}
+	ErrInvalidTag           = &Error{Code: CodeInvalidTag}
+	ErrInvalidUTM           = &Error{Code: CodeInvalidUTM}
+	ErrIdempotencyKeyReused = &Error{Code: CodeIdempotencyKeyReused}
+)
+
+// Error is an error response from the API
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("shtnr: %s (%d %s)", e.Message, e.StatusCode, e.Code)
+}
+
+// Is matches errors with the same code, so errors.Is(err, ErrNotFound) reports
+// whether a link was not found
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// readError turns an error response into an *Error, closing its body
+func readError(resp *http.Response) error {
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+
+	var body struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	e := &Error{StatusCode: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+	if json.Unmarshal(data, &body) == nil && body.Error.Code != "" {
+		e.Code, e.Message = body.Error.Code, body.Error.Message
+	}
+	return e
+}
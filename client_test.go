@@ -0,0 +1,234 @@
+package shtnr
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dmt195/go-shtnr/client"
+)
+
+// newTestClient starts a server running the full router, optionally wrapped, and
+// returns a client for it that retries without waiting long
+func newTestClient(t *testing.T, wrap func(http.Handler) http.Handler, apiKey string) *client.Client {
+	t.Helper()
+	var h http.Handler = app.routes()
+	if wrap != nil {
+		h = wrap(h)
+	}
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return client.New(srv.URL, apiKey, client.WithRetries(2, time.Millisecond))
+}
+
+func TestClientLinks(t *testing.T) {
+	clearTable()
+	c := newTestClient(t, nil, "testapikey")
+	ctx := context.Background()
+
+	created, err := c.CreateLink(ctx, client.CreateLinkParams{URL: "https://example.com", ShortCode: "sdk"})
+	if err != nil {
+		t.Fatalf("CreateLink failed: %v", err)
+	}
+	if created.ShortCode != "sdk" || created.LongLink != "https://example.com" {
+		t.Errorf("Unexpected link %+v", created)
+	}
+	generated, err := c.CreateLink(ctx, client.CreateLinkParams{URL: "https://example.org"})
+	if err != nil || generated.ShortCode == "" {
+		t.Fatalf("Expected a generated short code, got %+v, %v", generated, err)
+	}
+
+	got, err := c.GetLink(ctx, "sdk")
+	if err != nil || !reflect.DeepEqual(got, created) {
+		t.Errorf("Expected %+v, got %+v, %v", created, got, err)
+	}
+
+	list, err := c.ListLinks(ctx, client.ListOptions{Query: "example.org", Limit: 10})
+	if err != nil {
+		t.Fatalf("ListLinks failed: %v", err)
+	}
+	if list.Total != 1 || len(list.Links) != 1 || list.Links[0].ShortCode != generated.ShortCode || list.Limit != 10 {
+		t.Errorf("Unexpected list %+v", list)
+	}
+
+	newURL := "https://example.net"
+	updated, err := c.UpdateLink(ctx, "sdk", client.UpdateLinkParams{URL: &newURL})
+	if err != nil || updated.LongLink != newURL {
+		t.Errorf("Expected the URL to be updated, got %+v, %v", updated, err)
+	}
+
+	rr := httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/sdk", nil))
+	if rr.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("Failed to follow link, got status %d", rr.Code)
+	}
+	stats, err := c.Stats(ctx, "sdk")
+	if err != nil || stats.TimesAccessed != 1 {
+		t.Errorf("Expected 1 access, got %+v, %v", stats, err)
+	}
+
+	if err = c.DeleteLink(ctx, "sdk"); err != nil {
+		t.Fatalf("DeleteLink failed: %v", err)
+	}
+	if _, err = c.GetLink(ctx, "sdk"); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound after deleting, got %v", err)
+	}
+
+	trash, err := c.ListTrash(ctx, client.ListOptions{})
+	if err != nil || trash.Total != 1 || trash.Links[0].ShortCode != "sdk" || trash.Links[0].DeletedAt == nil {
+		t.Fatalf("Expected the deleted link in the trash, got %+v, %v", trash, err)
+	}
+	restored, err := c.RestoreLink(ctx, "sdk")
+	if err != nil || restored.DeletedAt != nil || restored.LongLink != newURL {
+		t.Errorf("Expected the link to be restored, got %+v, %v", restored, err)
+	}
+	if _, err = c.RestoreLink(ctx, "sdk"); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound restoring a link not in the trash, got %v", err)
+	}
+
+	_ = c.DeleteLink(ctx, "sdk")
+	if err = c.PurgeLink(ctx, "sdk"); err != nil {
+		t.Fatalf("PurgeLink failed: %v", err)
+	}
+	if trash, err = c.ListTrash(ctx, client.ListOptions{}); err != nil || trash.Total != 0 {
+		t.Errorf("Expected the trash to be empty, got %+v, %v", trash, err)
+	}
+}
+
+func TestClientStaleLinks(t *testing.T) {
+	seedStaleLinks(t)
+	c := newTestClient(t, nil, "testapikey")
+	ctx := context.Background()
+
+	stale, err := c.StaleLinks(ctx, client.StaleOptions{Days: 150})
+	if err != nil || stale.Total != 1 || stale.Links[0].ShortCode != "unused" {
+		t.Fatalf("Expected the link unused for 150 days, got %+v, %v", stale, err)
+	}
+
+	result, err := c.ArchiveLinks(ctx, "unused", "missing")
+	if err != nil || result.Affected != 1 || len(result.NotFound) != 1 {
+		t.Errorf("Unexpected result %+v, %v", result, err)
+	}
+	archived, err := c.ListLinks(ctx, client.ListOptions{Archived: true})
+	if err != nil || archived.Total != 2 {
+		t.Errorf("Expected 2 archived links, got %+v, %v", archived, err)
+	}
+
+	if _, err = c.DeleteLinks(ctx, "unused"); err != nil {
+		t.Errorf("DeleteLinks failed: %v", err)
+	}
+	if _, err = c.GetLink(ctx, "unused"); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	clearTable()
+	ctx := context.Background()
+	c := newTestClient(t, nil, "testapikey")
+
+	if _, err := c.CreateLink(ctx, client.CreateLinkParams{URL: "https://example.com", ShortCode: "taken"}); err != nil {
+		t.Fatalf("CreateLink failed: %v", err)
+	}
+	_, err := c.CreateLink(ctx, client.CreateLinkParams{URL: "https://example.com", ShortCode: "taken"})
+	var apiErr *client.Error
+	if !errors.Is(err, client.ErrConflict) || !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusConflict {
+		t.Errorf("Expected a 409 conflict, got %v", err)
+	}
+	if _, err = c.CreateLink(ctx, client.CreateLinkParams{URL: "not a url"}); !errors.Is(err, client.ErrInvalidURL) {
+		t.Errorf("Expected ErrInvalidURL, got %v", err)
+	}
+	if err = c.DeleteLink(ctx, "missing"); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	unauthorized := newTestClient(t, nil, "wrong")
+	if _, err = unauthorized.ListLinks(ctx, client.ListOptions{}); !errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("Expected ErrUnauthorized, got %v", err)
+	}
+}
+
+// TestClientRetries fails the first attempt at each request after the server has
+// handled it, as when a response is lost, and checks the retry doesn't create the
+// link twice
+func TestClientRetries(t *testing.T) {
+	clearTable()
+	var requests atomic.Int32
+	c := newTestClient(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requests.Add(1)%2 == 1 {
+				next.ServeHTTP(httptest.NewRecorder(), r)
+				w.Header().Set("Retry-After", "0")
+				http.Error(w, "Bad Gateway", http.StatusBadGateway)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, "testapikey")
+	ctx := context.Background()
+
+	link, err := c.CreateLink(ctx, client.CreateLinkParams{URL: "https://example.com"})
+	if err != nil {
+		t.Fatalf("Expected the retry to succeed, got %v", err)
+	}
+	if requests.Load() != 2 {
+		t.Errorf("Expected 2 requests, got %d", requests.Load())
+	}
+	if n := countLinks(t); n != 1 {
+		t.Errorf("Expected 1 link after retrying, got %d", n)
+	}
+	if _, err = c.GetLink(ctx, link.ShortCode); err != nil {
+		t.Errorf("GetLink failed: %v", err)
+	}
+}
+
+func TestClientRevisions(t *testing.T) {
+	clearTable()
+	c := newTestClient(t, nil, "testapikey")
+	ctx := context.Background()
+
+	_, _ = c.CreateLink(ctx, client.CreateLinkParams{URL: "https://one.com", ShortCode: "sdkrev"})
+	newURL := "https://two.com"
+	_, _ = c.UpdateLink(ctx, "sdkrev", client.UpdateLinkParams{URL: &newURL})
+
+	revisions, err := c.Revisions(ctx, "sdkrev")
+	if err != nil || len(revisions) != 2 || revisions[0].Revision != 2 {
+		t.Fatalf("Expected 2 revisions, got %+v, %v", revisions, err)
+	}
+	link, err := c.RollbackLink(ctx, "sdkrev", 1)
+	if err != nil || link.LongLink != "https://one.com" {
+		t.Errorf("Expected the link to be rolled back, got %+v, %v", link, err)
+	}
+}
+
+func TestClientTags(t *testing.T) {
+	clearTable()
+	c := newTestClient(t, nil, "testapikey")
+	ctx := context.Background()
+
+	created, err := c.CreateLink(ctx, client.CreateLinkParams{URL: "https://example.com", ShortCode: "sdktag", Tags: []string{"docs"}})
+	if err != nil || !reflect.DeepEqual(created.Tags, []string{"docs"}) {
+		t.Fatalf("Expected a tagged link, got %+v, %v", created, err)
+	}
+	_, _ = c.CreateLink(ctx, client.CreateLinkParams{URL: "https://example.org"})
+
+	list, err := c.ListLinks(ctx, client.ListOptions{Tag: "docs"})
+	if err != nil || list.Total != 1 || list.Links[0].ShortCode != "sdktag" {
+		t.Errorf("Expected the tagged link only, got %+v, %v", list, err)
+	}
+	tags, err := c.Tags(ctx)
+	if err != nil || len(tags) != 1 || tags[0].Tag != "docs" || tags[0].Links != 1 {
+		t.Errorf("Expected the docs tag, got %+v, %v", tags, err)
+	}
+
+	none := []string{}
+	updated, err := c.UpdateLink(ctx, "sdktag", client.UpdateLinkParams{Tags: &none})
+	if err != nil || len(updated.Tags) != 0 {
+		t.Errorf("Expected the tags to be removed, got %+v, %v", updated, err)
+	}
+}
@@ -0,0 +1,27 @@
+// Command shortner runs the link shortener. It is configured with environment
+// variables; run "shortner help" to see its subcommands.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	shtnr "github.com/dmt195/go-shtnr"
+)
+
+func main() {
+	app, err := shtnr.New(shtnr.WithEnv())
+	if err != nil {
+		panic(err)
+	}
+
+	// with no subcommand the server is started, as before subcommands existed
+	args := os.Args[1:]
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+	if err = app.Run(args, os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
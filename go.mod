@@ -1,4 +1,4 @@
-module shortner
+module github.com/dmt195/go-shtnr
 
 go 1.22
 
@@ -7,6 +7,7 @@ require (
 	github.com/gobuffalo/envy v1.10.2
 	github.com/gorilla/securecookie v1.1.2
 	github.com/mattn/go-sqlite3 v1.14.22
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	golang.org/x/crypto v0.23.0
 )
 
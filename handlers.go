@@ -1,4 +1,4 @@
-package main
+package shtnr
 
 import (
 	"database/sql"
@@ -6,11 +6,15 @@ import (
 	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
-	"html/template"
+	"golang.org/x/crypto/bcrypt"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -24,42 +28,161 @@ func isValidURL(toTest string) bool {
 	return re.MatchString(toTest)
 }
 
+// reservedShortCodes can't be used as short codes because they would be hidden by
+// the application's own routes
+var reservedShortCodes = []string{"api", "audit", "favicon.ico", "login", "logout", "mfa", "shorten", "shortlinks", "static"}
+
+var shortCodePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+const invalidShortCodeMessage = "Short codes may only contain letters, numbers, - and _, and must not be a reserved word"
+
+func isValidShortCode(shortCode string) bool {
+	return shortCodePattern.MatchString(shortCode) && !slices.Contains(reservedShortCodes, strings.ToLower(shortCode))
+}
+
+// LoginPageHandler renders the login form
+func (app *App) LoginPageHandler(w http.ResponseWriter, _ *http.Request) {
+	app.renderLoginPage(w, http.StatusOK, "")
+}
+
+// renderLoginPage renders the login form with an optional error message
+func (app *App) renderLoginPage(w http.ResponseWriter, status int, message string) {
+	tmpl := app.template("login.html")
+	type ViewModel struct {
+		Error      string
+		SSOEnabled bool
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err := tmpl.Execute(w, ViewModel{Error: message, SSOEnabled: app.oidc != nil})
+	if err != nil {
+		log.Println("Failed to execute template:", err)
+	}
+}
+
 // LoginHandler handles the login logic
-func (*App) LoginHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	username := r.FormValue("username")
 	pass := r.FormValue("password")
+	ip := clientIP(r)
 
-	if username == app.config.defaultAdminUser && pass == app.config.defaultAdminPassword {
-
-		// Generate a secure session token
-		value := map[string]string{
-			"username": username,
-			"token":    "authenticated",
-		}
-		if encoded, err := app.sc.Encode("session", value); err == nil {
-			cookie := &http.Cookie{
-				Name:     "session_token",
-				Value:    encoded,
-				Path:     "/",
-				HttpOnly: true,
-				Secure:   !app.config.isDevelopment, // Set to true in production
-				Expires:  time.Now().Add(1 * time.Hour),
-			}
-			http.SetCookie(w, cookie)
-			http.Redirect(w, r, "/shortlinks", http.StatusSeeOther)
+	if wait, locked := app.loginThrottle.check(ip, username); wait > 0 {
+		seconds := int(math.Ceil(wait.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		log.Printf("Login rejected for %q from %s: throttled for %ds", username, ip, seconds)
+		if locked {
+			app.renderLoginPage(w, http.StatusTooManyRequests, fmt.Sprintf("Too many failed sign-in attempts. Try again in %d minute(s).", (seconds+59)/60))
 		} else {
-			log.Println("Failed to encode session token:", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			app.renderLoginPage(w, http.StatusTooManyRequests, fmt.Sprintf("Please wait %d second(s) before trying again.", seconds))
+		}
+		return
+	}
+
+	u, err := app.getUserByUsername(username)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Println("Failed to look up user:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if err == nil && bcrypt.CompareHashAndPassword([]byte(u.passwordHashed), []byte(pass)) == nil {
+		// A second factor is still needed, so the throttle is only reset once the
+		// whole login has succeeded
+		switch {
+		case u.totpEnabled:
+			app.startPendingLogin(w, r, u.username, pendingVerify)
+		case app.mfaRequired(u.role):
+			app.startPendingLogin(w, r, u.username, pendingEnroll)
+		default:
+			app.completeLogin(w, r, ip, u.username)
 		}
 	} else {
 		log.Println("Login failed: username or password mismatch")
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		app.recordLoginFailure(r, username)
+		app.renderLoginPage(w, http.StatusUnauthorized, "Invalid username or password.")
+	}
+}
+
+// recordLoginFailure feeds a failed login into the throttle and audits it along with
+// any resulting lockouts
+func (app *App) recordLoginFailure(r *http.Request, username string) {
+	ip := clientIP(r)
+	app.auditAs(r, username, "login.failure", username, nil, nil)
+	for _, key := range app.loginThrottle.fail(ip, username) {
+		log.Printf("Locking out %s for %s after repeated failed logins", key, app.config.loginLockout)
+		err := app.insertAuditEvent(AuditEvent{
+			Actor:   username,
+			Action:  "login.lockout",
+			Target:  key,
+			IP:      ip,
+			Details: fmt.Sprintf("locked out for %s", app.config.loginLockout),
+		})
+		if err != nil {
+			log.Println("Failed to record lockout in audit log:", err)
+		}
 	}
 }
 
+// completeLogin issues the session cookie once a user has passed every login step
+func (app *App) completeLogin(w http.ResponseWriter, r *http.Request, ip, username string) {
+	app.loginThrottle.succeed(ip, username)
+	if err := app.setSessionCookie(w, username); err != nil {
+		log.Println("Failed to encode session token:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	app.auditAs(r, username, "login", username, nil, nil)
+	http.Redirect(w, r, "/shortlinks", http.StatusSeeOther)
+}
+
+// setSessionCookie logs the user in
+func (app *App) setSessionCookie(w http.ResponseWriter, username string) error {
+	// Generate a secure session token
+	value := map[string]string{
+		"username": username,
+		"token":    "authenticated",
+	}
+	encoded, err := app.sc.Encode("session", value)
+	if err != nil {
+		return err
+	}
+	cookie := &http.Cookie{
+		Name:     "session_token",
+		Value:    encoded,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   !app.config.isDevelopment, // Set to true in production
+		Expires:  time.Now().Add(1 * time.Hour),
+	}
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+// sessionUsername returns the user logged in with the request's session cookie
+func (app *App) sessionUsername(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie("session_token")
+	if err != nil {
+		return "", false
+	}
+
+	// Decode the session cookie
+	value := make(map[string]string)
+	if err = app.sc.Decode("session", cookie.Value, &value); err != nil {
+		return "", false
+	}
+
+	// Check if the session token is authenticated
+	if token, ok := value["token"]; !ok || token != "authenticated" {
+		return "", false
+	}
+	return value["username"], true
+}
+
 // LogoutHandler handles the logout logic
-func (*App) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if username, ok := app.sessionUsername(r); ok {
+		app.audit(r, "logout", username, nil, nil)
+	}
 	// Clear the session cookie
 	http.SetCookie(w, &http.Cookie{
 		Name:     "session_token",
@@ -73,117 +196,367 @@ func (*App) LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 
-func (*App) FollowShortURL(w http.ResponseWriter, r *http.Request) {
+// FollowShortURL redirects to the destination of a short link. A link in the trash
+// answers 410 Gone rather than 404, so it is clear it used to work. The path after the
+// short code and the query string fill in the placeholders of a template, and are
+// passed on to links that allow it.
+func (app *App) FollowShortURL(w http.ResponseWriter, r *http.Request) {
 	shortURL := chi.URLParam(r, "shortURL")
-	// Get the long URL from the database
-	longURL, err := getLinkByShortLink(shortURL)
+	link, err := app.getLinkByShortLink(shortURL)
 	if err != nil {
 		log.Printf("Failed to get Link by short link \"%s\". Error: %s", shortURL, err)
-		if errors.Is(err, sql.ErrNoRows) {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
 			http.Error(w, "Not found", http.StatusNotFound)
-		} else {
+		case errors.Is(err, errLinkTrashed):
+			http.Error(w, "This link has been deleted", http.StatusGone)
+		default:
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		}
 		return
 	}
+	longURL, err := redirectTarget(link, extraPath(r.URL.EscapedPath()), r.URL.Query())
+	if errors.Is(err, errPathNotForwarded) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errMissingArgument) || errors.Is(err, errDotSegment) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to build the destination of \"%s\". Error: %s", shortURL, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err = app.recordVisit(link.ID); err != nil {
+		log.Printf("Failed to record a visit to \"%s\". Error: %s", shortURL, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
 	log.Println("Redirecting user to:", longURL)
 	http.Redirect(w, r, longURL, http.StatusTemporaryRedirect)
 
 }
 
 // ShortenURL handles the URL shortening logic
-func (*App) ShortenURL(w http.ResponseWriter, r *http.Request) {
+func (app *App) ShortenURL(w http.ResponseWriter, r *http.Request) {
 	longURL := r.FormValue("url")
 	if !isValidURL(longURL) {
 		http.Error(w, "Invalid URL", http.StatusBadRequest)
 		return
 	}
+	if err := validatePlaceholders(longURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	utm := utmParamsFromForm(r)
+	if err := utm.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	shortURL := r.FormValue("shortURL")
-	_, err := insertLink(&Link{ShortCode: shortURL, LongLink: longURL})
+	if shortURL != "" && !isValidShortCode(shortURL) {
+		http.Error(w, invalidShortCodeMessage, http.StatusBadRequest)
+		return
+	}
+	tags, err := parseTagList(r.FormValue("tags"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	link := Link{
+		ShortCode:   shortURL,
+		LongLink:    utm.addTo(longURL),
+		Tags:        tags,
+		Title:       strings.TrimSpace(r.FormValue("title")),
+		Description: strings.TrimSpace(r.FormValue("description")),
+		Notes:       strings.TrimSpace(r.FormValue("notes")),
+	}
+	if err = validateLinkText(link); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	app.fillTitle(r, &link)
+	id, err := app.insertLink(&link)
+	if errors.Is(err, errShortCodeTaken) {
+		http.Error(w, "Short code is already in use", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		log.Println("Failed to insert Link:", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	link.ID = int(id)
+	app.audit(r, "link.create", link.ShortCode, nil, link)
 	http.Redirect(w, r, "/shortlinks", http.StatusSeeOther)
 }
 
-func (*App) ShortenURLApi(w http.ResponseWriter, r *http.Request) {
+// ShortenURLApi creates a link from a JSON body. It serves both POST /api/shorten
+// and POST /api/v1/links. Retries sent with the same Idempotency-Key get the original
+// response instead of creating another link.
+func (app *App) ShortenURLApi(w http.ResponseWriter, r *http.Request) {
 	type requestType struct {
-		URL      string `json:"url"`
-		ShortUrl string `json:"short_code"`
+		URL         string   `json:"url"`
+		ShortUrl    string   `json:"short_code"`
+		Tags        []string `json:"tags"`
+		Title       string   `json:"title"`
+		Description string   `json:"description"`
+		Notes       string   `json:"notes"`
+		// QueryPassthrough and PathPassthrough choose what is passed on when the
+		// link is followed
+		QueryPassthrough string `json:"query_passthrough"`
+		PathPassthrough  bool   `json:"path_passthrough"`
+		// FallbackURL is where a template goes when it is missing a value
+		FallbackURL string `json:"fallback_url"`
+		// the UTM parameters are added to the destination
+		utmParams
 	}
 	var req requestType
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		log.Println("Failed to decode body: ", err)
-		http.Error(w, "Cannot parse body", http.StatusBadRequest)
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidBody, "Cannot parse body")
 		return
 	}
 	if !isValidURL(req.URL) {
-		http.Error(w, "Invalid URL", http.StatusBadRequest)
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidURL, "Invalid URL")
 		return
 	}
-	i, err := insertLink(&Link{ShortCode: req.ShortUrl, LongLink: req.URL})
+	if err = validatePlaceholders(req.URL); err != nil {
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidURL, err.Error())
+		return
+	}
+	if err = validateFallbackURL(req.FallbackURL); err != nil {
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidURL, err.Error())
+		return
+	}
+	if err = req.utmParams.validate(); err != nil {
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidUTM, err.Error())
+		return
+	}
+	if req.ShortUrl != "" && !isValidShortCode(req.ShortUrl) {
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidShortCode, invalidShortCodeMessage)
+		return
+	}
+	tags, err := normalizeTags(req.Tags)
 	if err != nil {
-		log.Println("Failed to insert Link: ", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidTag, err.Error())
 		return
 	}
-
-	link, err := getLinkByID(i)
+	queryPassthrough, err := normalizeQueryPassthrough(req.QueryPassthrough)
 	if err != nil {
-		log.Println("Failed to retrieve full Link: ", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidBody, err.Error())
 		return
 	}
-	data, err := json.Marshal(link)
+	newLink := Link{
+		ShortCode:        req.ShortUrl,
+		LongLink:         req.utmParams.addTo(req.URL),
+		Tags:             tags,
+		Title:            req.Title,
+		Description:      req.Description,
+		Notes:            req.Notes,
+		QueryPassthrough: queryPassthrough,
+		PathPassthrough:  req.PathPassthrough,
+		FallbackURL:      req.FallbackURL,
+	}
+	if err = validateLinkText(newLink); err != nil {
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidBody, err.Error())
+		return
+	}
+	idempotencyKey, ok := app.startIdempotentRequest(w, r, req)
+	if !ok {
+		return
+	}
+	app.fillTitle(r, &newLink)
+	i, err := app.insertLink(&newLink)
 	if err != nil {
-		log.Println("Failed to marshal link body: ", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		app.releaseIdempotentRequest(idempotencyKey)
+		writeLinkSaveError(w, err)
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
-	_, _ = w.Write(data)
+
+	link, err := app.getLinkByID(i)
+	if err != nil {
+		app.releaseIdempotentRequest(idempotencyKey)
+		log.Println("Failed to retrieve full Link: ", err)
+		writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+		return
+	}
+	app.audit(r, "link.create", link.ShortCode, nil, link)
+	app.finishIdempotentRequest(idempotencyKey, http.StatusCreated, link)
+	writeJSON(w, http.StatusCreated, link)
 }
 
-func (*App) DeleteShortLink(w http.ResponseWriter, r *http.Request) {
+func (app *App) DeleteShortLink(w http.ResponseWriter, r *http.Request) {
 	shortURL := chi.URLParam(r, "shortURL")
-	err := deleteLink(shortURL)
+	before, err := app.getLinkByShortCode(shortURL)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Failed to get Link to delete:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	err = app.deleteLink(shortURL)
 	if err != nil {
 		log.Println("Failed to delete Link:", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	app.audit(r, "link.delete", shortURL, before, nil)
 	http.Redirect(w, r, "/shortlinks", http.StatusSeeOther)
 }
 
-func (*App) ShortLinksHandler(w http.ResponseWriter, _ *http.Request) {
-	tmpl := template.Must(template.ParseFiles("views/shortlinks.html"))
-	links, err := getAllLinks()
+const linksPageSize = 50
+
+// ShortLinksHandler lists the links a page at a time. The query string can search
+// them (q), limit them to those with a tag (tag), a UTM campaign (campaign) or created
+// between two dates (from, to), show the archived links instead (archived), sort them
+// (sort, as in the API, newest first by default) and pick a page.
+func (app *App) ShortLinksHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := app.template("shortlinks.html")
+	query := r.URL.Query()
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	q := linkQuery{Search: query.Get("q"), Limit: linksPageSize, Offset: (page - 1) * linksPageSize}
+	if !q.setSort(query.Get("sort")) {
+		q.setSort("-created")
+	}
+	q.Archived, _ = strconv.ParseBool(query.Get("archived"))
+	q.Tag = strings.ToLower(query.Get("tag"))
+	q.Campaign = query.Get("campaign")
+	// a date the browser should not have sent is ignored, as a bad sort is
+	from, to := query.Get("from"), query.Get("to")
+	if q.setCreatedRange(from, "") != nil {
+		from = ""
+	}
+	if q.setCreatedRange("", to) != nil {
+		to = ""
+	}
+
+	links, total, err := app.listLinks(q)
 	if err != nil {
-		log.Println("Failed to get all links:", err)
+		log.Println("Failed to list links:", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	tagStats, err := app.listTagStats()
+	if err != nil {
+		log.Println("Failed to list tags:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	pageURL := func(p int, sort string) string {
+		u := url.Values{}
+		if q.Search != "" {
+			u.Set("q", q.Search)
+		}
+		if from != "" {
+			u.Set("from", from)
+		}
+		if to != "" {
+			u.Set("to", to)
+		}
+		if q.Archived {
+			u.Set("archived", "true")
+		}
+		if q.Tag != "" {
+			u.Set("tag", q.Tag)
+		}
+		if q.Campaign != "" {
+			u.Set("campaign", q.Campaign)
+		}
+		u.Set("sort", sort)
+		if p > 1 {
+			u.Set("page", strconv.Itoa(p))
+		}
+		return "/shortlinks?" + u.Encode()
+	}
+	sort := q.Sort
+	if q.Desc {
+		sort = "-" + sort
+	}
+
+	// clearing the search keeps the order and which links are shown
+	clearQuery := url.Values{"sort": {sort}}
+	if q.Archived {
+		clearQuery.Set("archived", "true")
+	}
+
 	type ViewModel struct {
 		Links   []Link
 		SiteUrl string
+		Search  string
+		From    string
+		To      string
+		// Archived is set when the page lists the archived links
+		Archived bool
+		// Tag is set when the page only lists the links with that tag
+		Tag string
+		// TagStats are every tag in use, with their links and clicks
+		TagStats []TagStats
+		// Campaign is set when the page only lists the links of that UTM campaign
+		Campaign string
+		Sort     string
+		Desc     bool
+		// SortURLs sort by each column, reversing the order of the current one
+		SortURLs  map[string]string
+		Total     int
+		Page      int
+		Pages     int
+		PrevURL   string
+		NextURL   string
+		ClearURL  string
+		FirstItem int
+		LastItem  int
 	}
-
-	var siteUlr string
-
-	// use the port if in development mode
-	if app.config.isDevelopment {
-		siteUlr = fmt.Sprintf("%s:%s", app.config.baseUrl, app.config.port)
-	} else {
-		siteUlr = app.config.baseUrl
+	vm := ViewModel{
+		Links:     links,
+		SiteUrl:   app.config.siteURL(),
+		Search:    q.Search,
+		From:      from,
+		To:        to,
+		Archived:  q.Archived,
+		Tag:       q.Tag,
+		TagStats:  tagStats,
+		Campaign:  q.Campaign,
+		Sort:      q.Sort,
+		Desc:      q.Desc,
+		SortURLs:  map[string]string{},
+		Total:     total,
+		Page:      page,
+		Pages:     max(1, (total+linksPageSize-1)/linksPageSize),
+		ClearURL:  "/shortlinks?" + clearQuery.Encode(),
+		FirstItem: q.Offset + 1,
+		LastItem:  q.Offset + len(links),
+	}
+	for key := range linkSortColumns {
+		// text reads best A-Z, numbers and dates biggest first
+		desc := key != "short_code"
+		if key == q.Sort {
+			desc = !q.Desc
+		}
+		next := key
+		if desc {
+			next = "-" + key
+		}
+		vm.SortURLs[key] = pageURL(1, next)
+	}
+	if page > 1 {
+		vm.PrevURL = pageURL(page-1, sort)
+	}
+	if q.Offset+len(links) < total {
+		vm.NextURL = pageURL(page+1, sort)
 	}
 
-	err = tmpl.Execute(w, ViewModel{
-		Links:   links,
-		SiteUrl: siteUlr,
-	})
+	err = tmpl.Execute(w, vm)
 	if err != nil {
 		log.Println("Failed to execute template:", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -1,13 +1,15 @@
-package main
+package shtnr
 
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"database/sql"
 	"errors"
@@ -47,11 +49,78 @@ func TestLoginHandler(t *testing.T) {
 	rr = httptest.NewRecorder()
 	app.LoginHandler(rr, req)
 
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "Invalid username or password") {
+		t.Error("Expected the login page to show an error message")
+	}
+}
+
+func TestLoginHandlerLockout(t *testing.T) {
+	original := app.loginThrottle
+	defer func() { app.loginThrottle = original }()
+
+	now := time.Now()
+	app.loginThrottle = newLoginThrottle(3, 15*time.Minute)
+	app.loginThrottle.now = func() time.Time { return now }
+
+	attempt := func(password string) *httptest.ResponseRecorder {
+		data := url.Values{}
+		data.Set("username", "testadmin")
+		data.Set("password", password)
+		req, _ := http.NewRequest("POST", "/login", strings.NewReader(data.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = "192.0.2.1:1234"
+		rr := httptest.NewRecorder()
+		app.LoginHandler(rr, req)
+		return rr
+	}
+
+	for i := 0; i < 3; i++ {
+		if rr := attempt("wrongpassword"); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("Attempt %d: expected status %d, got %d", i+1, http.StatusUnauthorized, rr.Code)
+		}
+		now = now.Add(time.Minute)
+	}
+
+	// Even the right password is refused while locked out
+	rr := attempt("testpassword")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header")
+	}
+	if !strings.Contains(rr.Body.String(), "Too many failed sign-in attempts") {
+		t.Error("Expected the login page to explain the lockout")
+	}
+
+	var count int
+	_ = testApp.db.QueryRow("SELECT COUNT(*) FROM audit_log WHERE action = 'login.lockout'").Scan(&count)
+	if count == 0 {
+		t.Error("Expected the lockout to be recorded in the audit log")
+	}
+
+	// Once the lockout has passed the right password works again
+	now = now.Add(16 * time.Minute)
+	rr = attempt("testpassword")
 	if rr.Code != http.StatusSeeOther {
 		t.Errorf("Expected status %d, got %d", http.StatusSeeOther, rr.Code)
 	}
-	if rr.Header().Get("Location") != "/login" {
-		t.Errorf("Expected redirect to /login, got %s", rr.Header().Get("Location"))
+}
+
+func TestLoginPageHandler(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/login", nil)
+	rr := httptest.NewRecorder()
+
+	app.LoginPageHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "Sign in to your account") {
+		t.Error("Response body does not contain the login form")
 	}
 }
 
@@ -76,7 +145,7 @@ func TestLogoutHandler(t *testing.T) {
 func TestFollowShortURL(t *testing.T) {
 	clearTable()
 	link := Link{ShortCode: "testshort", LongLink: "http://example.com"}
-	_, _ = insertLink(&link)
+	_, _ = app.insertLink(&link)
 
 	// Test successful redirect
 	req, _ := http.NewRequest("GET", "/testshort", nil)
@@ -140,7 +209,7 @@ func TestShortenURLApi(t *testing.T) {
 	clearTable()
 
 	r := chi.NewRouter()
-	r.With(ApiKeyAuthMiddleware).Post("/api/shorten", app.ShortenURLApi)
+	r.With(app.ApiKeyAuthMiddleware).Post("/api/shorten", app.ShortenURLApi)
 
 	// Test successful shorten
 	payload := map[string]string{"url": "http://api.com", "short_code": "apishort"}
@@ -155,6 +224,11 @@ func TestShortenURLApi(t *testing.T) {
 	if rr.Code != http.StatusCreated {
 		t.Errorf("Expected status %d, got %d", http.StatusCreated, rr.Code)
 	}
+	var created Link
+	_ = json.Unmarshal(rr.Body.Bytes(), &created)
+	if created.CreatedAt.IsZero() || !created.UpdatedAt.Equal(created.CreatedAt) {
+		t.Errorf("Expected the new link to have its creation time, got %+v", created)
+	}
 
 	// Test invalid URL
 	payload = map[string]string{"url": "invalid-api-url", "short_code": "invalidapi"}
@@ -195,7 +269,7 @@ func TestShortenURLApi(t *testing.T) {
 func TestDeleteShortLink(t *testing.T) {
 	clearTable()
 	link := Link{ShortCode: "deleteme", LongLink: "http://deleteme.com"}
-	_, _ = insertLink(&link)
+	_, _ = app.insertLink(&link)
 
 	// Test successful delete
 	req, _ := http.NewRequest("POST", "/deleteme/delete", nil)
@@ -212,17 +286,20 @@ func TestDeleteShortLink(t *testing.T) {
 		t.Errorf("Expected redirect to /shortlinks, got %s", rr.Header().Get("Location"))
 	}
 
-	// Verify it's deleted
-	_, err := getLinkByShortLink("deleteme")
-	if !errors.Is(err, sql.ErrNoRows) {
-		t.Error("Expected link to be deleted, but it was found")
+	// Verify it's in the trash
+	_, err := app.getLinkByShortLink("deleteme")
+	if !errors.Is(err, errLinkTrashed) {
+		t.Errorf("Expected the link to be in the trash, got %v", err)
+	}
+	if _, err = app.getLinkByShortCode("deleteme"); !errors.Is(err, sql.ErrNoRows) {
+		t.Error("Expected the trashed link to be left out of lookups")
 	}
 }
 
 func TestShortLinksHandler(t *testing.T) {
 	clearTable()
-	_, _ = insertLink(&Link{ShortCode: "page1", LongLink: "http://page1.com"})
-	_, _ = insertLink(&Link{ShortCode: "page2", LongLink: "http://page2.com"})
+	_, _ = app.insertLink(&Link{ShortCode: "page1", LongLink: "http://page1.com"})
+	_, _ = app.insertLink(&Link{ShortCode: "page2", LongLink: "http://page2.com"})
 
 	req, _ := http.NewRequest("GET", "/shortlinks", nil)
 	rr := httptest.NewRecorder()
@@ -236,3 +313,66 @@ func TestShortLinksHandler(t *testing.T) {
 		t.Error("Response body does not contain expected shortlinks")
 	}
 }
+
+func TestShortLinksHandlerSearchSortAndPages(t *testing.T) {
+	clearTable()
+	for i := range linksPageSize + 5 {
+		_, _ = app.insertLink(&Link{ShortCode: fmt.Sprintf("bulk%02d", i), LongLink: "http://bulk.com", TimesAccessed: i})
+	}
+	_, _ = app.insertLink(&Link{ShortCode: "needle", LongLink: "http://haystack.com/needle"})
+
+	get := func(query string) string {
+		t.Helper()
+		req, _ := http.NewRequest("GET", "/shortlinks?"+query, nil)
+		rr := httptest.NewRecorder()
+		app.ShortLinksHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+		return rr.Body.String()
+	}
+
+	// newest first, a page at a time
+	body := get("")
+	if !strings.Contains(body, ">needle<") || strings.Contains(body, ">bulk00<") {
+		t.Error("Expected the first page to have the newest links only")
+	}
+	if !strings.Contains(body, "page 1 of 2") || !strings.Contains(body, `href="/shortlinks?page=2&amp;sort=-created"`) {
+		t.Error("Expected a link to the second page")
+	}
+	body = get("page=2&sort=-created")
+	if !strings.Contains(body, ">bulk00<") || strings.Contains(body, ">needle<") {
+		t.Error("Expected the second page to have the oldest links")
+	}
+
+	body = get("q=haystack")
+	if !strings.Contains(body, ">needle<") || strings.Contains(body, ">bulk") || !strings.Contains(body, "1&ndash;1 of 1") {
+		t.Error("Expected the search to match the destination")
+	}
+
+	body = get("sort=-clicks")
+	first := strings.Index(body, fmt.Sprintf(">bulk%02d<", linksPageSize+4))
+	second := strings.Index(body, fmt.Sprintf(">bulk%02d<", linksPageSize+3))
+	if first < 0 || second < first {
+		t.Error("Expected the most clicked links first")
+	}
+	if !strings.Contains(body, `href="/shortlinks?sort=clicks"`) {
+		t.Error("Expected the clicks column to reverse the order")
+	}
+
+	if body = get("sort=nonsense"); !strings.Contains(body, ">needle<") {
+		t.Error("Expected an unknown sort to fall back to newest first")
+	}
+
+	_, _ = app.db.Exec(`UPDATE links SET created_at = '2020-06-01 10:00:00' WHERE short_code = 'needle'`)
+	body = get("from=2020-06-01&to=2020-06-01")
+	if !strings.Contains(body, ">needle<") || strings.Contains(body, ">bulk") || !strings.Contains(body, ">2020-06-01<") {
+		t.Error("Expected the date range to match the link created that day")
+	}
+	if body = get("to=2020-05-31"); strings.Contains(body, ">needle<") || !strings.Contains(body, "No shortlinks match") {
+		t.Error("Expected no links created before the range")
+	}
+	if body = get("q=needle&from=someday"); !strings.Contains(body, ">needle<") {
+		t.Error("Expected an invalid date to be ignored")
+	}
+}
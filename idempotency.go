@@ -0,0 +1,90 @@
+package shtnr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// maxIdempotencyKeyLength keeps clients from storing arbitrarily large keys
+const maxIdempotencyKeyLength = 255
+
+// heldIdempotencyKey is an Idempotency-Key claimed by a request. Keys belong to the
+// caller that sent them, so that two callers picking the same key never see each
+// other's responses.
+type heldIdempotencyKey struct {
+	actor string
+	key   string
+}
+
+// startIdempotentRequest honours the Idempotency-Key header. It returns the key to
+// finish or release once the request has been handled, which is empty if the request
+// has no key. If the caller has used the key before it writes the response itself,
+// either replaying the original one or reporting the reuse, and returns false.
+func (app *App) startIdempotentRequest(w http.ResponseWriter, r *http.Request, payload any) (heldIdempotencyKey, bool) {
+	held := heldIdempotencyKey{actor: app.requestActor(r), key: r.Header.Get("Idempotency-Key")}
+	if held.key == "" || app.config.idempotencyWindow <= 0 {
+		return heldIdempotencyKey{}, true
+	}
+	if len(held.key) > maxIdempotencyKeyLength {
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidParameter, "Idempotency-Key is too long")
+		return heldIdempotencyKey{}, false
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Println("Failed to marshal idempotent request: ", err)
+		writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+		return heldIdempotencyKey{}, false
+	}
+	hash := sha256.Sum256(data)
+	requestHash := hex.EncodeToString(hash[:])
+
+	existing, reserved, err := app.reserveIdempotencyKey(held.actor, held.key, requestHash, time.Now().Add(-app.config.idempotencyWindow))
+	if err != nil {
+		log.Println("Failed to reserve idempotency key: ", err)
+		writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+		return heldIdempotencyKey{}, false
+	}
+	switch {
+	case reserved:
+		return held, true
+	case existing.requestHash != requestHash:
+		writeAPIError(w, http.StatusUnprocessableEntity, apiErrIdempotencyKeyReused, "Idempotency-Key has already been used with a different request")
+	case existing.status == 0:
+		writeAPIError(w, http.StatusConflict, apiErrConflict, "A request with this Idempotency-Key is still being processed")
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(existing.status)
+		_, _ = w.Write(existing.body)
+	}
+	return heldIdempotencyKey{}, false
+}
+
+// finishIdempotentRequest records the response to replay for retries with the key
+func (app *App) finishIdempotentRequest(held heldIdempotencyKey, status int, v any) {
+	if held.key == "" {
+		return
+	}
+	body, err := json.Marshal(v)
+	if err == nil {
+		err = app.completeIdempotencyKey(held.actor, held.key, status, body)
+	}
+	if err != nil {
+		log.Println("Failed to record idempotent response: ", err)
+	}
+}
+
+// releaseIdempotentRequest lets the key be used again after the request failed
+func (app *App) releaseIdempotentRequest(held heldIdempotencyKey) {
+	if held.key == "" {
+		return
+	}
+	if err := app.releaseIdempotencyKey(held.actor, held.key); err != nil {
+		log.Println("Failed to release idempotency key: ", err)
+	}
+}
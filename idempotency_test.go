@@ -0,0 +1,123 @@
+package shtnr
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// idempotentRequest creates a link through the full router with an Idempotency-Key
+func idempotentRequest(key, body string) *httptest.ResponseRecorder {
+	return idempotentRequestWithAPIKey("testapikey", key, body)
+}
+
+// idempotentRequestWithAPIKey is idempotentRequest made by another caller
+func idempotentRequestWithAPIKey(apiKey, key, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/api/v1/links", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-KEY", apiKey)
+	req.Header.Set("Idempotency-Key", key)
+	rr := httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	clearTable()
+
+	first := idempotentRequest("replay-key", `{"url": "http://example.com"}`)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d", http.StatusCreated, first.Code)
+	}
+	retry := idempotentRequest("replay-key", `{ "url":"http://example.com" }`)
+	if retry.Code != http.StatusCreated {
+		t.Fatalf("Expected replayed status %d, got %d", http.StatusCreated, retry.Code)
+	}
+	if retry.Body.String() != first.Body.String() {
+		t.Errorf("Expected the original body %q, got %q", first.Body.String(), retry.Body.String())
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("Expected the replay to be marked with Idempotent-Replayed")
+	}
+
+	links, err := app.getAllLinks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 {
+		t.Errorf("Expected 1 link to be created, got %d", len(links))
+	}
+}
+
+func TestIdempotencyKeyReusedWithDifferentPayload(t *testing.T) {
+	clearTable()
+
+	rr := idempotentRequest("reused-key", `{"url": "http://example.com"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d", http.StatusCreated, rr.Code)
+	}
+	rr = idempotentRequest("reused-key", `{"url": "http://example.org"}`)
+	assertAPIError(t, rr, http.StatusUnprocessableEntity, apiErrIdempotencyKeyReused)
+}
+
+func TestIdempotencyKeyPerCaller(t *testing.T) {
+	clearTable()
+	key, err := generateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = app.createAPIKey("other-caller", hashAPIKey(key)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { testApp.db.Exec("DELETE FROM api_keys WHERE name = ?", "other-caller") })
+
+	first := idempotentRequest("shared-key", `{"url": "http://example.com", "short_code": "mine"}`)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d", http.StatusCreated, first.Code)
+	}
+	// the same key from another caller is a request of its own, not a replay
+	rr := idempotentRequestWithAPIKey(key, "shared-key", `{"url": "http://example.com", "short_code": "mine"}`)
+	if rr.Header().Get("Idempotent-Replayed") != "" || strings.Contains(rr.Body.String(), `"id"`) {
+		t.Errorf("Expected the other caller not to see the first response, got %d %s", rr.Code, rr.Body.String())
+	}
+	assertAPIError(t, rr, http.StatusConflict, apiErrConflict)
+}
+
+func TestIdempotencyKeyReleasedOnFailure(t *testing.T) {
+	clearTable()
+	if _, err := app.insertLink(&Link{ShortCode: "taken", LongLink: "http://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := idempotentRequest("failed-key", `{"url": "http://example.org", "short_code": "taken"}`)
+	assertAPIError(t, rr, http.StatusConflict, apiErrConflict)
+
+	// a link in the trash keeps its short code until it is purged
+	if err := app.deleteLink("taken"); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.purgeLink("taken"); err != nil {
+		t.Fatal(err)
+	}
+	rr = idempotentRequest("failed-key", `{"url": "http://example.org", "short_code": "taken"}`)
+	if rr.Code != http.StatusCreated {
+		t.Errorf("Expected the retry to create the link with status %d, got %d", http.StatusCreated, rr.Code)
+	}
+}
+
+func TestIdempotencyKeyExpires(t *testing.T) {
+	_, reserved, err := app.reserveIdempotencyKey("api-key", "expiring-key", "one", time.Now().Add(-time.Hour))
+	if err != nil || !reserved {
+		t.Fatalf("Expected to reserve a new key, got %v, %v", reserved, err)
+	}
+	existing, reserved, err := app.reserveIdempotencyKey("api-key", "expiring-key", "two", time.Now().Add(-time.Hour))
+	if err != nil || reserved || existing.requestHash != "one" {
+		t.Fatalf("Expected the key to still be held, got %v, %+v, %v", reserved, existing, err)
+	}
+	_, reserved, err = app.reserveIdempotencyKey("api-key", "expiring-key", "two", time.Now().Add(time.Hour))
+	if err != nil || !reserved {
+		t.Errorf("Expected the expired key to be reserved again, got %v, %v", reserved, err)
+	}
+}
@@ -0,0 +1,342 @@
+package shtnr
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Adapters for the export formats of other URL shorteners. Each one turns an export
+// into importRecords, keeping the original short codes and click counts.
+
+// yourlsColumns is the column order of the YOURLS url table, used when a dump's
+// INSERT statements don't name their columns
+var yourlsColumns = []string{"keyword", "url", "title", "timestamp", "ip", "clicks"}
+
+var sqlInsertPattern = regexp.MustCompile("(?i)INSERT\\s+(?:IGNORE\\s+)?INTO\\s+[`\"]?(\\w+)[`\"]?\\s*(?:\\(([^)]*)\\))?\\s*VALUES\\s*")
+
+// parseCount reads a click count, which other shorteners may export as a quoted or
+// comma separated number
+func parseCount(s string) (int, error) {
+	s = strings.ReplaceAll(strings.TrimSpace(s), ",", "")
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, errors.New("click count must be a non-negative integer")
+	}
+	return n, nil
+}
+
+// shortCodeFromURL takes the short code from the end of a full short link, such as
+// https://sho.rt/abc or bit.ly/abc
+func shortCodeFromURL(s string) string {
+	s, _, _ = strings.Cut(strings.TrimSpace(s), "?")
+	s = strings.TrimSuffix(s, "/")
+	return s[strings.LastIndex(s, "/")+1:]
+}
+
+// yourlsRecord maps a row of the YOURLS url table to an importRecord
+func yourlsRecord(row int, keyword, url, clicks string) importRecord {
+	rec := importRecord{row: row, link: Link{ShortCode: keyword, LongLink: url}}
+	var err error
+	if rec.link.TimesAccessed, err = parseCount(clicks); err != nil {
+		rec.err = err.Error()
+	}
+	return rec
+}
+
+// decodeYOURLSSQL reads the url table from a mysqldump of a YOURLS database. The
+// table prefix is ignored, so any table whose name ends in "url" is read.
+func decodeYOURLSSQL(r io.Reader) ([]importRecord, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	dump := string(data)
+
+	var records []importRecord
+	found := false
+	for _, match := range sqlInsertPattern.FindAllStringSubmatchIndex(dump, -1) {
+		table := strings.ToLower(dump[match[2]:match[3]])
+		if !strings.HasSuffix(table, "url") {
+			continue
+		}
+		found = true
+		columns := yourlsColumns
+		if match[4] >= 0 {
+			columns = nil
+			for _, name := range strings.Split(dump[match[4]:match[5]], ",") {
+				columns = append(columns, strings.ToLower(strings.Trim(strings.TrimSpace(name), "`\"")))
+			}
+		}
+		keyword, url, clicks := slices.Index(columns, "keyword"), slices.Index(columns, "url"), slices.Index(columns, "clicks")
+		if keyword < 0 || url < 0 {
+			return nil, fmt.Errorf("table %s has no keyword and url columns", table)
+		}
+
+		rows, err := parseSQLValues(dump[match[1]:])
+		if err != nil {
+			return nil, fmt.Errorf("cannot read INSERT into %s: %w", table, err)
+		}
+		for _, values := range rows {
+			value := func(i int) string {
+				if i >= 0 && i < len(values) {
+					return values[i]
+				}
+				return ""
+			}
+			records = append(records, yourlsRecord(len(records)+1, value(keyword), value(url), value(clicks)))
+		}
+	}
+	if !found {
+		return nil, errors.New("no INSERT statements for a YOURLS url table found")
+	}
+	return records, nil
+}
+
+// parseSQLValues reads the rows of a VALUES clause, up to the semicolon that ends the
+// statement. NULLs are read as empty strings.
+func parseSQLValues(s string) ([][]string, error) {
+	var rows [][]string
+	i := 0
+	skipSpace := func() {
+		for i < len(s) && strings.ContainsRune(" \t\r\n", rune(s[i])) {
+			i++
+		}
+	}
+	for {
+		skipSpace()
+		if i >= len(s) || s[i] != '(' {
+			return nil, errors.New("expected ( at the start of a row")
+		}
+		i++
+		var row []string
+		for {
+			skipSpace()
+			if i >= len(s) {
+				return nil, errors.New("unexpected end of statement")
+			}
+			if s[i] == '\'' {
+				value, n, err := parseSQLString(s[i:])
+				if err != nil {
+					return nil, err
+				}
+				row = append(row, value)
+				i += n
+			} else {
+				end := i
+				for end < len(s) && s[end] != ',' && s[end] != ')' {
+					end++
+				}
+				value := strings.TrimSpace(s[i:end])
+				if strings.EqualFold(value, "NULL") {
+					value = ""
+				}
+				row = append(row, value)
+				i = end
+			}
+			skipSpace()
+			if i >= len(s) {
+				return nil, errors.New("unexpected end of statement")
+			}
+			if s[i] == ')' {
+				i++
+				break
+			}
+			if s[i] != ',' {
+				return nil, fmt.Errorf("unexpected %q in row", s[i])
+			}
+			i++
+		}
+		rows = append(rows, row)
+
+		skipSpace()
+		if i >= len(s) || s[i] == ';' {
+			return rows, nil
+		}
+		if s[i] != ',' {
+			return nil, fmt.Errorf("unexpected %q between rows", s[i])
+		}
+		i++
+	}
+}
+
+// parseSQLString reads a single quoted MySQL string literal from the start of s,
+// returning its value and the number of bytes it took up
+func parseSQLString(s string) (string, int, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case '0':
+				b.WriteByte(0)
+			default:
+				b.WriteByte(s[i])
+			}
+		case c == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			b.WriteByte('\'')
+			i++
+		case c == '\'':
+			return b.String(), i + 1, nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, errors.New("unterminated string")
+}
+
+// yourlsCount accepts click counts as either JSON numbers or strings, as YOURLS
+// returns them as strings
+type yourlsCount string
+
+func (c *yourlsCount) UnmarshalJSON(data []byte) error {
+	*c = yourlsCount(strings.Trim(string(data), `"`))
+	if *c == "null" {
+		*c = ""
+	}
+	return nil
+}
+
+type yourlsLink struct {
+	Keyword  string      `json:"keyword"`
+	ShortURL string      `json:"shorturl"`
+	URL      string      `json:"url"`
+	Clicks   yourlsCount `json:"clicks"`
+}
+
+// decodeYOURLSJSON reads links from a YOURLS stats API response, which has a "links"
+// object, or from a JSON export of the url table: either an array of rows or a
+// phpMyAdmin export with the rows under "data".
+func decodeYOURLSJSON(r io.Reader) ([]importRecord, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("cannot parse JSON: %w", err)
+	}
+
+	var links []yourlsLink
+	var stats struct {
+		Links map[string]yourlsLink `json:"links"`
+	}
+	var rows []struct {
+		yourlsLink
+		Type string       `json:"type"`
+		Name string       `json:"name"`
+		Data []yourlsLink `json:"data"`
+	}
+	switch {
+	case json.Unmarshal(raw, &stats) == nil && stats.Links != nil:
+		// the stats API names its links link_1, link_2 ... so sort them back into order
+		keys := make([]string, 0, len(stats.Links))
+		for key := range stats.Links {
+			keys = append(keys, key)
+		}
+		slices.SortFunc(keys, func(a, b string) int {
+			if len(a) != len(b) {
+				return len(a) - len(b)
+			}
+			return strings.Compare(a, b)
+		})
+		for _, key := range keys {
+			links = append(links, stats.Links[key])
+		}
+	case json.Unmarshal(raw, &rows) == nil:
+		for _, row := range rows {
+			if row.Type == "table" {
+				if strings.HasSuffix(strings.ToLower(row.Name), "url") {
+					links = append(links, row.Data...)
+				}
+				continue
+			}
+			if row.Type == "" {
+				links = append(links, row.yourlsLink)
+			}
+		}
+	default:
+		return nil, errors.New("JSON is not a YOURLS stats response or url table export")
+	}
+
+	records := make([]importRecord, len(links))
+	for i, l := range links {
+		keyword := l.Keyword
+		if keyword == "" {
+			keyword = shortCodeFromURL(l.ShortURL)
+		}
+		records[i] = yourlsRecord(i+1, keyword, l.URL, string(l.Clicks))
+	}
+	return records, nil
+}
+
+// Header names used by the different versions of Bitly's CSV export, after
+// normalising them to lower case with spaces
+var (
+	bitlyShortColumns  = []string{"bitlink", "link", "short url", "short link", "shortlink", "custom bitlink"}
+	bitlyLongColumns   = []string{"long url", "destination url", "destination", "original url", "url"}
+	bitlyClicksColumns = []string{"clicks", "total clicks", "user clicks", "engagements", "total engagements"}
+)
+
+// decodeBitlyCSV reads a CSV export of links from Bitly. The short code is the
+// back-half of the Bitlink, so bit.ly/abc is imported as abc.
+func decodeBitlyCSV(r io.Reader) ([]importRecord, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CSV header: %w", err)
+	}
+	for i, name := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(strings.ReplaceAll(strings.TrimPrefix(name, "\ufeff"), "_", " ")))
+	}
+	column := func(names []string) int {
+		for _, name := range names {
+			if i := slices.Index(header, name); i >= 0 {
+				return i
+			}
+		}
+		return -1
+	}
+	short, long, clicks := column(bitlyShortColumns), column(bitlyLongColumns), column(bitlyClicksColumns)
+	if short < 0 || long < 0 {
+		return nil, errors.New("CSV must have Bitlink and Long URL columns")
+	}
+
+	var records []importRecord
+	for row := 2; ; row++ {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CSV row %d: %w", row, err)
+		}
+		value := func(i int) string {
+			if i >= 0 && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		rec := importRecord{row: row, link: Link{ShortCode: shortCodeFromURL(value(short)), LongLink: value(long)}}
+		if rec.link.TimesAccessed, err = parseCount(value(clicks)); err != nil {
+			rec.err = err.Error()
+		}
+		records = append(records, rec)
+	}
+}
@@ -0,0 +1,100 @@
+package shtnr
+
+import (
+	"strings"
+	"testing"
+)
+
+// assertRecords checks the short code, destination and clicks of each imported record
+func assertRecords(t *testing.T, records []importRecord, want []Link) {
+	t.Helper()
+	if len(records) != len(want) {
+		t.Fatalf("Expected %d records, got %d: %+v", len(want), len(records), records)
+	}
+	for i, rec := range records {
+		if rec.err != "" {
+			t.Errorf("Record %d: unexpected error %q", i, rec.err)
+		}
+		got := rec.link
+		if got.ShortCode != want[i].ShortCode || got.LongLink != want[i].LongLink || got.TimesAccessed != want[i].TimesAccessed {
+			t.Errorf("Record %d: expected %+v, got %+v", i, want[i], rec.link)
+		}
+	}
+}
+
+func TestDecodeYOURLSSQL(t *testing.T) {
+	dump := "-- MySQL dump\n" +
+		"INSERT INTO `yourls_options` VALUES (1,'version','1.9');\n" +
+		"INSERT INTO `yourls_url` VALUES ('docs','https://example.com/docs','Docs','2020-01-01 00:00:00','127.0.0.1',12)," +
+		"('quote','https://example.com/it\\'s?a=1,b=2','It''s',NULL,'127.0.0.1',0);\n" +
+		"INSERT INTO `short_url` (`url`, `keyword`, `clicks`) VALUES ('https://example.org','org','3');\n"
+
+	records, err := decodeYOURLSSQL(strings.NewReader(dump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRecords(t, records, []Link{
+		{ShortCode: "docs", LongLink: "https://example.com/docs", TimesAccessed: 12},
+		{ShortCode: "quote", LongLink: "https://example.com/it's?a=1,b=2"},
+		{ShortCode: "org", LongLink: "https://example.org", TimesAccessed: 3},
+	})
+
+	if _, err = decodeYOURLSSQL(strings.NewReader("INSERT INTO `yourls_log` VALUES (1);")); err == nil {
+		t.Error("Expected an error for a dump without a url table")
+	}
+	if _, err = decodeYOURLSSQL(strings.NewReader("INSERT INTO `yourls_url` VALUES ('a','b")); err == nil {
+		t.Error("Expected an error for a truncated dump")
+	}
+}
+
+func TestDecodeYOURLSJSON(t *testing.T) {
+	stats := `{"links": {
+		"link_10": {"shorturl": "https://sho.rt/ten", "url": "https://example.com/10", "clicks": "10"},
+		"link_2": {"shorturl": "https://sho.rt/two", "url": "https://example.com/2", "clicks": 2}
+	}, "stats": {"total_links": "2"}}`
+	records, err := decodeYOURLSJSON(strings.NewReader(stats))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRecords(t, records, []Link{
+		{ShortCode: "two", LongLink: "https://example.com/2", TimesAccessed: 2},
+		{ShortCode: "ten", LongLink: "https://example.com/10", TimesAccessed: 10},
+	})
+
+	phpMyAdmin := `[
+		{"type": "header", "version": "5.2.1"},
+		{"type": "table", "name": "yourls_log", "data": [{"click_id": "1"}]},
+		{"type": "table", "name": "yourls_url", "data": [{"keyword": "docs", "url": "https://example.com/docs", "clicks": "7"}]}
+	]`
+	records, err = decodeYOURLSJSON(strings.NewReader(phpMyAdmin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRecords(t, records, []Link{{ShortCode: "docs", LongLink: "https://example.com/docs", TimesAccessed: 7}})
+
+	if _, err = decodeYOURLSJSON(strings.NewReader(`{"status": "fail"}`)); err == nil {
+		t.Error("Expected an error for JSON that isn't a YOURLS export")
+	}
+}
+
+func TestDecodeBitlyCSV(t *testing.T) {
+	export := "Title,Bitlink,Long URL,Created,Total clicks\n" +
+		"Docs,bit.ly/3AbCdEf,https://example.com/docs,2023-01-01,\"1,204\"\n" +
+		"Custom,https://bit.ly/launch-day?utm=x,https://example.com/launch,2023-02-01,0\n"
+	records, err := decodeBitlyCSV(strings.NewReader(export))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRecords(t, records, []Link{
+		{ShortCode: "3AbCdEf", LongLink: "https://example.com/docs", TimesAccessed: 1204},
+		{ShortCode: "launch-day", LongLink: "https://example.com/launch"},
+	})
+
+	records, err = decodeBitlyCSV(strings.NewReader("link,long_url,clicks\nbit.ly/x,https://example.com,lots\n"))
+	if err != nil || len(records) != 1 || records[0].err == "" {
+		t.Errorf("Expected a bad click count to be reported on the record, got %+v, %v", records, err)
+	}
+	if _, err = decodeBitlyCSV(strings.NewReader("Title,Created\n")); err == nil {
+		t.Error("Expected an error for a CSV without Bitlink and Long URL columns")
+	}
+}
@@ -0,0 +1,343 @@
+package shtnr
+
+import (
+	"database/sql"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// The purposes a pending login cookie can be issued for, after the password has been
+// checked but before a session is granted
+const (
+	pendingVerify = "verify"
+	pendingEnroll = "enroll"
+)
+
+// pendingLoginLifetime is how long the user has to complete the second login step
+const pendingLoginLifetime = 5 * time.Minute
+
+const totpIssuer = "Shtnr"
+
+// mfaRequired reports whether users with the role must use two-factor authentication
+func (app *App) mfaRequired(role string) bool {
+	return slices.Contains(app.config.mfaRequiredRoles, role)
+}
+
+// startPendingLogin remembers that the user has given the right password and sends
+// them on to the second factor step
+func (app *App) startPendingLogin(w http.ResponseWriter, r *http.Request, username, purpose string) {
+	value := map[string]string{
+		"username": username,
+		"purpose":  purpose,
+		"expires":  strconv.FormatInt(time.Now().Add(pendingLoginLifetime).Unix(), 10),
+	}
+	encoded, err := app.sc.Encode("mfa_pending", value)
+	if err != nil {
+		log.Println("Failed to encode pending login:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "mfa_pending",
+		Value:    encoded,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   !app.config.isDevelopment,
+		SameSite: http.SameSiteStrictMode,
+		Expires:  time.Now().Add(pendingLoginLifetime),
+	})
+
+	if purpose == pendingEnroll {
+		http.Redirect(w, r, "/mfa/setup", http.StatusSeeOther)
+	} else {
+		http.Redirect(w, r, "/login/mfa", http.StatusSeeOther)
+	}
+}
+
+// pendingLogin returns the user named in an unexpired pending login cookie with the given purpose
+func (app *App) pendingLogin(r *http.Request, purpose string) (string, bool) {
+	cookie, err := r.Cookie("mfa_pending")
+	if err != nil {
+		return "", false
+	}
+	value := make(map[string]string)
+	if err = app.sc.Decode("mfa_pending", cookie.Value, &value); err != nil {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(value["expires"], 10, 64)
+	if err != nil || time.Now().Unix() > expires || value["purpose"] != purpose {
+		return "", false
+	}
+	return value["username"], true
+}
+
+func (app *App) clearPendingLogin(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "mfa_pending",
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   !app.config.isDevelopment,
+	})
+}
+
+// MFAPageHandler renders the form asking for the second factor during login
+func (app *App) MFAPageHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := app.pendingLogin(r, pendingVerify); !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	app.renderMFAPage(w, http.StatusOK, "")
+}
+
+func (app *App) renderMFAPage(w http.ResponseWriter, status int, message string) {
+	tmpl := app.template("mfa.html")
+	type ViewModel struct {
+		Error string
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err := tmpl.Execute(w, ViewModel{Error: message})
+	if err != nil {
+		log.Println("Failed to execute template:", err)
+	}
+}
+
+// MFAHandler checks the authenticator or recovery code and completes the login
+func (app *App) MFAHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := app.pendingLogin(r, pendingVerify)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	ip := clientIP(r)
+
+	if wait, _ := app.loginThrottle.check(ip, username); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		app.renderMFAPage(w, http.StatusTooManyRequests, "Too many failed attempts. Please wait before trying again.")
+		return
+	}
+
+	u, err := app.getUserByUsername(username)
+	if err != nil {
+		log.Println("Failed to look up user for second factor:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	code := r.FormValue("code")
+	if step, ok := verifyTOTP(u.totpSecret, code, time.Now(), u.totpLastStep); ok {
+		if err = app.setUserTOTPLastStep(u.id, step); err != nil {
+			log.Println("Failed to record TOTP step:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	} else if used, err := app.useRecoveryCode(u.id, hashRecoveryCode(code)); err != nil {
+		log.Println("Failed to check recovery code:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	} else if !used {
+		log.Println("Login failed: invalid second factor for", username)
+		app.recordLoginFailure(r, username)
+		app.renderMFAPage(w, http.StatusUnauthorized, "Invalid authentication code.")
+		return
+	} else {
+		log.Println("Recovery code used to log in:", username)
+	}
+
+	app.clearPendingLogin(w)
+	app.completeLogin(w, r, ip, username)
+}
+
+// mfaSetupUser works out who is enrolling: either a logged-in user, or one whose role
+// requires two-factor authentication and who has only got as far as the password
+func (app *App) mfaSetupUser(r *http.Request) (u user, pending bool, err error) {
+	username, ok := app.sessionUsername(r)
+	if !ok {
+		username, pending = app.pendingLogin(r, pendingEnroll)
+		if !pending {
+			return u, false, sql.ErrNoRows
+		}
+	}
+	u, err = app.getUserByUsername(username)
+	return u, pending, err
+}
+
+type mfaSetupViewModel struct {
+	Username      string
+	Enabled       bool
+	Required      bool
+	QRCode        template.URL
+	Secret        string
+	RecoveryCodes []string
+	Error         string
+}
+
+func (app *App) renderMFASetupPage(w http.ResponseWriter, status int, vm mfaSetupViewModel) {
+	tmpl := app.template("mfa_setup.html")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err := tmpl.Execute(w, vm)
+	if err != nil {
+		log.Println("Failed to execute template:", err)
+	}
+}
+
+// MFASetupPageHandler shows the current two-factor status, or the secret to enrol
+// with as a QR code. The secret is only generated the first time, so reloading the
+// page or opening it twice shows the same one.
+func (app *App) MFASetupPageHandler(w http.ResponseWriter, r *http.Request) {
+	u, _, err := app.mfaSetupUser(r)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		log.Println("Failed to look up user for MFA setup:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	vm := mfaSetupViewModel{Username: u.username, Enabled: u.totpEnabled, Required: app.mfaRequired(u.role)}
+	if !u.totpEnabled {
+		if err = app.prepareEnrolment(&vm, u, false); err != nil {
+			log.Println("Failed to prepare MFA enrolment:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	app.renderMFASetupPage(w, http.StatusOK, vm)
+}
+
+// prepareEnrolment fills in the details the authenticator app needs. It keeps the
+// user's unconfirmed secret, and only stores a fresh one if they have none yet or
+// rotate is set.
+func (app *App) prepareEnrolment(vm *mfaSetupViewModel, u user, rotate bool) error {
+	secret := u.totpSecret
+	if secret == "" || rotate {
+		var err error
+		if secret, err = generateTOTPSecret(); err != nil {
+			return err
+		}
+		if err = app.setUserTOTPSecret(u.id, secret); err != nil {
+			return err
+		}
+	}
+	qr, err := qrCodeDataURI(totpProvisioningURI(totpIssuer, u.username, secret))
+	if err != nil {
+		return err
+	}
+	vm.Secret = secret
+	vm.QRCode = template.URL(qr)
+	return nil
+}
+
+// MFASetupHandler confirms enrolment with a code from the authenticator app and hands
+// out the recovery codes, or replaces the unconfirmed secret when rotate is posted
+func (app *App) MFASetupHandler(w http.ResponseWriter, r *http.Request) {
+	u, pending, err := app.mfaSetupUser(r)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		log.Println("Failed to look up user for MFA setup:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	vm := mfaSetupViewModel{Username: u.username, Required: app.mfaRequired(u.role)}
+	if u.totpEnabled {
+		vm.Enabled = true
+		app.renderMFASetupPage(w, http.StatusOK, vm)
+		return
+	}
+
+	if r.FormValue("rotate") == "true" {
+		if err = app.prepareEnrolment(&vm, u, true); err != nil {
+			log.Println("Failed to prepare MFA enrolment:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		app.renderMFASetupPage(w, http.StatusOK, vm)
+		return
+	}
+
+	step, ok := verifyTOTP(u.totpSecret, r.FormValue("code"), time.Now(), 0)
+	if u.totpSecret == "" || !ok {
+		vm.Error = "That code didn't match. Try again with the code your app shows now."
+		if err = app.prepareEnrolment(&vm, u, false); err != nil {
+			log.Println("Failed to prepare MFA enrolment:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		app.renderMFASetupPage(w, http.StatusUnprocessableEntity, vm)
+		return
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		log.Println("Failed to generate recovery codes:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = hashRecoveryCode(code)
+	}
+	if err = app.enableUserTOTP(u.id, step, hashes); err != nil {
+		log.Println("Failed to enable MFA:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	app.auditAs(r, u.username, "mfa.enable", u.username, nil, nil)
+
+	if pending {
+		// Enrolment was the last step of logging in
+		app.clearPendingLogin(w)
+		app.loginThrottle.succeed(clientIP(r), u.username)
+		if err = app.setSessionCookie(w, u.username); err != nil {
+			log.Println("Failed to encode session token:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	vm.Enabled = true
+	vm.RecoveryCodes = codes
+	app.renderMFASetupPage(w, http.StatusOK, vm)
+}
+
+// MFADisableHandler turns off two-factor authentication for the logged-in user after
+// checking a current code, unless their role requires it
+func (app *App) MFADisableHandler(w http.ResponseWriter, r *http.Request) {
+	username, _ := app.sessionUsername(r)
+	u, err := app.getUserByUsername(username)
+	if err != nil {
+		log.Println("Failed to look up user to disable MFA:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	vm := mfaSetupViewModel{Username: u.username, Enabled: u.totpEnabled, Required: app.mfaRequired(u.role)}
+	if vm.Required {
+		vm.Error = "Two-factor authentication is required for your role."
+		app.renderMFASetupPage(w, http.StatusForbidden, vm)
+		return
+	}
+	if _, ok := verifyTOTP(u.totpSecret, r.FormValue("code"), time.Now(), u.totpLastStep); !ok {
+		vm.Error = "Invalid authentication code."
+		app.renderMFASetupPage(w, http.StatusUnprocessableEntity, vm)
+		return
+	}
+	if err = app.disableUserTOTP(u.id); err != nil {
+		log.Println("Failed to disable MFA:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	app.audit(r, "mfa.disable", u.username, nil, nil)
+	http.Redirect(w, r, "/mfa/setup", http.StatusSeeOther)
+}
@@ -0,0 +1,202 @@
+package shtnr
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// createTestUser adds a user with the password "secret" for the length of the test
+func createTestUser(t *testing.T, username, role string) user {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	if err = app.ensureUser(username, string(hash), role); err != nil {
+		t.Fatalf("ensureUser failed: %v", err)
+	}
+	t.Cleanup(func() {
+		testApp.db.Exec("DELETE FROM users WHERE username = ?", username)
+	})
+	u, err := app.getUserByUsername(username)
+	if err != nil {
+		t.Fatalf("getUserByUsername failed: %v", err)
+	}
+	return u
+}
+
+// withoutLoginBackoff swaps in a throttle that only locks out, so tests can fail a login
+// and retry straight away
+func withoutLoginBackoff(t *testing.T) {
+	t.Helper()
+	original := app.loginThrottle
+	app.loginThrottle = newLoginThrottle(10, time.Minute)
+	app.loginThrottle.baseDelay = 0
+	t.Cleanup(func() { app.loginThrottle = original })
+}
+
+// postForm sends a form to the handler, carrying over the given cookies
+func postForm(handler http.HandlerFunc, path string, data url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", path, strings.NewReader(data.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	return rr
+}
+
+func findCookie(rr *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestLoginWithTOTP(t *testing.T) {
+	withoutLoginBackoff(t)
+	u := createTestUser(t, "mfauser", "admin")
+	secret, _ := generateTOTPSecret()
+	if err := app.setUserTOTPSecret(u.id, secret); err != nil {
+		t.Fatalf("setUserTOTPSecret failed: %v", err)
+	}
+	if err := app.enableUserTOTP(u.id, 0, []string{hashRecoveryCode("aaaaa-bbbbb")}); err != nil {
+		t.Fatalf("enableUserTOTP failed: %v", err)
+	}
+
+	rr := postForm(app.LoginHandler, "/login", url.Values{"username": {"mfauser"}, "password": {"secret"}}, nil)
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/login/mfa" {
+		t.Fatalf("Expected redirect to /login/mfa, got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+	if findCookie(rr, "session_token") != nil {
+		t.Fatal("Session must not be issued before the second factor")
+	}
+	pending := findCookie(rr, "mfa_pending")
+	if pending == nil {
+		t.Fatal("Expected a pending login cookie")
+	}
+
+	rr = postForm(app.MFAHandler, "/login/mfa", url.Values{"code": {"000000"}}, []*http.Cookie{pending})
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for wrong code, got %d", http.StatusUnauthorized, rr.Code)
+	}
+
+	code, _ := totpCode(secret, totpStep(time.Now()))
+	rr = postForm(app.MFAHandler, "/login/mfa", url.Values{"code": {code}}, []*http.Cookie{pending})
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/shortlinks" {
+		t.Fatalf("Expected redirect to /shortlinks, got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+	if findCookie(rr, "session_token") == nil {
+		t.Error("Expected a session cookie after the second factor")
+	}
+
+	// The same code cannot be used twice
+	rr = postForm(app.MFAHandler, "/login/mfa", url.Values{"code": {code}}, []*http.Cookie{pending})
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected replayed code to be rejected, got %d", rr.Code)
+	}
+
+	// Recovery codes work once
+	rr = postForm(app.MFAHandler, "/login/mfa", url.Values{"code": {"AAAAA-BBBBB"}}, []*http.Cookie{pending})
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("Expected recovery code to be accepted, got %d", rr.Code)
+	}
+	rr = postForm(app.MFAHandler, "/login/mfa", url.Values{"code": {"aaaaa-bbbbb"}}, []*http.Cookie{pending})
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected used recovery code to be rejected, got %d", rr.Code)
+	}
+}
+
+func TestMFAPageRequiresPendingLogin(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/login/mfa", nil)
+	rr := httptest.NewRecorder()
+	app.MFAPageHandler(rr, req)
+
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/login" {
+		t.Errorf("Expected redirect to /login, got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+}
+
+func TestRequiredMFAEnrolment(t *testing.T) {
+	app.config.mfaRequiredRoles = []string{"editor"}
+	defer func() { app.config.mfaRequiredRoles = nil }()
+	withoutLoginBackoff(t)
+	createTestUser(t, "editoruser", "editor")
+
+	rr := postForm(app.LoginHandler, "/login", url.Values{"username": {"editoruser"}, "password": {"secret"}}, nil)
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/mfa/setup" {
+		t.Fatalf("Expected redirect to /mfa/setup, got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+	pending := findCookie(rr, "mfa_pending")
+
+	req, _ := http.NewRequest("GET", "/mfa/setup", nil)
+	req.AddCookie(pending)
+	rr = httptest.NewRecorder()
+	app.MFASetupPageHandler(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "data:image/png;base64,") {
+		t.Fatalf("Expected the setup page with a QR code, got %d", rr.Code)
+	}
+
+	u, _ := app.getUserByUsername("editoruser")
+	code, _ := totpCode(u.totpSecret, totpStep(time.Now()))
+	rr = postForm(app.MFASetupHandler, "/mfa/setup", url.Values{"code": {code}}, []*http.Cookie{pending})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected enrolment to succeed, got %d", rr.Code)
+	}
+	if findCookie(rr, "session_token") == nil {
+		t.Error("Expected enrolment to complete the login")
+	}
+	if !strings.Contains(rr.Body.String(), "recovery codes") {
+		t.Error("Expected recovery codes to be shown")
+	}
+
+	u, _ = app.getUserByUsername("editoruser")
+	if !u.totpEnabled {
+		t.Error("Expected TOTP to be enabled")
+	}
+
+	// Users whose role requires MFA cannot turn it off
+	session := findCookie(rr, "session_token")
+	rr = postForm(app.MFADisableHandler, "/mfa/disable", url.Values{"code": {code}}, []*http.Cookie{session})
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %d", http.StatusForbidden, rr.Code)
+	}
+}
+
+func TestMFASetupKeepsSecret(t *testing.T) {
+	createTestUser(t, "enroluser", "editor")
+	session := sessionCookie(t, "enroluser")
+	secret := func() string {
+		u, _ := app.getUserByUsername("enroluser")
+		return u.totpSecret
+	}
+	showPage := func() {
+		req, _ := http.NewRequest("GET", "/mfa/setup", nil)
+		req.AddCookie(session)
+		app.MFASetupPageHandler(httptest.NewRecorder(), req)
+	}
+
+	showPage()
+	first := secret()
+	showPage()
+	if first == "" || secret() != first {
+		t.Errorf("Expected reloading the page to keep the secret, got %q then %q", first, secret())
+	}
+	rr := postForm(app.MFASetupHandler, "/mfa/setup", url.Values{"code": {"000000"}}, []*http.Cookie{session})
+	if rr.Code != http.StatusUnprocessableEntity || secret() != first {
+		t.Errorf("Expected a wrong code to keep the secret, got %d", rr.Code)
+	}
+	rr = postForm(app.MFASetupHandler, "/mfa/setup", url.Values{"rotate": {"true"}}, []*http.Cookie{session})
+	if rr.Code != http.StatusOK || secret() == first || !strings.Contains(rr.Body.String(), secret()) {
+		t.Errorf("Expected a new secret to be shown, got %d", rr.Code)
+	}
+}
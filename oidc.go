@@ -0,0 +1,465 @@
+package shtnr
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcStateLifetime is how long the user has to complete the login at the identity provider
+const oidcStateLifetime = 10 * time.Minute
+
+// oidcGroupRole maps a group claimed by the identity provider onto a local role
+type oidcGroupRole struct {
+	group string
+	role  string
+}
+
+// oidcDiscovery is the subset of the provider's openid-configuration document that we use
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcClaims are the ID token claims used to log a user in
+type oidcClaims struct {
+	Issuer        string       `json:"iss"`
+	Subject       string       `json:"sub"`
+	Audience      oidcAudience `json:"aud"`
+	Expiry        int64        `json:"exp"`
+	IssuedAt      int64        `json:"iat"`
+	Nonce         string       `json:"nonce"`
+	Email         string       `json:"email"`
+	EmailVerified *bool        `json:"email_verified"`
+	Groups        []string     `json:"groups"`
+}
+
+// oidcAudience accepts the aud claim as either a single string or an array
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = oidcAudience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// oidcProvider logs users in through an OpenID Connect identity provider using the
+// authorization code flow with PKCE. The discovery document and signing keys are
+// fetched on first use and cached; the keys are refetched when a token is signed
+// with a key we haven't seen, to follow the provider's key rotation.
+type oidcProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       []string
+	groupRoles   []oidcGroupRole
+	defaultRole  string
+	client       *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+}
+
+func newOIDCProvider(config *Config) *oidcProvider {
+	if config.oidcIssuer == "" {
+		return nil
+	}
+	redirectURL := config.oidcRedirectURL
+	if redirectURL == "" {
+		redirectURL = config.siteURL() + "/login/oidc/callback"
+	}
+	scopes := config.oidcScopes
+	if !slices.Contains(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+	return &oidcProvider{
+		issuer:       strings.TrimSuffix(config.oidcIssuer, "/"),
+		clientID:     config.oidcClientID,
+		clientSecret: config.oidcClientSecret,
+		redirectURL:  redirectURL,
+		scopes:       scopes,
+		groupRoles:   config.oidcGroupRoles,
+		defaultRole:  config.oidcDefaultRole,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// parseGroupRoles reads a list of group=role pairs. The first pair whose group the
+// user is in decides their role, so the most privileged roles should be listed first.
+func parseGroupRoles(pairs []string) []oidcGroupRole {
+	var mappings []oidcGroupRole
+	for _, pair := range pairs {
+		group, role, ok := strings.Cut(pair, "=")
+		if !ok {
+			log.Printf("Ignoring OIDC group mapping %q: expected group=role", pair)
+			continue
+		}
+		mappings = append(mappings, oidcGroupRole{strings.TrimSpace(group), strings.TrimSpace(role)})
+	}
+	return mappings
+}
+
+// role returns the local role for the claimed groups, or "" if the user may not log in
+func (p *oidcProvider) role(groups []string) string {
+	for _, m := range p.groupRoles {
+		if slices.Contains(groups, m.group) {
+			return m.role
+		}
+	}
+	return p.defaultRole
+}
+
+func (p *oidcProvider) getJSON(target string, v any) error {
+	resp, err := p.client.Get(target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, target)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// discover returns the provider's configuration, fetching it on first use
+func (p *oidcProvider) discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	if err := p.getJSON(p.issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("failed to fetch OIDC discovery document: %w", err)
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("OIDC discovery issuer %q does not match configured issuer %q", d.Issuer, p.issuer)
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// key returns the RSA signing key with the given ID, refreshing the key set if needed
+func (p *oidcProvider) key(kid string) (*rsa.PublicKey, error) {
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err = p.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("failed to fetch OIDC signing keys: %w", err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			log.Printf("Ignoring malformed OIDC signing key %q", k.Kid)
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	p.keys = keys
+
+	k, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("no OIDC signing key with id %q", kid)
+	}
+	return k, nil
+}
+
+// authCodeURL builds the URL the user is sent to at the identity provider
+func (p *oidcProvider) authCodeURL(state, nonce, verifier string) (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.clientID)
+	params.Set("redirect_uri", p.redirectURL)
+	params.Set("scope", strings.Join(p.scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+// exchange swaps the authorization code for tokens and returns the raw ID token
+func (p *oidcProvider) exchange(code, verifier string) (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURL)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to call OIDC token endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode OIDC token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("OIDC token endpoint returned %d: %s %s", resp.StatusCode, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("OIDC token response did not include an id_token")
+	}
+	return body.IDToken, nil
+}
+
+// verify checks the ID token's signature and claims and returns the claims
+func (p *oidcProvider) verify(rawToken, nonce string, now time.Time) (*oidcClaims, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed ID token header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token signature: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, fmt.Errorf("invalid ID token signature: %w", err)
+	}
+
+	var claims oidcClaims
+	if err = decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed ID token claims: %w", err)
+	}
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != p.issuer:
+		return nil, fmt.Errorf("ID token issued by %q, expected %q", claims.Issuer, p.issuer)
+	case !slices.Contains(claims.Audience, p.clientID):
+		return nil, errors.New("ID token was not issued for this client")
+	case now.Unix() >= claims.Expiry:
+		return nil, errors.New("ID token has expired")
+	case claims.Nonce != nonce:
+		return nil, errors.New("ID token nonce does not match")
+	case claims.Subject == "":
+		return nil, errors.New("ID token has no subject")
+	}
+	return &claims, nil
+}
+
+func decodeJWTSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// randomToken returns a URL safe random string with 256 bits of entropy
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// OIDCLoginHandler starts a login at the identity provider
+func (app *App) OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	state, err1 := randomToken()
+	nonce, err2 := randomToken()
+	verifier, err3 := randomToken()
+	if err := errors.Join(err1, err2, err3); err != nil {
+		log.Println("Failed to generate OIDC state:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	target, err := app.oidc.authCodeURL(state, nonce, verifier)
+	if err != nil {
+		log.Println("Failed to build OIDC authorization URL:", err)
+		app.renderLoginPage(w, http.StatusBadGateway, "Single sign-on is currently unavailable.")
+		return
+	}
+
+	value := map[string]string{
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+		"expires":  strconv.FormatInt(time.Now().Add(oidcStateLifetime).Unix(), 10),
+	}
+	encoded, err := app.sc.Encode("oidc_state", value)
+	if err != nil {
+		log.Println("Failed to encode OIDC state:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "oidc_state",
+		Value:    encoded,
+		Path:     "/login/oidc",
+		HttpOnly: true,
+		Secure:   !app.config.isDevelopment,
+		// Lax so that the cookie comes back on the redirect from the provider
+		SameSite: http.SameSiteLaxMode,
+		Expires:  time.Now().Add(oidcStateLifetime),
+	})
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// OIDCCallbackHandler completes a login when the identity provider redirects back
+func (app *App) OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	ip := clientIP(r)
+
+	cookie, err := r.Cookie("oidc_state")
+	value := make(map[string]string)
+	if err == nil {
+		err = app.sc.Decode("oidc_state", cookie.Value, &value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: "oidc_state", Path: "/login/oidc", MaxAge: -1, HttpOnly: true, Secure: !app.config.isDevelopment})
+	var expires int64
+	if err == nil {
+		expires, err = strconv.ParseInt(value["expires"], 10, 64)
+	}
+	if err != nil || time.Now().Unix() > expires || r.URL.Query().Get("state") != value["state"] {
+		log.Println("OIDC login failed: missing, expired or mismatched state")
+		app.renderLoginPage(w, http.StatusBadRequest, "Your single sign-on session expired. Please try again.")
+		return
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		log.Printf("OIDC login failed at the provider: %s %s", e, r.URL.Query().Get("error_description"))
+		app.renderLoginPage(w, http.StatusUnauthorized, "Single sign-on was cancelled or refused.")
+		return
+	}
+
+	rawToken, err := app.oidc.exchange(r.URL.Query().Get("code"), value["verifier"])
+	if err != nil {
+		log.Println("OIDC login failed:", err)
+		app.renderLoginPage(w, http.StatusBadGateway, "Single sign-on failed. Please try again.")
+		return
+	}
+	claims, err := app.oidc.verify(rawToken, value["nonce"], time.Now())
+	if err != nil {
+		log.Println("OIDC login failed:", err)
+		app.renderLoginPage(w, http.StatusUnauthorized, "Single sign-on failed. Please try again.")
+		return
+	}
+
+	if claims.Email == "" || (claims.EmailVerified != nil && !*claims.EmailVerified) {
+		log.Printf("OIDC login refused for subject %s: no verified email", claims.Subject)
+		app.renderLoginPage(w, http.StatusForbidden, "Your account does not have a verified email address.")
+		return
+	}
+	role := app.oidc.role(claims.Groups)
+	if role == "" {
+		log.Printf("OIDC login refused for %s: no group maps to a role", claims.Email)
+		app.renderLoginPage(w, http.StatusForbidden, "Your account is not allowed to use this application.")
+		return
+	}
+
+	err = app.upsertSSOUser(app.oidc.issuer, claims.Subject, claims.Email, role)
+	if errors.Is(err, errSSOUsernameTaken) {
+		log.Printf("OIDC login refused for subject %s: %s already belongs to another account", claims.Subject, claims.Email)
+		app.renderLoginPage(w, http.StatusForbidden, "An account with your email address already exists and can't be used with single sign-on.")
+		return
+	}
+	if err != nil {
+		log.Println("Failed to store OIDC user:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// The identity provider is responsible for any second factor
+	app.completeLogin(w, r, ip, claims.Email)
+}
@@ -0,0 +1,278 @@
+package shtnr
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockIssuer is a minimal OpenID Connect provider serving discovery, JWKS and token
+// endpoints. Authorization is simulated by the test reading the redirect URL.
+type mockIssuer struct {
+	server    *httptest.Server
+	key       *rsa.PrivateKey
+	challenge string
+	nonce     string
+	claims    map[string]any
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	m := &mockIssuer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.server.URL,
+			"authorization_endpoint": m.server.URL + "/authorize",
+			"token_endpoint":         m.server.URL + "/token",
+			"jwks_uri":               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kid": "test-key",
+				"kty": "RSA",
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		switch {
+		case id != "shtnr" || secret != "client-secret":
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		case r.FormValue("code") != "good-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != m.challenge:
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		claims := map[string]any{
+			"iss":   m.server.URL,
+			"sub":   "user-1",
+			"aud":   "shtnr",
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"iat":   time.Now().Unix(),
+			"nonce": m.nonce,
+		}
+		for k, v := range m.claims {
+			claims[k] = v
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": m.sign(t, claims), "token_type": "Bearer"})
+	})
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+func (m *mockIssuer) sign(t *testing.T, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test-key", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// useMockIssuer points the app at the mock provider for the length of the test
+func useMockIssuer(t *testing.T, m *mockIssuer) {
+	t.Helper()
+	original := app.oidc
+	app.oidc = newOIDCProvider(&Config{
+		baseUrl:          "http://short.test",
+		oidcIssuer:       m.server.URL,
+		oidcClientID:     "shtnr",
+		oidcClientSecret: "client-secret",
+		oidcScopes:       []string{"email", "groups"},
+		oidcGroupRoles:   parseGroupRoles([]string{"link-admins=admin", "marketing=editor"}),
+	})
+	t.Cleanup(func() { app.oidc = original })
+}
+
+// oidcLogin runs the login flow through the mock provider and returns the callback response
+func oidcLogin(t *testing.T, m *mockIssuer, code string) *httptest.ResponseRecorder {
+	t.Helper()
+	req, _ := http.NewRequest("GET", "/login/oidc", nil)
+	rr := httptest.NewRecorder()
+	app.OIDCLoginHandler(rr, req)
+	if rr.Code != http.StatusFound {
+		t.Fatalf("Expected redirect to provider, got %d", rr.Code)
+	}
+	location, _ := url.Parse(rr.Header().Get("Location"))
+	if !strings.HasPrefix(location.String(), m.server.URL+"/authorize") {
+		t.Fatalf("Unexpected authorization URL: %s", location)
+	}
+	query := location.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("redirect_uri") != "http://short.test/login/oidc/callback" {
+		t.Errorf("Unexpected authorization parameters: %s", location.RawQuery)
+	}
+	if query.Get("scope") != "openid email groups" {
+		t.Errorf("Unexpected scope: %s", query.Get("scope"))
+	}
+	m.challenge = query.Get("code_challenge")
+	m.nonce = query.Get("nonce")
+	state := findCookie(rr, "oidc_state")
+
+	callback := "/login/oidc/callback?" + url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	req, _ = http.NewRequest("GET", callback, nil)
+	req.AddCookie(state)
+	rr = httptest.NewRecorder()
+	app.OIDCCallbackHandler(rr, req)
+	return rr
+}
+
+func TestOIDCLogin(t *testing.T) {
+	m := newMockIssuer(t)
+	useMockIssuer(t, m)
+	m.claims = map[string]any{"email": "jo@example.com", "email_verified": true, "groups": []string{"staff", "marketing"}}
+	t.Cleanup(func() { testApp.db.Exec("DELETE FROM users WHERE username = ?", "jo@example.com") })
+
+	rr := oidcLogin(t, m, "good-code")
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/shortlinks" {
+		t.Fatalf("Expected redirect to /shortlinks, got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+	if findCookie(rr, "session_token") == nil {
+		t.Error("Expected a session cookie")
+	}
+
+	u, err := app.getUserByUsername("jo@example.com")
+	if err != nil {
+		t.Fatalf("Expected the user to be created: %v", err)
+	}
+	if u.role != "editor" {
+		t.Errorf("Expected role editor, got %s", u.role)
+	}
+
+	// Roles follow the identity provider on the next login
+	m.claims["groups"] = []string{"link-admins"}
+	oidcLogin(t, m, "good-code")
+	u, _ = app.getUserByUsername("jo@example.com")
+	if u.role != "admin" {
+		t.Errorf("Expected role admin, got %s", u.role)
+	}
+
+	// SSO users cannot use the password form
+	rr = postForm(app.LoginHandler, "/login", url.Values{"username": {"jo@example.com"}, "password": {""}}, nil)
+	if rr.Code == http.StatusSeeOther {
+		t.Error("Expected password login to fail for an SSO user")
+	}
+
+	// The user is known by their subject, so a new email renames them
+	m.claims["email"] = "joanna@example.com"
+	t.Cleanup(func() { testApp.db.Exec("DELETE FROM users WHERE username = ?", "joanna@example.com") })
+	oidcLogin(t, m, "good-code")
+	if _, err = app.getUserByUsername("jo@example.com"); err == nil {
+		t.Error("Expected the user to be renamed")
+	}
+	if u, err = app.getUserByUsername("joanna@example.com"); err != nil || u.role != "admin" {
+		t.Errorf("Expected the renamed user to keep their role, got %+v, %v", u, err)
+	}
+}
+
+func TestOIDCLoginLocalUsername(t *testing.T) {
+	m := newMockIssuer(t)
+	useMockIssuer(t, m)
+	if err := app.createUser("local@example.com", "$2a$10$notarealhash", "editor"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { testApp.db.Exec("DELETE FROM users WHERE username = ?", "local@example.com") })
+
+	// An identity with the same email as a password account doesn't log in as it
+	m.claims = map[string]any{"email": "local@example.com", "email_verified": true, "groups": []string{"link-admins"}}
+	if rr := oidcLogin(t, m, "good-code"); rr.Code != http.StatusForbidden || findCookie(rr, "session_token") != nil {
+		t.Errorf("Expected status %d without a session, got %d", http.StatusForbidden, rr.Code)
+	}
+	u, _ := app.getUserByUsername("local@example.com")
+	if u.role != "editor" || u.passwordHashed != "$2a$10$notarealhash" {
+		t.Errorf("Expected the local account to be left alone, got %+v", u)
+	}
+}
+
+func TestOIDCLoginRejected(t *testing.T) {
+	m := newMockIssuer(t)
+	useMockIssuer(t, m)
+
+	m.claims = map[string]any{"email": "nobody@example.com", "email_verified": true, "groups": []string{"staff"}}
+	if rr := oidcLogin(t, m, "good-code"); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d for unmapped groups, got %d", http.StatusForbidden, rr.Code)
+	}
+
+	m.claims = map[string]any{"email": "jo@example.com", "email_verified": false, "groups": []string{"link-admins"}}
+	if rr := oidcLogin(t, m, "good-code"); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d for unverified email, got %d", http.StatusForbidden, rr.Code)
+	}
+
+	if rr := oidcLogin(t, m, "bad-code"); rr.Code != http.StatusBadGateway {
+		t.Errorf("Expected status %d for a rejected code, got %d", http.StatusBadGateway, rr.Code)
+	}
+}
+
+func TestOIDCCallbackRequiresState(t *testing.T) {
+	m := newMockIssuer(t)
+	useMockIssuer(t, m)
+
+	req, _ := http.NewRequest("GET", "/login/oidc/callback?code=good-code&state=forged", nil)
+	rr := httptest.NewRecorder()
+	app.OIDCCallbackHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestOIDCVerify(t *testing.T) {
+	m := newMockIssuer(t)
+	useMockIssuer(t, m)
+	now := time.Now()
+	valid := map[string]any{"iss": m.server.URL, "sub": "user-1", "aud": []string{"other", "shtnr"}, "exp": now.Add(time.Minute).Unix(), "nonce": "n"}
+
+	if _, err := app.oidc.verify(m.sign(t, valid), "n", now); err != nil {
+		t.Errorf("Expected token to verify: %v", err)
+	}
+
+	tests := map[string]map[string]any{
+		"wrong issuer":   {"iss": "https://evil.example", "aud": "shtnr", "exp": now.Add(time.Minute).Unix(), "nonce": "n"},
+		"wrong audience": {"iss": m.server.URL, "aud": "other", "exp": now.Add(time.Minute).Unix(), "nonce": "n"},
+		"expired":        {"iss": m.server.URL, "aud": "shtnr", "exp": now.Add(-time.Minute).Unix(), "nonce": "n"},
+		"wrong nonce":    {"iss": m.server.URL, "aud": "shtnr", "exp": now.Add(time.Minute).Unix(), "nonce": "x"},
+		"no subject":     {"iss": m.server.URL, "aud": "shtnr", "exp": now.Add(time.Minute).Unix(), "nonce": "n"},
+	}
+	for name, claims := range tests {
+		if _, err := app.oidc.verify(m.sign(t, claims), "n", now); err == nil {
+			t.Errorf("%s: expected verification to fail", name)
+		}
+	}
+
+	// Tampering with the claims breaks the signature
+	token := m.sign(t, valid)
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(map[string]any{"iss": m.server.URL, "aud": "shtnr", "exp": now.Add(time.Hour).Unix(), "nonce": "n", "email": "boss@example.com"})
+	parts[1] = base64.RawURLEncoding.EncodeToString(forged)
+	if _, err := app.oidc.verify(strings.Join(parts, "."), "n", now); err == nil {
+		t.Error("Expected a tampered token to fail verification")
+	}
+}
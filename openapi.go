@@ -0,0 +1,18 @@
+package shtnr
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec describes every route under /api. openapi_test.go checks that it stays in
+// step with the router and with the Link type.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// OpenAPIHandler serves the OpenAPI specification of the API
+func (app *App) OpenAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(openAPISpec)
+}
@@ -0,0 +1,111 @@
+package shtnr
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type testOpenAPISpec struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		SecuritySchemes map[string]struct {
+			Type string `json:"type"`
+			In   string `json:"in"`
+			Name string `json:"name"`
+		} `json:"securitySchemes"`
+		Schemas map[string]struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+		} `json:"schemas"`
+	} `json:"components"`
+}
+
+func loadOpenAPISpec(t *testing.T) testOpenAPISpec {
+	t.Helper()
+	var spec testOpenAPISpec
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("openapi.json is not valid JSON: %s", err)
+	}
+	return spec
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/api/openapi.json", nil)
+	rr := httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d without an API key, got %d", http.StatusOK, rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected JSON content type, got %q", ct)
+	}
+	if !json.Valid(rr.Body.Bytes()) {
+		t.Error("Expected the spec to be valid JSON")
+	}
+}
+
+func TestOpenAPISpecCoversRoutes(t *testing.T) {
+	spec := loadOpenAPISpec(t)
+
+	registered := make(map[string][]string)
+	err := chi.Walk(app.routes(), func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		if !strings.HasPrefix(route, "/api/") {
+			return nil
+		}
+		// chi reports the root of a sub-router with a trailing slash
+		if len(route) > 1 {
+			route = strings.TrimSuffix(route, "/")
+		}
+		registered[route] = append(registered[route], strings.ToLower(method))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for route, methods := range registered {
+		for _, method := range methods {
+			if _, ok := spec.Paths[route][method]; !ok {
+				t.Errorf("%s %s is routed but missing from openapi.json", strings.ToUpper(method), route)
+			}
+		}
+	}
+	for path, operations := range spec.Paths {
+		for method := range operations {
+			if method == "parameters" {
+				continue
+			}
+			if !slices.Contains(registered[path], method) {
+				t.Errorf("%s %s is in openapi.json but not routed", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
+
+func TestOpenAPISpecDescribesLink(t *testing.T) {
+	spec := loadOpenAPISpec(t)
+
+	scheme := spec.Components.SecuritySchemes["ApiKey"]
+	if scheme.Type != "apiKey" || scheme.In != "header" || scheme.Name != "X-API-KEY" {
+		t.Errorf("Expected an X-API-KEY header security scheme, got %+v", scheme)
+	}
+
+	properties := spec.Components.Schemas["Link"].Properties
+	linkType := reflect.TypeOf(Link{})
+	for i := 0; i < linkType.NumField(); i++ {
+		name, _, _ := strings.Cut(linkType.Field(i).Tag.Get("json"), ",")
+		if _, ok := properties[name]; !ok {
+			t.Errorf("Link field %s is missing from the Link schema", name)
+		}
+	}
+	if len(properties) != linkType.NumField() {
+		t.Errorf("Expected %d properties in the Link schema, got %d", linkType.NumField(), len(properties))
+	}
+}
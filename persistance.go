@@ -1,57 +1,431 @@
-package main
+package shtnr
 
 import (
 	"crypto/rand"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"log"
 	"math/big"
+	"strings"
+	"time"
 )
 
-func setupDatabase() {
-	var err error
-	app.db, err = sql.Open("sqlite3", "./data/local.sqlite")
+// defaultDatabaseFile is where the database is kept when no store is given to New
+const defaultDatabaseFile = "./data/local.sqlite"
+
+// openDatabase opens a SQLite database file. The schema is brought up to date by
+// migrate.
+func openDatabase(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", path)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
+	return db, nil
+}
 
-	createTable := `
+// migrations holds the schema changes in the order they are applied. The index of
+// the last applied migration + 1 is stored in the database's user_version pragma,
+// so new changes must only ever be appended to the end of this list.
+var migrations = []string{
+	`
 	CREATE TABLE IF NOT EXISTS links (
 		ID INTEGER PRIMARY KEY,
 		short_code TEXT UNIQUE NOT NULL,
 		long_link TEXT NOT NULL,
 		times_accessed NUMERIC DEFAULT 0
 	);
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		actor TEXT NOT NULL,
+		action TEXT NOT NULL,
+		target TEXT NOT NULL DEFAULT '',
+		ip TEXT NOT NULL DEFAULT '',
+		details TEXT NOT NULL DEFAULT ''
+	);
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY,
+		username TEXT UNIQUE NOT NULL,
+		password_hash TEXT NOT NULL,
+		role TEXT NOT NULL DEFAULT 'admin',
+		totp_secret TEXT NOT NULL DEFAULT '',
+		totp_enabled INTEGER NOT NULL DEFAULT 0,
+		totp_last_step INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		id INTEGER PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		code_hash TEXT NOT NULL,
+		used_at TIMESTAMP
+	);
+	`,
+	`
+	ALTER TABLE audit_log ADD COLUMN before_value TEXT NOT NULL DEFAULT '';
+	ALTER TABLE audit_log ADD COLUMN after_value TEXT NOT NULL DEFAULT '';
+	CREATE INDEX IF NOT EXISTS audit_log_target ON audit_log (target);
+	CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+	BEGIN
+		SELECT RAISE(ABORT, 'audit log is append-only');
+	END;
+	CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+	BEGIN
+		SELECT RAISE(ABORT, 'audit log is append-only');
+	END;
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		key TEXT PRIMARY KEY,
+		request_hash TEXT NOT NULL,
+		status INTEGER NOT NULL DEFAULT 0,
+		response TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		revoked_at TIMESTAMP
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS api_keys_active_name ON api_keys (name) WHERE revoked_at IS NULL;
+	`,
+	`
+	ALTER TABLE links ADD COLUMN created_at TIMESTAMP;
+	ALTER TABLE links ADD COLUMN updated_at TIMESTAMP;
+	-- existing links take their creation time from the audit log where it has one
+	UPDATE links SET created_at = COALESCE(
+		(SELECT MIN(created_at) FROM audit_log WHERE action = 'link.create' AND target = links.short_code),
+		CURRENT_TIMESTAMP
+	);
+	UPDATE links SET updated_at = created_at;
+	CREATE INDEX IF NOT EXISTS links_created_at ON links (created_at);
+	`,
+	`
+	-- links visited before this have no last_accessed_at, only a count
+	ALTER TABLE links ADD COLUMN last_accessed_at TIMESTAMP;
+	ALTER TABLE links ADD COLUMN archived_at TIMESTAMP;
+	CREATE INDEX IF NOT EXISTS links_last_accessed_at ON links (last_accessed_at);
+	`,
+	`
+	ALTER TABLE links ADD COLUMN deleted_at TIMESTAMP;
+	CREATE INDEX IF NOT EXISTS links_deleted_at ON links (deleted_at);
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS link_revisions (
+		id INTEGER PRIMARY KEY,
+		link_id INTEGER NOT NULL,
+		revision INTEGER NOT NULL,
+		short_code TEXT NOT NULL,
+		long_link TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (link_id, revision)
+	);
+	-- existing links start their history with the version they have now
+	INSERT INTO link_revisions (link_id, revision, short_code, long_link, created_at)
+	SELECT id, 1, short_code, long_link, COALESCE(updated_at, CURRENT_TIMESTAMP) FROM links;
+	-- every way of saving a link, including imports, adds a revision
+	CREATE TRIGGER IF NOT EXISTS link_revisions_insert AFTER INSERT ON links
+	BEGIN
+		INSERT INTO link_revisions (link_id, revision, short_code, long_link)
+		VALUES (NEW.id, 1, NEW.short_code, NEW.long_link);
+	END;
+	CREATE TRIGGER IF NOT EXISTS link_revisions_update AFTER UPDATE OF short_code, long_link ON links
+	WHEN OLD.short_code IS NOT NEW.short_code OR OLD.long_link IS NOT NEW.long_link
+	BEGIN
+		INSERT INTO link_revisions (link_id, revision, short_code, long_link)
+		VALUES (NEW.id, (SELECT COALESCE(MAX(revision), 0) + 1 FROM link_revisions WHERE link_id = NEW.id), NEW.short_code, NEW.long_link);
+	END;
+	CREATE TRIGGER IF NOT EXISTS link_revisions_delete AFTER DELETE ON links
+	BEGIN
+		DELETE FROM link_revisions WHERE link_id = OLD.id;
+	END;
+	`,
+	`
+	CREATE TABLE IF NOT EXISTS link_tags (
+		link_id INTEGER NOT NULL,
+		tag TEXT NOT NULL,
+		PRIMARY KEY (link_id, tag)
+	);
+	CREATE INDEX IF NOT EXISTS link_tags_tag ON link_tags (tag);
+	CREATE TRIGGER IF NOT EXISTS link_tags_delete AFTER DELETE ON links
+	BEGIN
+		DELETE FROM link_tags WHERE link_id = OLD.id;
+	END;
+	`,
+	`
+	ALTER TABLE links ADD COLUMN title TEXT NOT NULL DEFAULT '';
+	ALTER TABLE links ADD COLUMN description TEXT NOT NULL DEFAULT '';
+	ALTER TABLE links ADD COLUMN notes TEXT NOT NULL DEFAULT '';
+	`,
+	`
+	ALTER TABLE links ADD COLUMN query_passthrough TEXT NOT NULL DEFAULT 'off';
+	ALTER TABLE links ADD COLUMN path_passthrough INTEGER NOT NULL DEFAULT 0;
+	`,
+	`
+	ALTER TABLE links ADD COLUMN fallback_url TEXT NOT NULL DEFAULT '';
+	`,
+	`
+	-- single sign-on users are known by who issued their identity, not their email
+	ALTER TABLE users ADD COLUMN sso_issuer TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN sso_subject TEXT NOT NULL DEFAULT '';
+	CREATE UNIQUE INDEX IF NOT EXISTS users_sso_identity ON users (sso_issuer, sso_subject) WHERE sso_subject != '';
+	`,
+	`
+	-- idempotency keys belong to the caller that sent them. They are only held for a
+	-- short window, so the ones from before this are dropped rather than carried over.
+	DROP TABLE IF EXISTS idempotency_keys;
+	CREATE TABLE idempotency_keys (
+		actor TEXT NOT NULL,
+		key TEXT NOT NULL,
+		request_hash TEXT NOT NULL,
+		status INTEGER NOT NULL DEFAULT 0,
+		response TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (actor, key)
+	);
+	`,
 	`
+	-- revisions keep every field of a link that can be edited. The ones from before
+	-- this only kept the short code and destination, so they take the rest from the
+	-- link as it is now.
+	ALTER TABLE link_revisions ADD COLUMN title TEXT NOT NULL DEFAULT '';
+	ALTER TABLE link_revisions ADD COLUMN description TEXT NOT NULL DEFAULT '';
+	ALTER TABLE link_revisions ADD COLUMN notes TEXT NOT NULL DEFAULT '';
+	ALTER TABLE link_revisions ADD COLUMN query_passthrough TEXT NOT NULL DEFAULT 'off';
+	ALTER TABLE link_revisions ADD COLUMN path_passthrough INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE link_revisions ADD COLUMN fallback_url TEXT NOT NULL DEFAULT '';
+	ALTER TABLE link_revisions ADD COLUMN tags TEXT NOT NULL DEFAULT '';
+	UPDATE link_revisions SET (title, description, notes, query_passthrough, path_passthrough, fallback_url, tags) = (
+		SELECT title, description, notes, query_passthrough, path_passthrough, fallback_url,
+		       COALESCE((SELECT group_concat(tag) FROM (SELECT tag FROM link_tags WHERE link_id = links.id ORDER BY tag)), '')
+		FROM links WHERE links.id = link_revisions.link_id
+	) WHERE link_id IN (SELECT id FROM links);
+	-- tags are saved after the link itself, so revisions are added by addLinkRevision
+	-- once both are
+	DROP TRIGGER IF EXISTS link_revisions_insert;
+	DROP TRIGGER IF EXISTS link_revisions_update;
+	`,
+}
 
-	_, err = app.db.Exec(createTable)
+// sqliteTimeFormat matches the format of CURRENT_TIMESTAMP so that times compare correctly
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+// sqliteTime formats a time to be stored, or gives NULL for the zero time so that
+// the statement can fall back to another value
+func sqliteTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(sqliteTimeFormat)
+}
+
+// sqliteNullTime formats a time that may not be set, giving NULL if it isn't
+func sqliteNullTime(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return sqliteTime(*t)
+}
+
+// schemaVersion returns the number of migrations that have been applied
+func schemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
 	if err != nil {
-		log.Fatal(err)
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
 	}
+	return version, nil
 }
 
-func insertLink(l *Link) (int64, error) {
+// migrate brings the database schema up to date by applying any migrations that
+// have not been run yet
+func migrate(db *sql.DB) error {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to start migration %d: %w", i+1, err)
+		}
+		if _, err = tx.Exec(migrations[i]); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to apply migration %d: %w", i+1, err)
+		}
+		// PRAGMA does not accept bound parameters
+		if _, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to record migration %d: %w", i+1, err)
+		}
+		if err = tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// errShortCodeTaken is returned when a link is saved with a short code that is already in use
+var errShortCodeTaken = errors.New("short code is already in use")
+
+// errLinkTrashed is returned when a link being followed has been moved to the trash
+var errLinkTrashed = errors.New("link is in the trash")
+
+// generatedShortCodeAttempts is how many random short codes are tried before giving up
+const generatedShortCodeAttempts = 5
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func (app *App) insertLink(l *Link) (int64, error) {
+	return insertLinkWith(app.db, l)
+}
+
+// insertLinkWith saves a new link. It is created now unless it has a CreatedAt, as an
+// imported link does, and was last updated when it was created unless it has an
+// UpdatedAt.
+func insertLinkWith(db execer, l *Link) (int64, error) {
 	// if the short code is not provided, generate one
-	if l.ShortCode == "" {
-		l.ShortCode = generateShortCode()
+	generated := l.ShortCode == ""
+	if l.QueryPassthrough == "" {
+		l.QueryPassthrough = queryPassthroughOff
 	}
-	result, err := app.db.Exec(`
-	INSERT INTO links (
-	                     short_code, long_link
-	                     ) VALUES (?, ?)`, l.ShortCode, l.LongLink)
+	for attempt := 1; ; attempt++ {
+		if generated {
+			l.ShortCode = generateShortCode()
+		}
+		result, err := db.Exec(`
+		INSERT INTO links (
+		                     short_code, long_link, times_accessed, title, description, notes, query_passthrough, path_passthrough, fallback_url, created_at, updated_at,
+		                     last_accessed_at, archived_at
+		                     ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, COALESCE(?, CURRENT_TIMESTAMP), COALESCE(?, ?, CURRENT_TIMESTAMP), ?, ?)`,
+			l.ShortCode, l.LongLink, l.TimesAccessed, l.Title, l.Description, l.Notes, l.QueryPassthrough, l.PathPassthrough, l.FallbackURL,
+			sqliteTime(l.CreatedAt), sqliteTime(l.UpdatedAt), sqliteTime(l.CreatedAt), sqliteNullTime(l.LastAccessedAt), sqliteNullTime(l.ArchivedAt))
+		if isUniqueViolation(err) {
+			// a clash with a random code is just bad luck, so try another
+			if generated && attempt < generatedShortCodeAttempts {
+				continue
+			}
+			return 0, errShortCodeTaken
+		}
+		if err != nil {
+			log.Println(err)
+			return 0, err
+		}
+
+		id, err := result.LastInsertId()
+		if err != nil {
+			log.Println("Failed to retrieve last insert ID:", err)
+			return 0, err
+		}
+		if err = setLinkTags(db, id, l.Tags); err != nil {
+			return 0, err
+		}
+		if err = addLinkRevision(db, id); err != nil {
+			return 0, err
+		}
+
+		return id, nil
+	}
+}
+
+// insertLinksAtomically inserts all of the links or none of them. If one can't be
+// inserted it returns its index along with the error.
+func (app *App) insertLinksAtomically(links []Link) ([]int64, int, error) {
+	tx, err := app.db.Begin()
 	if err != nil {
-		log.Println(err)
-		return 0, err
+		return nil, -1, err
 	}
+	defer tx.Rollback()
 
-	id, err := result.LastInsertId()
+	ids := make([]int64, len(links))
+	for i := range links {
+		ids[i], err = insertLinkWith(tx, &links[i])
+		if err != nil {
+			return nil, i, err
+		}
+	}
+	return ids, -1, tx.Commit()
+}
+
+// What happened to each link passed to importLinks
+const (
+	importCreated  = "created"
+	importUpdated  = "updated"
+	importConflict = "conflict"
+)
+
+// importLinks saves imported links, including their visit counts and times, in one
+// transaction. A link whose short code is already in use is skipped, or replaced by
+// the imported one if overwrite is set. It keeps its creation time if the import
+// doesn't have one, and is updated now if the import doesn't say when it was. It
+// returns what happened to each link. A dry run rolls the transaction back instead
+// of committing it.
+func (app *App) importLinks(links []Link, overwrite, dryRun bool) ([]string, error) {
+	tx, err := app.db.Begin()
 	if err != nil {
-		log.Println("Failed to retrieve last insert ID:", err)
-		return 0, err
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	outcomes := make([]string, len(links))
+	for i := range links {
+		_, err = insertLinkWith(tx, &links[i])
+		switch {
+		case err == nil:
+			outcomes[i] = importCreated
+		case !errors.Is(err, errShortCodeTaken):
+			return nil, err
+		case overwrite:
+			// a link in the trash is taken back out of it, as it would be created otherwise
+			statement := `
+			UPDATE links SET long_link = ?, times_accessed = ?, title = ?, description = ?, notes = ?, query_passthrough = ?, path_passthrough = ?,
+			                 fallback_url = ?, created_at = COALESCE(?, created_at), updated_at = COALESCE(?, CURRENT_TIMESTAMP),
+			                 last_accessed_at = ?, archived_at = ?, deleted_at = NULL
+			WHERE short_code = ? RETURNING id`
+			l := links[i]
+			if l.QueryPassthrough == "" {
+				l.QueryPassthrough = queryPassthroughOff
+			}
+			var id int64
+			err = tx.QueryRow(statement, l.LongLink, l.TimesAccessed, l.Title, l.Description, l.Notes, l.QueryPassthrough, l.PathPassthrough,
+				l.FallbackURL, sqliteTime(l.CreatedAt), sqliteTime(l.UpdatedAt), sqliteNullTime(l.LastAccessedAt), sqliteNullTime(l.ArchivedAt), l.ShortCode).Scan(&id)
+			if err != nil {
+				return nil, err
+			}
+			if err = setLinkTags(tx, id, l.Tags); err != nil {
+				return nil, err
+			}
+			if err = addLinkRevision(tx, id); err != nil {
+				return nil, err
+			}
+			outcomes[i] = importUpdated
+		default:
+			outcomes[i] = importConflict
+		}
+	}
+	if dryRun {
+		return outcomes, tx.Rollback()
 	}
+	return outcomes, tx.Commit()
+}
 
-	return id, nil
+// isUniqueViolation reports whether the error is from breaking a UNIQUE constraint
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
 }
 
 // generateShortCode generates a random 6 character string to be used as a short code
@@ -73,55 +447,827 @@ func generateShortCode() string {
 	return string(shortKey)
 }
 
-func getLinkByShortLink(shortCode string) (string, error) {
+// linkTagsColumn reads the tags of a row of links as a single comma separated column,
+// in alphabetical order. It is NULL for a link without tags.
+const linkTagsColumn = "(SELECT group_concat(tag) FROM (SELECT tag FROM link_tags WHERE link_id = links.id ORDER BY tag))"
+
+// linkColumns are the columns read into a Link by scanLink, in order
+const linkColumns = "id, short_code, long_link, times_accessed, created_at, updated_at, last_accessed_at, archived_at, deleted_at, title, description, notes, query_passthrough, path_passthrough, fallback_url, " +
+	linkTagsColumn
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanLink(row rowScanner) (Link, error) {
 	var l Link
-	err := app.db.QueryRow("SELECT id, short_code, long_link, times_accessed FROM links WHERE short_code = ?", shortCode).Scan(&l.ID, &l.ShortCode, &l.LongLink, &l.TimesAccessed)
+	var tags sql.NullString
+	err := row.Scan(&l.ID, &l.ShortCode, &l.LongLink, &l.TimesAccessed, &l.CreatedAt, &l.UpdatedAt, &l.LastAccessedAt, &l.ArchivedAt, &l.DeletedAt, &l.Title, &l.Description, &l.Notes, &l.QueryPassthrough, &l.PathPassthrough, &l.FallbackURL, &tags)
+	l.Tags = []string{}
+	if tags.String != "" {
+		l.Tags = strings.Split(tags.String, ",")
+	}
+	return l, err
+}
+
+// getLinkByShortLink looks up a link being followed. The visit is not counted until
+// the link has been followed. A link in the trash gives errLinkTrashed.
+func (app *App) getLinkByShortLink(shortCode string) (Link, error) {
+	l, err := scanLink(app.db.QueryRow("SELECT "+linkColumns+" FROM links WHERE short_code = ?", shortCode))
+	if err != nil {
+		return l, fmt.Errorf("failed to get link by short code in db query: %w", err)
+	}
+	if l.DeletedAt != nil {
+		return l, errLinkTrashed
+	}
+	return l, nil
+}
+
+// getLinkByShortCode looks up a link without counting it as a visit. Links in the
+// trash are not found.
+func (app *App) getLinkByShortCode(shortCode string) (Link, error) {
+	l, err := scanLink(app.db.QueryRow("SELECT "+linkColumns+" FROM links WHERE short_code = ? AND deleted_at IS NULL", shortCode))
 	if err != nil {
-		return "", fmt.Errorf("failed to get link by short code in db query: %w", err)
+		return l, fmt.Errorf("failed to get link by short code in db query: %w", err)
 	}
-	err = setVisitNumberToLink(l.ID, l.TimesAccessed+1)
+	return l, nil
+}
+
+// getTrashedLink looks up a link in the trash
+func (app *App) getTrashedLink(shortCode string) (Link, error) {
+	l, err := scanLink(app.db.QueryRow("SELECT "+linkColumns+" FROM links WHERE short_code = ? AND deleted_at IS NOT NULL", shortCode))
 	if err != nil {
-		return "", fmt.Errorf("failed to update visit number after getting links: %w", err)
+		return l, fmt.Errorf("failed to get link by short code in db query: %w", err)
 	}
-	return l.LongLink, nil
+	return l, nil
 }
 
-func getLinkByID(id int64) (Link, error) {
-	var l Link
-	err := app.db.QueryRow("SELECT id, short_code, long_link, times_accessed FROM links WHERE id = ?", id).Scan(&l.ID, &l.ShortCode, &l.LongLink, &l.TimesAccessed)
+func (app *App) getLinkByID(id int64) (Link, error) {
+	l, err := scanLink(app.db.QueryRow("SELECT "+linkColumns+" FROM links WHERE id = ?", id))
 	if err != nil {
 		return l, fmt.Errorf("failed to get link by short code in db query: %w", err)
 	}
 	return l, nil
 }
 
-func setVisitNumberToLink(id int, timesAccessed int) error {
+func (app *App) setVisitNumberToLink(id int, timesAccessed int) error {
 	statement := `UPDATE links SET times_accessed = ? WHERE id = ?`
 	_, err := app.db.Exec(statement, timesAccessed, id)
 	return err
 }
 
-func getAllLinks() ([]Link, error) {
-	rows, err := app.db.Query("SELECT id, short_code, long_link, times_accessed FROM links")
+// recordVisit counts a visit to a link and notes when it happened
+func (app *App) recordVisit(id int) error {
+	statement := `UPDATE links SET times_accessed = times_accessed + 1, last_accessed_at = CURRENT_TIMESTAMP WHERE id = ?`
+	_, err := app.db.Exec(statement, id)
+	return err
+}
+
+// setLinkArchived archives a link, or brings it back from the archive. Archiving a
+// link that already is keeps the time it was first archived.
+func (app *App) setLinkArchived(shortCode string, archived bool) error {
+	statement := `UPDATE links SET archived_at = NULL WHERE short_code = ?`
+	if archived {
+		statement = `UPDATE links SET archived_at = COALESCE(archived_at, CURRENT_TIMESTAMP) WHERE short_code = ?`
+	}
+	_, err := app.db.Exec(statement, shortCode)
+	return err
+}
+
+func (app *App) getAllLinks() ([]Link, error) {
+	rows, err := app.db.Query("SELECT " + linkColumns + " FROM links WHERE deleted_at IS NULL ORDER BY id")
 	if err != nil {
 		return nil, err
 	}
-	var links []Link
 	defer rows.Close()
+	return scanLinks(rows)
+}
 
+func scanLinks(rows *sql.Rows) ([]Link, error) {
+	var links []Link
 	for rows.Next() {
-		var l Link
-		err = rows.Scan(&l.ID, &l.ShortCode, &l.LongLink, &l.TimesAccessed)
+		l, err := scanLink(rows)
 		if err != nil {
 			return nil, err
 		}
 		links = append(links, l)
 	}
-	return links, nil
+	return links, rows.Err()
+}
+
+// linkQuery describes a page of links to list
+type linkQuery struct {
+	// Search matches anywhere in the short code, destination, title, description or
+	// notes
+	Search string
+	// Sort is one of the keys of linkSortColumns
+	Sort   string
+	Desc   bool
+	Limit  int
+	Offset int
+	// CreatedFrom and CreatedBefore limit the links to those created in that range,
+	// when they are set
+	CreatedFrom   time.Time
+	CreatedBefore time.Time
+	// Archived lists the archived links instead of the ones in use
+	Archived bool
+	// NotVisitedSince limits the links to those that have not been visited since
+	// then, counting links that were never visited from when they were created
+	NotVisitedSince time.Time
+	// NeverVisited limits the links to those that have never been visited
+	NeverVisited bool
+	// Trashed lists the links in the trash, archived or not, instead
+	Trashed bool
+	// Tag limits the links to those with this tag
+	Tag string
+	// Campaign limits the links to those whose destination has this utm_campaign
+	Campaign string
+}
+
+// linkSortColumns maps the sort keys accepted from users onto columns
+var linkSortColumns = map[string]string{
+	"id":         "id",
+	"short_code": "short_code",
+	"clicks":     "times_accessed",
+	"created":    "created_at",
+	"updated":    "updated_at",
+	"visited":    "last_accessed_at",
+	"deleted":    "deleted_at",
+}
+
+// setSort sets the order from a sort key, prefixed with "-" for descending order. It
+// reports whether the key is one of linkSortColumns.
+func (q *linkQuery) setSort(sort string) bool {
+	key, desc := strings.TrimPrefix(sort, "-"), strings.HasPrefix(sort, "-")
+	if _, ok := linkSortColumns[key]; !ok {
+		return false
+	}
+	q.Sort, q.Desc = key, desc
+	return true
+}
+
+// setCreatedRange limits the query to links created between from and to, either of
+// which may be empty. They take a date (YYYY-MM-DD) or an RFC 3339 time, and both ends
+// are inclusive, so a date on its own as to takes in the whole of that day.
+func (q *linkQuery) setCreatedRange(from, to string) error {
+	if from != "" {
+		t, _, err := parseLinkTime(from)
+		if err != nil {
+			return fmt.Errorf("invalid created from %q: %w", from, err)
+		}
+		q.CreatedFrom = t
+	}
+	if to != "" {
+		t, dateOnly, err := parseLinkTime(to)
+		if err != nil {
+			return fmt.Errorf("invalid created to %q: %w", to, err)
+		}
+		if dateOnly {
+			q.CreatedBefore = t.AddDate(0, 0, 1)
+		} else {
+			// the database keeps whole seconds
+			q.CreatedBefore = t.Truncate(time.Second).Add(time.Second)
+		}
+	}
+	return nil
+}
+
+// parseLinkTime parses a date or an RFC 3339 time, reporting which it was
+func parseLinkTime(s string) (time.Time, bool, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, false, errors.New("expected a date (YYYY-MM-DD) or an RFC 3339 time")
+	}
+	return t, false, nil
+}
+
+// listLinks returns a page of the links matching the query along with the total
+// number of matches
+func (app *App) listLinks(q linkQuery) ([]Link, int, error) {
+	var conditions []string
+	var args []any
+	if q.Search != "" {
+		conditions = append(conditions, `(short_code LIKE ? ESCAPE '\' OR long_link LIKE ? ESCAPE '\' OR title LIKE ? ESCAPE '\' `+
+			`OR description LIKE ? ESCAPE '\' OR notes LIKE ? ESCAPE '\')`)
+		pattern := "%" + escapeLike(q.Search) + "%"
+		args = append(args, pattern, pattern, pattern, pattern, pattern)
+	}
+	if q.Tag != "" {
+		conditions = append(conditions, `id IN (SELECT link_id FROM link_tags WHERE tag = ?)`)
+		args = append(args, q.Tag)
+	}
+	if q.Campaign != "" {
+		// the campaign is matched once the destination's query string is decoded,
+		// which SQL can't do
+		ids, err := app.campaignLinkIDs(q.Campaign)
+		if err != nil {
+			return nil, 0, err
+		}
+		encoded, err := json.Marshal(ids)
+		if err != nil {
+			return nil, 0, err
+		}
+		conditions = append(conditions, `id IN (SELECT value FROM json_each(?))`)
+		args = append(args, string(encoded))
+	}
+	if !q.CreatedFrom.IsZero() {
+		conditions = append(conditions, `created_at >= ?`)
+		args = append(args, q.CreatedFrom.UTC().Format(sqliteTimeFormat))
+	}
+	if !q.CreatedBefore.IsZero() {
+		conditions = append(conditions, `created_at < ?`)
+		args = append(args, q.CreatedBefore.UTC().Format(sqliteTimeFormat))
+	}
+	switch {
+	case q.Trashed:
+		conditions = append(conditions, `deleted_at IS NOT NULL`)
+	case q.Archived:
+		conditions = append(conditions, `deleted_at IS NULL`, `archived_at IS NOT NULL`)
+	default:
+		conditions = append(conditions, `deleted_at IS NULL`, `archived_at IS NULL`)
+	}
+	if !q.NotVisitedSince.IsZero() {
+		conditions = append(conditions, `COALESCE(last_accessed_at, created_at) < ?`)
+		args = append(args, q.NotVisitedSince.UTC().Format(sqliteTimeFormat))
+	}
+	if q.NeverVisited {
+		// the count also covers visits from before last_accessed_at was recorded
+		conditions = append(conditions, `times_accessed = 0`)
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	err := app.db.QueryRow("SELECT COUNT(*) FROM links"+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	column, ok := linkSortColumns[q.Sort]
+	if !ok {
+		column = "id"
+	}
+	direction := "ASC"
+	if q.Desc {
+		direction = "DESC"
+	}
+	// the id breaks ties so that paging is stable
+	query := "SELECT " + linkColumns + " FROM links" + where + " ORDER BY " + column + " " + direction + ", id " + direction + " LIMIT ? OFFSET ?"
+	rows, err := app.db.Query(query, append(args, q.Limit, q.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	links, err := scanLinks(rows)
+	return links, total, err
+}
+
+// escapeLike escapes the LIKE wildcards in user input
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// updateLink saves a new short code, destination, title, description, notes, tags,
+// passthrough settings and fallback URL for the link with the given ID
+func (app *App) updateLink(l Link) error {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statement := `
+	UPDATE links SET short_code = ?, long_link = ?, title = ?, description = ?, notes = ?, query_passthrough = ?, path_passthrough = ?,
+	                 fallback_url = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?`
+	_, err = tx.Exec(statement, l.ShortCode, l.LongLink, l.Title, l.Description, l.Notes, l.QueryPassthrough, l.PathPassthrough, l.FallbackURL, l.ID)
+	if isUniqueViolation(err) {
+		return errShortCodeTaken
+	}
+	if err != nil {
+		return err
+	}
+	if err = setLinkTags(tx, int64(l.ID), l.Tags); err != nil {
+		return err
+	}
+	if err = addLinkRevision(tx, int64(l.ID)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// setLinkTags replaces the tags on a link
+func setLinkTags(db execer, linkID int64, tags []string) error {
+	if _, err := db.Exec(`DELETE FROM link_tags WHERE link_id = ?`, linkID); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if _, err := db.Exec(`INSERT OR IGNORE INTO link_tags (link_id, tag) VALUES (?, ?)`, linkID, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listTagStats returns every tag in use with how many links have it and how many
+// times they have been followed between them. Links in the trash are left out.
+func (app *App) listTagStats() ([]TagStats, error) {
+	rows, err := app.db.Query(`
+	SELECT t.tag, COUNT(*), COALESCE(SUM(l.times_accessed), 0)
+	FROM link_tags t JOIN links l ON l.id = t.link_id
+	WHERE l.deleted_at IS NULL
+	GROUP BY t.tag ORDER BY t.tag`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []TagStats{}
+	for rows.Next() {
+		var s TagStats
+		if err = rows.Scan(&s.Tag, &s.Links, &s.Clicks); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+// linkRevisionColumns are the columns read into a LinkRevision by scanLinkRevision,
+// in order
+const linkRevisionColumns = "revision, short_code, long_link, title, description, notes, query_passthrough, path_passthrough, fallback_url, tags, created_at"
+
+func scanLinkRevision(row rowScanner) (LinkRevision, error) {
+	var rev LinkRevision
+	var tags string
+	err := row.Scan(&rev.Revision, &rev.ShortCode, &rev.LongLink, &rev.Title, &rev.Description, &rev.Notes, &rev.QueryPassthrough, &rev.PathPassthrough, &rev.FallbackURL, &tags, &rev.CreatedAt)
+	rev.Tags = []string{}
+	if tags != "" {
+		rev.Tags = strings.Split(tags, ",")
+	}
+	return rev, err
+}
+
+// addLinkRevision saves the link with the given ID as its next revision, unless
+// nothing that a revision keeps has changed since the last one. It is called once the
+// link and its tags have both been saved.
+func addLinkRevision(db execer, linkID int64) error {
+	_, err := db.Exec(`
+	INSERT INTO link_revisions (link_id, revision, short_code, long_link, title, description, notes, query_passthrough, path_passthrough, fallback_url, tags)
+	SELECT cur.id, COALESCE(last.revision, 0) + 1, cur.short_code, cur.long_link, cur.title, cur.description, cur.notes,
+	       cur.query_passthrough, cur.path_passthrough, cur.fallback_url, cur.tags
+	FROM (SELECT links.*, COALESCE(`+linkTagsColumn+`, '') AS tags FROM links WHERE id = ?) AS cur
+	LEFT JOIN (SELECT * FROM link_revisions WHERE link_id = ? ORDER BY revision DESC LIMIT 1) AS last ON 1
+	WHERE last.revision IS NULL
+	   OR (cur.short_code, cur.long_link, cur.title, cur.description, cur.notes, cur.query_passthrough, cur.path_passthrough, cur.fallback_url, cur.tags)
+	      IS NOT (last.short_code, last.long_link, last.title, last.description, last.notes, last.query_passthrough, last.path_passthrough, last.fallback_url, last.tags)`,
+		linkID, linkID)
+	return err
+}
+
+// listLinkRevisions returns every version of a link, newest first
+func (app *App) listLinkRevisions(linkID int) ([]LinkRevision, error) {
+	rows, err := app.db.Query(`SELECT `+linkRevisionColumns+` FROM link_revisions WHERE link_id = ? ORDER BY revision DESC`, linkID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []LinkRevision
+	for rows.Next() {
+		rev, err := scanLinkRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+// getLinkRevision looks up one version of a link
+func (app *App) getLinkRevision(linkID, revision int) (LinkRevision, error) {
+	row := app.db.QueryRow(`SELECT `+linkRevisionColumns+` FROM link_revisions WHERE link_id = ? AND revision = ?`, linkID, revision)
+	return scanLinkRevision(row)
+}
+
+// rollbackLink gives a link everything it had at an earlier revision, leaving its
+// visits and times alone. The rollback is saved as a new revision, so it can be undone
+// in turn.
+func (app *App) rollbackLink(l Link, revision int) (Link, error) {
+	rev, err := app.getLinkRevision(l.ID, revision)
+	if err != nil {
+		return l, err
+	}
+	l.ShortCode = rev.ShortCode
+	l.LongLink = rev.LongLink
+	l.Title = rev.Title
+	l.Description = rev.Description
+	l.Notes = rev.Notes
+	l.QueryPassthrough = rev.QueryPassthrough
+	l.PathPassthrough = rev.PathPassthrough
+	l.FallbackURL = rev.FallbackURL
+	l.Tags = rev.Tags
+	if err = app.updateLink(l); err != nil {
+		return l, err
+	}
+	return app.getLinkByID(int64(l.ID))
 }
 
-func deleteLink(shortCode string) error {
-	statement := `DELETE FROM links WHERE short_code = ?`
+// deleteLink moves a link to the trash, where it stays until it is restored or purged
+func (app *App) deleteLink(shortCode string) error {
+	statement := `UPDATE links SET deleted_at = CURRENT_TIMESTAMP WHERE short_code = ? AND deleted_at IS NULL`
 	_, err := app.db.Exec(statement, shortCode)
 	return err
 }
+
+// restoreLink takes a link back out of the trash
+func (app *App) restoreLink(shortCode string) error {
+	statement := `UPDATE links SET deleted_at = NULL WHERE short_code = ?`
+	_, err := app.db.Exec(statement, shortCode)
+	return err
+}
+
+// purgeLink deletes a link in the trash for good
+func (app *App) purgeLink(shortCode string) error {
+	statement := `DELETE FROM links WHERE short_code = ? AND deleted_at IS NOT NULL`
+	_, err := app.db.Exec(statement, shortCode)
+	return err
+}
+
+// purgeTrash deletes the links moved to the trash before deletedBefore for good, and
+// returns how many there were
+func (app *App) purgeTrash(deletedBefore time.Time) (int64, error) {
+	statement := `DELETE FROM links WHERE deleted_at < ?`
+	res, err := app.db.Exec(statement, deletedBefore.UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// insertAuditEvent appends an entry to the audit log
+func (app *App) insertAuditEvent(e AuditEvent) error {
+	statement := `
+	INSERT INTO audit_log (actor, action, target, ip, before_value, after_value, details)
+	VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err := app.db.Exec(statement, e.Actor, e.Action, e.Target, e.IP, string(e.Before), string(e.After), e.Details)
+	return err
+}
+
+// auditFilter narrows down the audit events returned by listAuditEvents. Zero values
+// match everything, and a zero Limit returns every matching event.
+type auditFilter struct {
+	Actor  string
+	Action string
+	Target string
+	From   time.Time
+	To     time.Time
+	Limit  int
+	Offset int
+}
+
+// listAuditEvents returns the matching audit events, newest first
+func (app *App) listAuditEvents(f auditFilter) ([]AuditEvent, error) {
+	query := `SELECT id, created_at, actor, action, target, ip, before_value, after_value, details FROM audit_log WHERE 1 = 1`
+	var args []any
+	if f.Actor != "" {
+		query += ` AND actor = ?`
+		args = append(args, f.Actor)
+	}
+	if f.Action != "" {
+		// match on prefix so that e.g. "link." finds every link change
+		query += ` AND action LIKE ? || '%' ESCAPE '\'`
+		args = append(args, escapeLike(f.Action))
+	}
+	if f.Target != "" {
+		query += ` AND target = ?`
+		args = append(args, f.Target)
+	}
+	if !f.From.IsZero() {
+		query += ` AND created_at >= ?`
+		args = append(args, f.From.UTC().Format(sqliteTimeFormat))
+	}
+	if !f.To.IsZero() {
+		query += ` AND created_at < ?`
+		args = append(args, f.To.UTC().Format(sqliteTimeFormat))
+	}
+	query += ` ORDER BY id DESC`
+	if f.Limit > 0 {
+		query += ` LIMIT ? OFFSET ?`
+		args = append(args, f.Limit, f.Offset)
+	}
+
+	rows, err := app.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	for rows.Next() {
+		var e AuditEvent
+		var before, after string
+		err = rows.Scan(&e.ID, &e.CreatedAt, &e.Actor, &e.Action, &e.Target, &e.IP, &before, &after, &e.Details)
+		if err != nil {
+			return nil, err
+		}
+		if before != "" {
+			e.Before = json.RawMessage(before)
+		}
+		if after != "" {
+			e.After = json.RawMessage(after)
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+var errUserExists = errors.New("user already exists")
+
+// createUser adds a local user, failing with errUserExists if the name is taken
+func (app *App) createUser(username, passwordHash, role string) error {
+	statement := `INSERT INTO users (username, password_hash, role) VALUES (?, ?, ?)`
+	_, err := app.db.Exec(statement, username, passwordHash, role)
+	if isUniqueViolation(err) {
+		return errUserExists
+	}
+	return err
+}
+
+// setUserPassword changes a user's password, returning sql.ErrNoRows if there is no
+// such user
+func (app *App) setUserPassword(username, passwordHash string) error {
+	res, err := app.db.Exec(`UPDATE users SET password_hash = ? WHERE username = ?`, passwordHash, username)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ensureUser creates the user if no user with that username exists yet. It is used to
+// seed the admin account from the environment on first start; later changes to the
+// account are left alone.
+func (app *App) ensureUser(username, passwordHash, role string) error {
+	statement := `INSERT OR IGNORE INTO users (username, password_hash, role) VALUES (?, ?, ?)`
+	_, err := app.db.Exec(statement, username, passwordHash, role)
+	return err
+}
+
+// errSSOUsernameTaken is returned when a single sign-on user's email is already the
+// username of an account that doesn't belong to them
+var errSSOUsernameTaken = errors.New("username is taken by another account")
+
+// upsertSSOUser creates or updates a user who logs in through single sign-on. They are
+// found by the issuer and subject of their identity, and their username and role
+// follow the identity provider on every login. They are given no password so they
+// cannot log in with the login form, and are never merged into a password account
+// that has the same username.
+func (app *App) upsertSSOUser(issuer, subject, username, role string) error {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`UPDATE users SET username = ?, role = ? WHERE sso_issuer = ? AND sso_subject = ?`,
+		// users who logged in before identities were recorded are matched by email once
+		`UPDATE users SET username = ?, role = ?, sso_issuer = ?, sso_subject = ?
+		WHERE username = ? AND password_hash = '' AND sso_subject = ''`,
+	}
+	for i, statement := range statements {
+		args := []any{username, role, issuer, subject}
+		if i == 1 {
+			args = append(args, username)
+		}
+		res, err := tx.Exec(statement, args...)
+		if isUniqueViolation(err) {
+			return errSSOUsernameTaken
+		}
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n > 0 {
+			return tx.Commit()
+		}
+	}
+
+	_, err = tx.Exec(`
+	INSERT INTO users (username, password_hash, role, sso_issuer, sso_subject) VALUES (?, '', ?, ?, ?)`,
+		username, role, issuer, subject)
+	if isUniqueViolation(err) {
+		return errSSOUsernameTaken
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (app *App) getUserByUsername(username string) (user, error) {
+	var u user
+	err := app.db.QueryRow(`
+	SELECT id, username, password_hash, role, totp_secret, totp_enabled, totp_last_step
+	FROM users WHERE username = ?`, username).Scan(&u.id, &u.username, &u.passwordHashed, &u.role, &u.totpSecret, &u.totpEnabled, &u.totpLastStep)
+	if err != nil {
+		return u, fmt.Errorf("failed to get user by username in db query: %w", err)
+	}
+	return u, nil
+}
+
+// setUserTOTPSecret stores a new, not yet confirmed, TOTP secret for the user
+func (app *App) setUserTOTPSecret(userID int, secret string) error {
+	statement := `UPDATE users SET totp_secret = ?, totp_enabled = 0, totp_last_step = 0 WHERE id = ?`
+	_, err := app.db.Exec(statement, secret, userID)
+	return err
+}
+
+// enableUserTOTP turns on two-factor authentication for the user and replaces any
+// existing recovery codes with the given hashes
+func (app *App) enableUserTOTP(userID int, lastStep int64, recoveryCodeHashes []string) error {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE users SET totp_enabled = 1, totp_last_step = ? WHERE id = ?`, lastStep, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodeHashes {
+		_, err = tx.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)`, userID, hash)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// disableUserTOTP turns off two-factor authentication and removes the recovery codes
+func (app *App) disableUserTOTP(userID int) error {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE users SET totp_secret = '', totp_enabled = 0, totp_last_step = 0 WHERE id = ?`, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// setUserTOTPLastStep records the time step of the last accepted code so it cannot be replayed
+func (app *App) setUserTOTPLastStep(userID int, step int64) error {
+	statement := `UPDATE users SET totp_last_step = ? WHERE id = ?`
+	_, err := app.db.Exec(statement, step, userID)
+	return err
+}
+
+// useRecoveryCode marks a matching unused recovery code as used, reporting whether there was one
+func (app *App) useRecoveryCode(userID int, codeHash string) (bool, error) {
+	statement := `UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP WHERE user_id = ? AND code_hash = ? AND used_at IS NULL`
+	result, err := app.db.Exec(statement, userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// idempotentResponse is what was recorded for an Idempotency-Key. A status of 0 means
+// the first request with the key has not finished yet.
+type idempotentResponse struct {
+	requestHash string
+	status      int
+	body        []byte
+}
+
+// reserveIdempotencyKey claims the actor's key for a new request, forgetting keys
+// created before expiredBefore. If the actor has already used the key it returns what
+// was recorded for it instead.
+func (app *App) reserveIdempotencyKey(actor, key, requestHash string, expiredBefore time.Time) (idempotentResponse, bool, error) {
+	var existing idempotentResponse
+	tx, err := app.db.Begin()
+	if err != nil {
+		return existing, false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM idempotency_keys WHERE created_at < ?`, expiredBefore.UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return existing, false, err
+	}
+	res, err := tx.Exec(`INSERT OR IGNORE INTO idempotency_keys (actor, key, request_hash) VALUES (?, ?, ?)`, actor, key, requestHash)
+	if err != nil {
+		return existing, false, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return existing, false, err
+	} else if n == 1 {
+		return existing, true, tx.Commit()
+	}
+
+	var body string
+	err = tx.QueryRow(`SELECT request_hash, status, response FROM idempotency_keys WHERE actor = ? AND key = ?`, actor, key).
+		Scan(&existing.requestHash, &existing.status, &body)
+	existing.body = []byte(body)
+	return existing, false, err
+}
+
+// completeIdempotencyKey records the response to replay for later requests with the key
+func (app *App) completeIdempotencyKey(actor, key string, status int, body []byte) error {
+	_, err := app.db.Exec(`UPDATE idempotency_keys SET status = ?, response = ? WHERE actor = ? AND key = ?`, status, string(body), actor, key)
+	return err
+}
+
+// releaseIdempotencyKey forgets a key whose request failed so that it can be retried
+func (app *App) releaseIdempotencyKey(actor, key string) error {
+	_, err := app.db.Exec(`DELETE FROM idempotency_keys WHERE actor = ? AND key = ?`, actor, key)
+	return err
+}
+
+var errAPIKeyExists = errors.New("an API key with that name already exists")
+
+// apiKey is a stored API key. Only a hash of the key itself is kept.
+type apiKey struct {
+	name      string
+	createdAt time.Time
+}
+
+// createAPIKey stores a new key, failing with errAPIKeyExists if an unrevoked key
+// already has the name
+func (app *App) createAPIKey(name, keyHash string) error {
+	_, err := app.db.Exec(`INSERT INTO api_keys (name, key_hash) VALUES (?, ?)`, name, keyHash)
+	if isUniqueViolation(err) {
+		return errAPIKeyExists
+	}
+	return err
+}
+
+// revokeAPIKey stops the named key from working, returning sql.ErrNoRows if there is
+// no unrevoked key with that name
+func (app *App) revokeAPIKey(name string) error {
+	res, err := app.db.Exec(`UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP WHERE name = ? AND revoked_at IS NULL`, name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// getAPIKeyName returns the name of the unrevoked key with the hash
+func (app *App) getAPIKeyName(keyHash string) (string, error) {
+	var name string
+	err := app.db.QueryRow(`SELECT name FROM api_keys WHERE key_hash = ? AND revoked_at IS NULL`, keyHash).Scan(&name)
+	return name, err
+}
+
+// listAPIKeys returns the unrevoked keys, oldest first
+func (app *App) listAPIKeys() ([]apiKey, error) {
+	rows, err := app.db.Query(`SELECT name, created_at FROM api_keys WHERE revoked_at IS NULL ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []apiKey
+	for rows.Next() {
+		var k apiKey
+		if err = rows.Scan(&k.name, &k.createdAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
@@ -1,4 +1,4 @@
-package main
+package shtnr
 
 import (
 	"database/sql"
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/gorilla/securecookie"
 	"golang.org/x/crypto/bcrypt"
@@ -13,6 +14,9 @@ import (
 
 var testApp App
 
+// app is the App that tests without their own instance run against
+var app *App
+
 func TestMain(m *testing.M) {
 	// Setup: Create a temporary database file for testing
 	tempDBFile := "./test_local.sqlite"
@@ -22,15 +26,20 @@ func TestMain(m *testing.M) {
 		fmt.Printf("Error opening database: %v\n", openErr)
 		os.Exit(1)
 	}
-	// Initialize the global app variable for testing
+	// Initialize the shared app for testing
 	app = &App{
 		config: &Config{
 			defaultAdminUser:     "testadmin",
 			defaultAdminPassword: "testpassword",
 			isDevelopment:        true,
 			apiKey:               "testapikey",
+			loginMaxAttempts:     5,
+			loginLockout:         15 * time.Minute,
+			idempotencyWindow:    24 * time.Hour,
+			trashRetention:       30 * 24 * time.Hour,
 		},
 	}
+	app.loginThrottle = newLoginThrottle(app.config.loginMaxAttempts, app.config.loginLockout)
 
 	// Hash the admin password for the test app
 	var hashedPassword []byte
@@ -47,23 +56,26 @@ func TestMain(m *testing.M) {
 	blockKey := securecookie.GenerateRandomKey(32)
 	app.sc = securecookie.New(hashKey, blockKey)
 
+	if err = app.loadTemplates(); err != nil {
+		fmt.Printf("Failed to parse templates: %v\n", err)
+		os.Exit(1)
+	}
+
 	app.db = testApp.db
 
 	// Initialize the database schema
-	createTable := `
-	CREATE TABLE IF NOT EXISTS links (
-		ID INTEGER PRIMARY KEY,
-		short_code TEXT UNIQUE NOT NULL,
-		long_link TEXT NOT NULL,
-		times_accessed NUMERIC DEFAULT 0
-	);
-	`
-	_, err = testApp.db.Exec(createTable)
+	err = migrate(testApp.db)
 	if err != nil {
 		fmt.Printf("Failed to create test database table: %v\n", err)
 		os.Exit(1)
 	}
 
+	err = app.ensureUser(app.config.defaultAdminUser, app.hashPassword, "admin")
+	if err != nil {
+		fmt.Printf("Failed to create test admin user: %v\n", err)
+		os.Exit(1)
+	}
+
 	// Run tests
 	code := m.Run()
 
@@ -81,7 +93,7 @@ func clearTable() {
 func TestInsertLink(t *testing.T) {
 	clearTable()
 	link := Link{ShortCode: "testshort", LongLink: "http://example.com"}
-	id, err := insertLink(&link)
+	id, err := app.insertLink(&link)
 	if err != nil {
 		t.Fatalf("insertLink failed: %v", err)
 	}
@@ -91,7 +103,7 @@ func TestInsertLink(t *testing.T) {
 
 	// Test auto-generation of short code
 	link2 := Link{LongLink: "http://example.org"}
-	id2, err := insertLink(&link2)
+	id2, err := app.insertLink(&link2)
 	if err != nil {
 		t.Fatalf("insertLink with auto-gen failed: %v", err)
 	}
@@ -106,18 +118,18 @@ func TestInsertLink(t *testing.T) {
 func TestGetLinkByShortLink(t *testing.T) {
 	clearTable()
 	link := Link{ShortCode: "gettest", LongLink: "http://get.com"}
-	_, _ = insertLink(&link)
+	_, _ = app.insertLink(&link)
 
-	longURL, err := getLinkByShortLink("gettest")
+	got, err := app.getLinkByShortLink("gettest")
 	if err != nil {
 		t.Fatalf("getLinkByShortLink failed: %v", err)
 	}
-	if longURL != link.LongLink {
-		t.Errorf("Expected %s, got %s", link.LongLink, longURL)
+	if got.LongLink != link.LongLink {
+		t.Errorf("Expected %s, got %s", link.LongLink, got.LongLink)
 	}
 
 	// Test non-existent short link
-	_, err = getLinkByShortLink("nonexistent")
+	_, err = app.getLinkByShortLink("nonexistent")
 	if !errors.Is(err, sql.ErrNoRows) {
 		t.Errorf("Expected sql.ErrNoRows for non-existent link, got %v", err)
 	}
@@ -126,9 +138,9 @@ func TestGetLinkByShortLink(t *testing.T) {
 func TestGetLinkByID(t *testing.T) {
 	clearTable()
 	link := Link{ShortCode: "idtest", LongLink: "http://id.com"}
-	id, _ := insertLink(&link)
+	id, _ := app.insertLink(&link)
 
-	retrievedLink, err := getLinkByID(id)
+	retrievedLink, err := app.getLinkByID(id)
 	if err != nil {
 		t.Fatalf("getLinkByID failed: %v", err)
 	}
@@ -137,7 +149,7 @@ func TestGetLinkByID(t *testing.T) {
 	}
 
 	// Test non-existent ID
-	_, err = getLinkByID(9999)
+	_, err = app.getLinkByID(9999)
 	if !errors.Is(err, sql.ErrNoRows) {
 		t.Errorf("Expected sql.ErrNoRows for non-existent ID, got %v", err)
 	}
@@ -146,25 +158,49 @@ func TestGetLinkByID(t *testing.T) {
 func TestSetVisitNumberToLink(t *testing.T) {
 	clearTable()
 	link := Link{ShortCode: "visitest", LongLink: "http://visit.com"}
-	id, _ := insertLink(&link)
+	id, _ := app.insertLink(&link)
 
-	err := setVisitNumberToLink(int(id), 10)
+	err := app.setVisitNumberToLink(int(id), 10)
 	if err != nil {
 		t.Fatalf("setVisitNumberToLink failed: %v", err)
 	}
 
-	retrievedLink, _ := getLinkByID(id)
+	retrievedLink, _ := app.getLinkByID(id)
 	if retrievedLink.TimesAccessed != 10 {
 		t.Errorf("Expected TimesAccessed to be 10, got %d", retrievedLink.TimesAccessed)
 	}
 }
 
+func TestLinkTimestamps(t *testing.T) {
+	clearTable()
+	link := Link{ShortCode: "stamped", LongLink: "http://stamped.com"}
+	id, _ := app.insertLink(&link)
+	// backdate the link so changes to it show in updated_at
+	_, _ = app.db.Exec(`UPDATE links SET created_at = '2020-01-01 00:00:00', updated_at = '2020-01-01 00:00:00' WHERE id = ?`, id)
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	_ = app.setVisitNumberToLink(int(id), 3)
+	got, _ := app.getLinkByID(id)
+	if !got.CreatedAt.Equal(created) || !got.UpdatedAt.Equal(created) {
+		t.Errorf("Expected visits to leave the times alone, got %v and %v", got.CreatedAt, got.UpdatedAt)
+	}
+
+	_ = app.updateLink(Link{ID: int(id), ShortCode: "stamped", LongLink: "http://stamped.org"})
+	got, _ = app.getLinkByID(id)
+	if !got.CreatedAt.Equal(created) {
+		t.Errorf("Expected created_at to stay %v, got %v", created, got.CreatedAt)
+	}
+	if time.Since(got.UpdatedAt) > time.Minute {
+		t.Errorf("Expected updated_at to be now, got %v", got.UpdatedAt)
+	}
+}
+
 func TestGetAllLinks(t *testing.T) {
 	clearTable()
-	_, _ = insertLink(&Link{ShortCode: "all1", LongLink: "http://all1.com"})
-	_, _ = insertLink(&Link{ShortCode: "all2", LongLink: "http://all2.com"})
+	_, _ = app.insertLink(&Link{ShortCode: "all1", LongLink: "http://all1.com"})
+	_, _ = app.insertLink(&Link{ShortCode: "all2", LongLink: "http://all2.com"})
 
-	links, err := getAllLinks()
+	links, err := app.getAllLinks()
 	if err != nil {
 		t.Fatalf("getAllLinks failed: %v", err)
 	}
@@ -176,16 +212,67 @@ func TestGetAllLinks(t *testing.T) {
 func TestDeleteLink(t *testing.T) {
 	clearTable()
 	link := Link{ShortCode: "deltest", LongLink: "http://del.com"}
-	_, _ = insertLink(&link)
+	_, _ = app.insertLink(&link)
 
-	err := deleteLink("deltest")
+	err := app.deleteLink("deltest")
 	if err != nil {
 		t.Fatalf("deleteLink failed: %v", err)
 	}
 
-	_, err = getLinkByShortLink("deltest")
-	if !errors.Is(err, sql.ErrNoRows) {
-		t.Error("Expected link to be deleted, but it was found")
+	_, err = app.getLinkByShortLink("deltest")
+	if !errors.Is(err, errLinkTrashed) {
+		t.Errorf("Expected the link to be in the trash, got %v", err)
+	}
+	if _, err = app.getLinkByShortCode("deltest"); !errors.Is(err, sql.ErrNoRows) {
+		t.Error("Expected the trashed link to be left out of lookups")
+	}
+
+	if err = app.restoreLink("deltest"); err != nil {
+		t.Fatalf("restoreLink failed: %v", err)
+	}
+	if _, err = app.getLinkByShortLink("deltest"); err != nil {
+		t.Errorf("Expected the restored link to work, got %v", err)
+	}
+
+	_ = app.deleteLink("deltest")
+	if err = app.purgeLink("deltest"); err != nil {
+		t.Fatalf("purgeLink failed: %v", err)
+	}
+	if _, err = app.getTrashedLink("deltest"); !errors.Is(err, sql.ErrNoRows) {
+		t.Error("Expected the purged link to be gone")
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	clearTable()
+	for _, code := range []string{"kept", "recent", "expired"} {
+		_, _ = app.insertLink(&Link{ShortCode: code, LongLink: "http://example.com/" + code})
+	}
+	_ = app.deleteLink("recent")
+	_ = app.deleteLink("expired")
+	_, _ = app.db.Exec(`UPDATE links SET deleted_at = '2020-01-01 00:00:00' WHERE short_code = 'expired'`)
+
+	n, err := app.purgeTrash(time.Now().AddDate(0, 0, -30))
+	if err != nil || n != 1 {
+		t.Fatalf("Expected 1 link to be purged, got %d, %v", n, err)
+	}
+	if _, err = app.getTrashedLink("recent"); err != nil {
+		t.Errorf("Expected the recently deleted link to stay in the trash, got %v", err)
+	}
+	var count int
+	_ = app.db.QueryRow(`SELECT COUNT(*) FROM links`).Scan(&count)
+	if count != 2 {
+		t.Errorf("Expected 2 links left, got %d", count)
+	}
+}
+
+func TestInsertLinkConflict(t *testing.T) {
+	clearTable()
+	_, _ = app.insertLink(&Link{ShortCode: "dupe", LongLink: "http://dupe.com"})
+
+	_, err := app.insertLink(&Link{ShortCode: "dupe", LongLink: "http://other.com"})
+	if !errors.Is(err, errShortCodeTaken) {
+		t.Errorf("Expected errShortCodeTaken, got %v", err)
 	}
 }
 
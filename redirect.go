@@ -0,0 +1,100 @@
+package shtnr
+
+import (
+	"errors"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// How a link passes the query string it was followed with on to its destination.
+// The modes other than off differ in what happens when the destination already has
+// a parameter of the same name.
+const (
+	// queryPassthroughOff drops the incoming query string
+	queryPassthroughOff = "off"
+	// queryPassthroughKeep keeps the destination's value
+	queryPassthroughKeep = "keep"
+	// queryPassthroughOverride replaces it with the incoming value
+	queryPassthroughOverride = "override"
+	// queryPassthroughAppend sends both
+	queryPassthroughAppend = "append"
+)
+
+const invalidQueryPassthroughMessage = "query_passthrough must be one of off, keep, override or append"
+
+// normalizeQueryPassthrough checks a query passthrough mode, treating no mode as off
+func normalizeQueryPassthrough(mode string) (string, error) {
+	switch mode {
+	case "":
+		return queryPassthroughOff, nil
+	case queryPassthroughOff, queryPassthroughKeep, queryPassthroughOverride, queryPassthroughAppend:
+		return mode, nil
+	}
+	return "", errors.New(invalidQueryPassthroughMessage)
+}
+
+// errPathNotForwarded is returned when a link is followed with extra path segments
+// that it does not pass on
+var errPathNotForwarded = errors.New("link does not pass on extra paths")
+
+// errDotSegment is returned when a link is followed with a . or .. path segment,
+// which would otherwise move the destination out of the path it is meant to stay in
+var errDotSegment = errors.New("paths can't have . or .. segments")
+
+// isDotSegment reports whether an escaped path segment is . or .., which browsers
+// resolve even when the dots are percent-encoded
+func isDotSegment(segment string) bool {
+	if unescaped, err := url.PathUnescape(segment); err == nil {
+		segment = unescaped
+	}
+	return segment == "." || segment == ".."
+}
+
+// redirectTarget returns where following a link goes. extraPath is the escaped path
+// after the short code, without a leading slash, and query is the incoming query
+// string. They fill in the placeholders of a template first, and what is left of
+// each is only passed on when the link allows it.
+func redirectTarget(l Link, extraPath string, query url.Values) (string, error) {
+	longLink, extraPath, query, err := fillPlaceholders(l, extraPath, query)
+	if err != nil {
+		return "", err
+	}
+	if extraPath != "" && !l.PathPassthrough {
+		return "", errPathNotForwarded
+	}
+	if slices.ContainsFunc(strings.Split(extraPath, "/"), isDotSegment) {
+		return "", errDotSegment
+	}
+	forwardQuery := len(query) > 0 && l.QueryPassthrough != "" && l.QueryPassthrough != queryPassthroughOff
+	if extraPath == "" && !forwardQuery {
+		return longLink, nil
+	}
+
+	dest, err := url.Parse(longLink)
+	if err != nil {
+		return "", err
+	}
+	if extraPath != "" {
+		dest = dest.JoinPath(extraPath)
+	}
+	if forwardQuery {
+		merged := dest.Query()
+		for name, values := range query {
+			switch {
+			case l.QueryPassthrough == queryPassthroughAppend:
+				merged[name] = append(merged[name], values...)
+			case l.QueryPassthrough == queryPassthroughOverride || !merged.Has(name):
+				merged[name] = values
+			}
+		}
+		dest.RawQuery = merged.Encode()
+	}
+	return dest.String(), nil
+}
+
+// extraPath returns the escaped path after the short code in a request for a link
+func extraPath(escapedPath string) string {
+	_, rest, _ := strings.Cut(strings.TrimPrefix(escapedPath, "/"), "/")
+	return rest
+}
@@ -0,0 +1,102 @@
+package shtnr
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRedirectTarget(t *testing.T) {
+	query := url.Values{"ref": {"mail"}, "lang": {"fr"}}
+	for _, tc := range []struct {
+		link  Link
+		path  string
+		query url.Values
+		want  string
+	}{
+		{Link{LongLink: "https://example.com/docs?lang=en", QueryPassthrough: queryPassthroughOff}, "", query, "https://example.com/docs?lang=en"},
+		{Link{LongLink: "https://example.com/docs?lang=en", QueryPassthrough: queryPassthroughKeep}, "", query, "https://example.com/docs?lang=en&ref=mail"},
+		{Link{LongLink: "https://example.com/docs?lang=en", QueryPassthrough: queryPassthroughOverride}, "", query, "https://example.com/docs?lang=fr&ref=mail"},
+		{Link{LongLink: "https://example.com/docs?lang=en", QueryPassthrough: queryPassthroughAppend}, "", query, "https://example.com/docs?lang=en&lang=fr&ref=mail"},
+		// the destination is left exactly as it is when there is nothing to add
+		{Link{LongLink: "https://example.com/docs?b=1&a=2", QueryPassthrough: queryPassthroughKeep}, "", nil, "https://example.com/docs?b=1&a=2"},
+		{Link{LongLink: "https://example.com/docs/", PathPassthrough: true}, "api/v2", nil, "https://example.com/docs/api/v2"},
+		{Link{LongLink: "https://example.com", PathPassthrough: true}, "api/v2/", nil, "https://example.com/api/v2/"},
+		{Link{LongLink: "https://example.com/docs?lang=en", PathPassthrough: true, QueryPassthrough: queryPassthroughKeep}, "a%2Fb", query, "https://example.com/docs/a%2Fb?lang=en&ref=mail"},
+	} {
+		got, err := redirectTarget(tc.link, tc.path, tc.query)
+		if err != nil || got != tc.want {
+			t.Errorf("Expected %s for %+v, got %s, %v", tc.want, tc.link, got, err)
+		}
+	}
+	if _, err := redirectTarget(Link{LongLink: "https://example.com"}, "extra", nil); err != errPathNotForwarded {
+		t.Errorf("Expected the extra path to be refused, got %v", err)
+	}
+	for _, path := range []string{"x/../../../evil", "./evil", "%2e%2e/evil", "api/.%2E"} {
+		if _, err := redirectTarget(Link{LongLink: "https://example.com/docs", PathPassthrough: true}, path, nil); err != errDotSegment {
+			t.Errorf("Expected %s to be refused, got %v", path, err)
+		}
+	}
+	if _, err := normalizeQueryPassthrough("sometimes"); err == nil {
+		t.Error("Expected an unknown query passthrough mode to be rejected")
+	}
+}
+
+func TestFollowShortURLPassthrough(t *testing.T) {
+	clearTable()
+	_, _ = app.insertLink(&Link{ShortCode: "docs", LongLink: "https://example.com/docs", PathPassthrough: true, QueryPassthrough: queryPassthroughKeep})
+	_, _ = app.insertLink(&Link{ShortCode: "plain", LongLink: "https://example.com/plain"})
+	router := app.routes()
+
+	for path, want := range map[string]string{
+		"/docs/api/v2?utm_source=mail": "https://example.com/docs/api/v2?utm_source=mail",
+		"/docs/info":                   "https://example.com/docs/info",
+		"/plain?utm_source=mail":       "https://example.com/plain",
+	} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != http.StatusTemporaryRedirect || rr.Header().Get("Location") != want {
+			t.Errorf("Expected %s to redirect to %s, got %d %s", path, want, rr.Code, rr.Header().Get("Location"))
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/plain/extra", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for a path the link doesn't pass on, got %d", http.StatusNotFound, rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/docs/x/../../../evil", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a path that leaves the destination, got %d %s", http.StatusBadRequest, rr.Code, rr.Header().Get("Location"))
+	}
+	if link, _ := app.getLinkByShortCode("plain"); link.TimesAccessed != 1 {
+		t.Errorf("Expected only the redirect to count as a visit, got %d", link.TimesAccessed)
+	}
+}
+
+func TestLinkPassthroughApi(t *testing.T) {
+	clearTable()
+	rr := apiRequest("POST", "/api/v1/links", `{"url": "https://example.com", "short_code": "guide", "query_passthrough": "append"}`)
+	var created Link
+	_ = json.Unmarshal(rr.Body.Bytes(), &created)
+	if rr.Code != http.StatusCreated || created.QueryPassthrough != queryPassthroughAppend || created.PathPassthrough {
+		t.Fatalf("Expected the link to be created passing on its query string, got %d %+v", rr.Code, created)
+	}
+	assertAPIError(t, apiRequest("POST", "/api/v1/links", `{"url": "https://example.com", "query_passthrough": "always"}`), http.StatusBadRequest, apiErrInvalidBody)
+
+	rr = apiRequest("PATCH", "/api/v1/links/guide", `{"path_passthrough": true}`)
+	var updated Link
+	_ = json.Unmarshal(rr.Body.Bytes(), &updated)
+	if rr.Code != http.StatusOK || !updated.PathPassthrough || updated.QueryPassthrough != queryPassthroughAppend {
+		t.Errorf("Expected only path passthrough to change, got %d %+v", rr.Code, updated)
+	}
+
+	rr = apiRequest("POST", "/api/v1/links", `{"url": "https://example.org", "short_code": "defaults"}`)
+	_ = json.Unmarshal(rr.Body.Bytes(), &created)
+	if created.QueryPassthrough != queryPassthroughOff {
+		t.Errorf("Expected the query string to be dropped by default, got %q", created.QueryPassthrough)
+	}
+}
@@ -0,0 +1,216 @@
+package shtnr
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// LinkRevisionList is every version of a link, newest first
+type LinkRevisionList struct {
+	Revisions []LinkRevision `json:"revisions"`
+}
+
+// LinkRevisionsApi lists every version of a link, newest first
+func (app *App) LinkRevisionsApi(w http.ResponseWriter, r *http.Request) {
+	link, ok := app.apiLink(w, r)
+	if !ok {
+		return
+	}
+	revisions, err := app.listLinkRevisions(link.ID)
+	if err != nil {
+		log.Println("Failed to list Link revisions: ", err)
+		writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+		return
+	}
+	if revisions == nil {
+		revisions = []LinkRevision{}
+	}
+	writeJSON(w, http.StatusOK, LinkRevisionList{Revisions: revisions})
+}
+
+// RollbackLinkApi gives a link everything it had at an earlier revision
+func (app *App) RollbackLinkApi(w http.ResponseWriter, r *http.Request) {
+	type requestType struct {
+		Revision int `json:"revision"`
+	}
+	var req requestType
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		log.Println("Failed to decode body: ", err)
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidBody, "Cannot parse body")
+		return
+	}
+
+	before, ok := app.apiLink(w, r)
+	if !ok {
+		return
+	}
+	after, err := app.rollbackLink(before, req.Revision)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeAPIError(w, http.StatusNotFound, apiErrNotFound, "Revision not found")
+		return
+	}
+	if err != nil {
+		writeLinkSaveError(w, err)
+		return
+	}
+	app.audit(r, "link.rollback", after.ShortCode, before, after)
+	writeJSON(w, http.StatusOK, after)
+}
+
+// linkInfoURL is the address of a link's detail page
+func linkInfoURL(shortCode string) string {
+	return "/shortlinks/" + url.PathEscape(shortCode) + "/info"
+}
+
+// LinkInfoHandler shows a link along with every version of it, so that it can be
+// edited or rolled back, and how to fill it in if it is a template
+func (app *App) LinkInfoHandler(w http.ResponseWriter, r *http.Request) {
+	link, err := app.getLinkByShortCode(chi.URLParam(r, "shortURL"))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Failed to get Link:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	revisions, err := app.listLinkRevisions(link.ID)
+	if err != nil {
+		log.Println("Failed to list Link revisions:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	type ViewModel struct {
+		Link         Link
+		SiteUrl      string
+		Revisions    []LinkRevision
+		Placeholders []string
+	}
+	vm := ViewModel{
+		Link:         link,
+		SiteUrl:      app.config.siteURL(),
+		Revisions:    revisions,
+		Placeholders: linkPlaceholders(link.LongLink),
+	}
+
+	tmpl := app.template("link.html")
+	err = tmpl.Execute(w, vm)
+	if err != nil {
+		log.Println("Failed to execute template:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// EditShortLink changes the short code, destination, tags, title, description, notes,
+// fallback and passthrough options of a link from its detail page
+func (app *App) EditShortLink(w http.ResponseWriter, r *http.Request) {
+	longURL := r.FormValue("url")
+	if !isValidURL(longURL) {
+		http.Error(w, "Invalid URL", http.StatusBadRequest)
+		return
+	}
+	if err := validatePlaceholders(longURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fallbackURL := strings.TrimSpace(r.FormValue("fallback_url"))
+	if err := validateFallbackURL(fallbackURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	shortCode := r.FormValue("shortURL")
+	if !isValidShortCode(shortCode) {
+		http.Error(w, invalidShortCodeMessage, http.StatusBadRequest)
+		return
+	}
+	tags, err := parseTagList(r.FormValue("tags"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	queryPassthrough, err := normalizeQueryPassthrough(r.FormValue("query_passthrough"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	before, err := app.getLinkByShortCode(chi.URLParam(r, "shortURL"))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		after := before
+		after.ShortCode, after.LongLink, after.Tags = shortCode, longURL, tags
+		after.Title = strings.TrimSpace(r.FormValue("title"))
+		after.Description = strings.TrimSpace(r.FormValue("description"))
+		after.Notes = strings.TrimSpace(r.FormValue("notes"))
+		after.QueryPassthrough = queryPassthrough
+		after.PathPassthrough = r.FormValue("path_passthrough") == "true"
+		after.FallbackURL = fallbackURL
+		if err = validateLinkText(after); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = app.updateLink(after)
+	}
+	if errors.Is(err, errShortCodeTaken) {
+		http.Error(w, "Short code is already in use", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Println("Failed to update Link:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	after, err := app.getLinkByID(int64(before.ID))
+	if err != nil {
+		log.Println("Failed to retrieve full Link:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	app.audit(r, "link.update", after.ShortCode, before, after)
+	http.Redirect(w, r, linkInfoURL(after.ShortCode), http.StatusSeeOther)
+}
+
+// RollbackShortLink gives a link everything it had at the revision posted from its
+// detail page
+func (app *App) RollbackShortLink(w http.ResponseWriter, r *http.Request) {
+	revision, err := strconv.Atoi(r.FormValue("revision"))
+	if err != nil {
+		http.Error(w, "Invalid revision", http.StatusBadRequest)
+		return
+	}
+	before, err := app.getLinkByShortCode(chi.URLParam(r, "shortURL"))
+	var after Link
+	if err == nil {
+		after, err = app.rollbackLink(before, revision)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errShortCodeTaken) {
+		http.Error(w, "Short code is already in use", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Println("Failed to roll back Link:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	app.audit(r, "link.rollback", after.ShortCode, before, after)
+	http.Redirect(w, r, linkInfoURL(after.ShortCode), http.StatusSeeOther)
+}
@@ -0,0 +1,148 @@
+package shtnr
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLinkRevisions(t *testing.T) {
+	clearTable()
+	id, _ := app.insertLink(&Link{ShortCode: "versioned", LongLink: "http://one.com"})
+	_ = app.updateLink(Link{ID: int(id), ShortCode: "versioned", LongLink: "http://two.com"})
+	_ = app.updateLink(Link{ID: int(id), ShortCode: "renamed", LongLink: "http://two.com"})
+	// visits and saves that change nothing are not revisions
+	_ = app.setVisitNumberToLink(int(id), 7)
+	_ = app.updateLink(Link{ID: int(id), ShortCode: "renamed", LongLink: "http://two.com"})
+
+	revisions, err := app.listLinkRevisions(int(id))
+	if err != nil {
+		t.Fatalf("listLinkRevisions failed: %v", err)
+	}
+	var got []string
+	for _, rev := range revisions {
+		got = append(got, rev.ShortCode+" "+rev.LongLink)
+	}
+	want := "renamed http://two.com, versioned http://two.com, versioned http://one.com"
+	if strings.Join(got, ", ") != want || revisions[0].Revision != 3 {
+		t.Errorf("Expected revisions %q, got %q", want, strings.Join(got, ", "))
+	}
+
+	link, _ := app.getLinkByID(id)
+	link, err = app.rollbackLink(link, 1)
+	if err != nil || link.ShortCode != "versioned" || link.LongLink != "http://one.com" || link.TimesAccessed != 7 {
+		t.Errorf("Expected the first version back with its visits, got %+v, %v", link, err)
+	}
+	if revisions, _ = app.listLinkRevisions(int(id)); len(revisions) != 4 {
+		t.Errorf("Expected the rollback to add a revision, got %d", len(revisions))
+	}
+
+	_, _ = app.insertLink(&Link{ShortCode: "renamed", LongLink: "http://other.com"})
+	if _, err = app.rollbackLink(link, 3); !errors.Is(err, errShortCodeTaken) {
+		t.Errorf("Expected a clash with the short code now in use, got %v", err)
+	}
+}
+
+func TestLinkRevisionsKeepEveryField(t *testing.T) {
+	clearTable()
+	first := Link{ShortCode: "full", LongLink: "http://{page}.com", Tags: []string{"docs", "team"}, Title: "One", Description: "First",
+		Notes: "Notes", QueryPassthrough: queryPassthroughKeep, PathPassthrough: true, FallbackURL: "http://fallback.com"}
+	id, _ := app.insertLink(&first)
+	_ = app.updateLink(Link{ID: int(id), ShortCode: "full", LongLink: "http://{page}.com", Tags: []string{"docs"}, Title: "One", Description: "First",
+		Notes: "Notes", QueryPassthrough: queryPassthroughKeep, PathPassthrough: true, FallbackURL: "http://fallback.com"})
+	_ = app.updateLink(Link{ID: int(id), ShortCode: "full", LongLink: "http://two.com", QueryPassthrough: queryPassthroughOff})
+
+	revisions, _ := app.listLinkRevisions(int(id))
+	if len(revisions) != 3 || !slices.Equal(revisions[1].Tags, []string{"docs"}) || revisions[0].Title != "" {
+		t.Fatalf("Expected a revision for the change of tags and one for the rest, got %+v", revisions)
+	}
+
+	link, _ := app.getLinkByID(id)
+	link, err := app.rollbackLink(link, 1)
+	if err != nil {
+		t.Fatalf("rollbackLink failed: %v", err)
+	}
+	first.ID, first.TimesAccessed = link.ID, link.TimesAccessed
+	first.CreatedAt, first.UpdatedAt = link.CreatedAt, link.UpdatedAt
+	if !reflect.DeepEqual(link, first) {
+		t.Errorf("Expected every field of the first version back, got %+v", link)
+	}
+}
+
+func TestLinkRevisionsApi(t *testing.T) {
+	clearTable()
+	_, _ = app.insertLink(&Link{ShortCode: "apirev", LongLink: "http://one.com"})
+	apiRequest("PATCH", "/api/v1/links/apirev", `{"url": "http://two.com"}`)
+
+	rr := apiRequest("GET", "/api/v1/links/apirev/revisions", "")
+	var list LinkRevisionList
+	_ = json.Unmarshal(rr.Body.Bytes(), &list)
+	if rr.Code != http.StatusOK || len(list.Revisions) != 2 || list.Revisions[1].LongLink != "http://one.com" {
+		t.Fatalf("Expected 2 revisions, got %d %+v", rr.Code, list)
+	}
+
+	rr = apiRequest("POST", "/api/v1/links/apirev/rollback", `{"revision": 1}`)
+	var link Link
+	_ = json.Unmarshal(rr.Body.Bytes(), &link)
+	if rr.Code != http.StatusOK || link.LongLink != "http://one.com" {
+		t.Errorf("Expected the link to be rolled back, got %d %+v", rr.Code, link)
+	}
+	events, _ := app.listAuditEvents(auditFilter{Action: "link.rollback", Target: "apirev", Limit: 1})
+	if len(events) != 1 {
+		t.Error("Expected the rollback to be audited")
+	}
+
+	assertAPIError(t, apiRequest("POST", "/api/v1/links/apirev/rollback", `{"revision": 9}`), http.StatusNotFound, apiErrNotFound)
+	assertAPIError(t, apiRequest("POST", "/api/v1/links/apirev/rollback", `revision`), http.StatusBadRequest, apiErrInvalidBody)
+	assertAPIError(t, apiRequest("GET", "/api/v1/links/missing/revisions", ""), http.StatusNotFound, apiErrNotFound)
+}
+
+func TestLinkInfoHandler(t *testing.T) {
+	clearTable()
+	_, _ = app.insertLink(&Link{ShortCode: "detail", LongLink: "http://one.com"})
+	cookie := sessionCookie(t, "testadmin")
+	serve := func(method, path string, form url.Values) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		app.routes().ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve("POST", "/shortlinks/detail/edit", url.Values{"shortURL": {"details"}, "url": {"http://two.com"}})
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/shortlinks/details/info" {
+		t.Fatalf("Expected a redirect to the renamed link, got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+	if rr = serve("POST", "/shortlinks/details/edit", url.Values{"shortURL": {"details"}, "url": {"not a url"}}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an invalid URL, got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	rr = serve("GET", "/shortlinks/details/info", nil)
+	body := rr.Body.String()
+	if rr.Code != http.StatusOK || !strings.Contains(body, "http://one.com") || !strings.Contains(body, "http://two.com") {
+		t.Errorf("Expected the page to show both versions, got status %d", rr.Code)
+	}
+
+	rr = serve("POST", "/shortlinks/details/rollback", url.Values{"revision": {"1"}})
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/shortlinks/detail/info" {
+		t.Errorf("Expected a redirect to the rolled back link, got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+	if link, err := app.getLinkByShortCode("detail"); err != nil || link.LongLink != "http://one.com" {
+		t.Errorf("Expected the first version back, got %+v, %v", link, err)
+	}
+	// links named like the other pages under /shortlinks still have one
+	_, _ = app.insertLink(&Link{ShortCode: "trash", LongLink: "http://trash.com"})
+	if rr = serve("GET", "/shortlinks/trash/info", nil); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "http://trash.com") {
+		t.Errorf("Expected the detail page of the trash link, got status %d", rr.Code)
+	}
+	if rr = serve("GET", "/shortlinks/missing/info", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, rr.Code)
+	}
+}
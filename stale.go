@@ -0,0 +1,278 @@
+package shtnr
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// defaultStaleDays is how long a link goes without a visit before the stale link
+// report lists it, unless the report asks for another number of days
+const defaultStaleDays = 90
+
+// linkActions are the changes that can be made to many links at once
+var linkActions = []string{"archive", "unarchive", "delete"}
+
+// LinkBulkResult reports what a bulk action did
+type LinkBulkResult struct {
+	Action   string `json:"action"`
+	Affected int    `json:"affected"`
+	// NotFound lists the short codes that did not match a link
+	NotFound []string `json:"not_found"`
+}
+
+// staleQuery returns the query for links not visited in the given number of days,
+// least recently visited first
+func staleQuery(days int, neverVisited bool) linkQuery {
+	return linkQuery{
+		NotVisitedSince: time.Now().AddDate(0, 0, -days),
+		NeverVisited:    neverVisited,
+		Sort:            "visited",
+	}
+}
+
+// applyLinkAction archives, unarchives or deletes a link and records it in the audit
+// log. It returns the link as it is afterwards.
+func (app *App) applyLinkAction(r *http.Request, action string, before Link) (Link, error) {
+	var err error
+	switch action {
+	case "archive":
+		err = app.setLinkArchived(before.ShortCode, true)
+	case "unarchive":
+		err = app.setLinkArchived(before.ShortCode, false)
+	case "delete":
+		if err = app.deleteLink(before.ShortCode); err != nil {
+			return before, err
+		}
+		app.audit(r, "link.delete", before.ShortCode, before, nil)
+		return Link{}, nil
+	default:
+		return before, errors.New("unknown link action " + action)
+	}
+	if err != nil {
+		return before, err
+	}
+	after, err := app.getLinkByID(int64(before.ID))
+	if err != nil {
+		return before, err
+	}
+	app.audit(r, "link."+action, after.ShortCode, before, after)
+	return after, nil
+}
+
+// bulkLinkAction applies an action to each of the links with the given short codes,
+// skipping the ones that do not exist
+func (app *App) bulkLinkAction(r *http.Request, action string, shortCodes []string) (LinkBulkResult, error) {
+	result := LinkBulkResult{Action: action, NotFound: []string{}}
+	for _, shortCode := range shortCodes {
+		link, err := app.getLinkByShortCode(shortCode)
+		if errors.Is(err, sql.ErrNoRows) {
+			result.NotFound = append(result.NotFound, shortCode)
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		if _, err = app.applyLinkAction(r, action, link); err != nil {
+			return result, err
+		}
+		result.Affected++
+	}
+	return result, nil
+}
+
+// StaleLinksApi lists the links that have not been visited in the last days (90 by
+// default), counting links never visited from when they were created. With
+// never_visited only links that were never visited are listed. Archived links are
+// left out.
+func (app *App) StaleLinksApi(w http.ResponseWriter, r *http.Request) {
+	days, err := queryInt(r, "days", defaultStaleDays)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidParameter, err.Error())
+		return
+	}
+	never, err := queryBool(r, "never_visited")
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidParameter, err.Error())
+		return
+	}
+	page, err := queryLinkPage(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidParameter, err.Error())
+		return
+	}
+	q := staleQuery(days, never)
+	q.Limit, q.Offset = page.Limit, page.Offset
+	if page.Sort != "" {
+		q.Sort, q.Desc = page.Sort, page.Desc
+	}
+
+	links, total, err := app.listLinks(q)
+	if err != nil {
+		log.Println("Failed to list stale links: ", err)
+		writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+		return
+	}
+	writeLinkList(w, q, links, total)
+}
+
+// BulkLinksApi archives, unarchives or deletes many links at once
+func (app *App) BulkLinksApi(w http.ResponseWriter, r *http.Request) {
+	type requestType struct {
+		Action     string   `json:"action"`
+		ShortCodes []string `json:"short_codes"`
+	}
+	var req requestType
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		log.Println("Failed to decode body: ", err)
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidBody, "Cannot parse body")
+		return
+	}
+	if !slices.Contains(linkActions, req.Action) {
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidParameter, "action must be archive, unarchive or delete")
+		return
+	}
+	if len(req.ShortCodes) == 0 || len(req.ShortCodes) > maxBatchSize {
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidBody, "A bulk action takes between 1 and "+strconv.Itoa(maxBatchSize)+" short codes")
+		return
+	}
+
+	result, err := app.bulkLinkAction(r, req.Action, req.ShortCodes)
+	if err != nil {
+		log.Println("Failed to "+req.Action+" Links: ", err)
+		writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// staleLinksURL links to the stale link report with the given settings
+func staleLinksURL(days int, never bool, page int) string {
+	u := url.Values{}
+	u.Set("days", strconv.Itoa(days))
+	if never {
+		u.Set("never", "true")
+	}
+	if page > 1 {
+		u.Set("page", strconv.Itoa(page))
+	}
+	return "/shortlinks/stale?" + u.Encode()
+}
+
+// staleReportSettings reads the settings of the stale link report from a request,
+// falling back to the defaults for anything missing or invalid
+func staleReportSettings(r *http.Request) (days int, never bool) {
+	days, err := strconv.Atoi(r.FormValue("days"))
+	if err != nil || days < 0 {
+		days = defaultStaleDays
+	}
+	never, _ = strconv.ParseBool(r.FormValue("never"))
+	return days, never
+}
+
+// StaleLinksHandler shows the stale link report, from which links can be archived or
+// deleted in bulk
+func (app *App) StaleLinksHandler(w http.ResponseWriter, r *http.Request) {
+	days, never := staleReportSettings(r)
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	q := staleQuery(days, never)
+	q.Limit, q.Offset = linksPageSize, (page-1)*linksPageSize
+
+	links, total, err := app.listLinks(q)
+	if err != nil {
+		log.Println("Failed to list stale links:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	type ViewModel struct {
+		Links     []Link
+		SiteUrl   string
+		Days      int
+		Never     bool
+		Total     int
+		Page      int
+		Pages     int
+		PrevURL   string
+		NextURL   string
+		FirstItem int
+		LastItem  int
+	}
+	vm := ViewModel{
+		Links:     links,
+		SiteUrl:   app.config.siteURL(),
+		Days:      days,
+		Never:     never,
+		Total:     total,
+		Page:      page,
+		Pages:     max(1, (total+linksPageSize-1)/linksPageSize),
+		FirstItem: q.Offset + 1,
+		LastItem:  q.Offset + len(links),
+	}
+	if page > 1 {
+		vm.PrevURL = staleLinksURL(days, never, page-1)
+	}
+	if q.Offset+len(links) < total {
+		vm.NextURL = staleLinksURL(days, never, page+1)
+	}
+
+	tmpl := app.template("stale.html")
+	err = tmpl.Execute(w, vm)
+	if err != nil {
+		log.Println("Failed to execute template:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// StaleLinksActionHandler archives or deletes the links selected in the stale link
+// report, then shows the report again
+func (app *App) StaleLinksActionHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	action := r.PostForm.Get("action")
+	if action != "archive" && action != "delete" {
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+	if _, err := app.bulkLinkAction(r, action, r.PostForm["short_code"]); err != nil {
+		log.Println("Failed to "+action+" Links:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	days, never := staleReportSettings(r)
+	http.Redirect(w, r, staleLinksURL(days, never, 1), http.StatusSeeOther)
+}
+
+// UnarchiveShortLink brings a link back from the archive
+func (app *App) UnarchiveShortLink(w http.ResponseWriter, r *http.Request) {
+	shortURL := chi.URLParam(r, "shortURL")
+	link, err := app.getLinkByShortCode(shortURL)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		_, err = app.applyLinkAction(r, "unarchive", link)
+	}
+	if err != nil {
+		log.Println("Failed to unarchive Link:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/shortlinks?archived=true", http.StatusSeeOther)
+}
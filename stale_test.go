@@ -0,0 +1,228 @@
+package shtnr
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ageLink makes a link look as if it was created, and last visited, that many days
+// ago. A negative visitedDaysAgo leaves it never visited.
+func ageLink(t *testing.T, shortCode string, createdDaysAgo, visitedDaysAgo, visits int) {
+	t.Helper()
+	daysAgo := func(days int) string {
+		return time.Now().AddDate(0, 0, -days).UTC().Format(sqliteTimeFormat)
+	}
+	var visited any
+	if visitedDaysAgo >= 0 {
+		visited = daysAgo(visitedDaysAgo)
+	}
+	_, err := app.db.Exec(`UPDATE links SET created_at = ?, last_accessed_at = ?, times_accessed = ? WHERE short_code = ?`,
+		daysAgo(createdDaysAgo), visited, visits, shortCode)
+	if err != nil {
+		t.Fatalf("Failed to age link: %v", err)
+	}
+}
+
+// seedStaleLinks creates links that are stale in different ways, and some that are not
+func seedStaleLinks(t *testing.T) {
+	t.Helper()
+	clearTable()
+	for _, code := range []string{"unused", "forgotten", "popular", "brandnew", "archived"} {
+		_, _ = app.insertLink(&Link{ShortCode: code, LongLink: "http://example.com/" + code})
+	}
+	ageLink(t, "unused", 200, -1, 0)
+	ageLink(t, "forgotten", 300, 100, 5)
+	ageLink(t, "popular", 300, 1, 50)
+	ageLink(t, "archived", 400, -1, 0)
+	_ = app.setLinkArchived("archived", true)
+}
+
+func TestFollowShortURLRecordsVisit(t *testing.T) {
+	clearTable()
+	_, _ = app.insertLink(&Link{ShortCode: "visited", LongLink: "http://example.com"})
+
+	rr := httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/visited", nil))
+	if rr.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("Expected status %d, got %d", http.StatusTemporaryRedirect, rr.Code)
+	}
+
+	link, _ := app.getLinkByShortCode("visited")
+	if link.TimesAccessed != 1 {
+		t.Errorf("Expected 1 visit, got %d", link.TimesAccessed)
+	}
+	if link.LastAccessedAt == nil || time.Since(*link.LastAccessedAt) > time.Minute {
+		t.Errorf("Expected the visit time to be recorded, got %v", link.LastAccessedAt)
+	}
+}
+
+func TestStaleLinksApi(t *testing.T) {
+	seedStaleLinks(t)
+
+	codes := func(query string) []string {
+		t.Helper()
+		rr := apiRequest("GET", "/api/v1/reports/stale"+query, "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected status %d, got %d", query, http.StatusOK, rr.Code)
+		}
+		var body LinkList
+		_ = json.Unmarshal(rr.Body.Bytes(), &body)
+		var codes []string
+		for _, l := range body.Links {
+			codes = append(codes, l.ShortCode)
+		}
+		return codes
+	}
+
+	for query, want := range map[string]string{
+		// never visited links come first, then the least recently visited
+		"":                    "unused forgotten",
+		"?days=30":            "unused forgotten",
+		"?days=150":           "unused",
+		"?days=365":           "",
+		"?never_visited=true": "unused",
+		"?sort=-clicks":       "forgotten unused",
+	} {
+		if got := strings.Join(codes(query), " "); got != want {
+			t.Errorf("%s: expected %q, got %q", query, want, got)
+		}
+	}
+
+	assertAPIError(t, apiRequest("GET", "/api/v1/reports/stale?days=-1", ""), http.StatusBadRequest, apiErrInvalidParameter)
+	assertAPIError(t, apiRequest("GET", "/api/v1/reports/stale?never_visited=maybe", ""), http.StatusBadRequest, apiErrInvalidParameter)
+}
+
+func TestBulkLinksApi(t *testing.T) {
+	seedStaleLinks(t)
+	var lastEvent int
+	_ = app.db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM audit_log`).Scan(&lastEvent)
+
+	bulk := func(body string) LinkBulkResult {
+		t.Helper()
+		rr := apiRequest("POST", "/api/v1/links/bulk", body)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+		var result LinkBulkResult
+		_ = json.Unmarshal(rr.Body.Bytes(), &result)
+		return result
+	}
+
+	result := bulk(`{"action": "archive", "short_codes": ["unused", "forgotten", "missing"]}`)
+	if result.Affected != 2 || len(result.NotFound) != 1 || result.NotFound[0] != "missing" {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+	links, _, _ := app.listLinks(linkQuery{Limit: 10})
+	if len(links) != 2 {
+		t.Errorf("Expected archived links to be left out of the list, got %d links", len(links))
+	}
+	links, _, _ = app.listLinks(linkQuery{Archived: true, Limit: 10})
+	if len(links) != 3 {
+		t.Errorf("Expected 3 archived links, got %d", len(links))
+	}
+
+	// archived links still redirect
+	rr := httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/unused", nil))
+	if rr.Code != http.StatusTemporaryRedirect {
+		t.Errorf("Expected an archived link to redirect, got status %d", rr.Code)
+	}
+
+	if result = bulk(`{"action": "unarchive", "short_codes": ["forgotten"]}`); result.Affected != 1 {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+	if link, _ := app.getLinkByShortCode("forgotten"); link.ArchivedAt != nil {
+		t.Error("Expected the link to be unarchived")
+	}
+
+	if result = bulk(`{"action": "delete", "short_codes": ["forgotten", "unused"]}`); result.Affected != 2 {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+	if n := countLinks(t); n != 3 {
+		t.Errorf("Expected 3 links left, got %d", n)
+	}
+
+	var count int
+	_ = app.db.QueryRow(`SELECT COUNT(*) FROM audit_log WHERE id > ? AND action IN ('link.archive', 'link.unarchive')`, lastEvent).Scan(&count)
+	if count != 3 {
+		t.Errorf("Expected 3 archive events in the audit log, got %d", count)
+	}
+
+	assertAPIError(t, apiRequest("POST", "/api/v1/links/bulk", `{"action": "shred", "short_codes": ["popular"]}`), http.StatusBadRequest, apiErrInvalidParameter)
+	assertAPIError(t, apiRequest("POST", "/api/v1/links/bulk", `{"action": "delete", "short_codes": []}`), http.StatusBadRequest, apiErrInvalidBody)
+}
+
+func TestUpdateLinkApiArchived(t *testing.T) {
+	clearTable()
+	_, _ = app.insertLink(&Link{ShortCode: "shelved", LongLink: "http://example.com"})
+
+	rr := apiRequest("PATCH", "/api/v1/links/shelved", `{"archived": true}`)
+	var link Link
+	_ = json.Unmarshal(rr.Body.Bytes(), &link)
+	if rr.Code != http.StatusOK || link.ArchivedAt == nil {
+		t.Fatalf("Expected the link to be archived, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	rr = apiRequest("PATCH", "/api/v1/links/shelved", `{"archived": false, "url": "http://example.org"}`)
+	link = Link{}
+	_ = json.Unmarshal(rr.Body.Bytes(), &link)
+	if link.ArchivedAt != nil || link.LongLink != "http://example.org" {
+		t.Errorf("Expected the link to be changed and unarchived, got %+v", link)
+	}
+}
+
+func TestStaleLinksHandler(t *testing.T) {
+	seedStaleLinks(t)
+
+	req, _ := http.NewRequest("GET", "/shortlinks/stale?days=150", nil)
+	rr := httptest.NewRecorder()
+	app.StaleLinksHandler(rr, req)
+	body := rr.Body.String()
+	if rr.Code != http.StatusOK || !strings.Contains(body, ">unused<") || strings.Contains(body, ">forgotten<") {
+		t.Errorf("Expected the report to list the link unused for 150 days, got status %d", rr.Code)
+	}
+	if !strings.Contains(body, ">Never<") {
+		t.Error("Expected the report to show the link was never visited")
+	}
+
+	rr = postForm(app.StaleLinksActionHandler, "/shortlinks/stale", url.Values{
+		"action":     {"archive"},
+		"short_code": {"unused", "forgotten"},
+		"days":       {"150"},
+	}, nil)
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/shortlinks/stale?days=150" {
+		t.Errorf("Expected a redirect back to the report, got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+	if link, _ := app.getLinkByShortCode("unused"); link.ArchivedAt == nil {
+		t.Error("Expected the selected links to be archived")
+	}
+
+	rr = postForm(app.StaleLinksActionHandler, "/shortlinks/stale", url.Values{"action": {"shred"}}, nil)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an unknown action, got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	// the archive lists them, and they can be brought back from it
+	req, _ = http.NewRequest("GET", "/shortlinks?archived=true", nil)
+	rr = httptest.NewRecorder()
+	app.ShortLinksHandler(rr, req)
+	if body = rr.Body.String(); !strings.Contains(body, ">forgotten<") || strings.Contains(body, ">popular<") {
+		t.Error("Expected the archived view to list the archived links only")
+	}
+
+	req, _ = http.NewRequest("POST", "/forgotten/unarchive", nil)
+	req.AddCookie(sessionCookie(t, "testadmin"))
+	rr = httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("Expected status %d, got %d", http.StatusSeeOther, rr.Code)
+	}
+	if link, _ := app.getLinkByShortCode("forgotten"); link.ArchivedAt != nil {
+		t.Error("Expected the link to be unarchived")
+	}
+}
@@ -0,0 +1,48 @@
+// static/app.js
+
+// Copy buttons: an element with data-copy copies its value when its button is
+// clicked, showing the [data-copied] elements in place of the [data-not-copied]
+// ones for a moment.
+document.addEventListener('click', function (event) {
+    const button = event.target.closest('[data-copy] button');
+    if (!button) {
+        return;
+    }
+    const container = button.closest('[data-copy]');
+    navigator.clipboard.writeText(container.dataset.copy).then(function () {
+        const show = function (copied) {
+            container.querySelectorAll('[data-copied]').forEach(function (el) {
+                el.hidden = !copied;
+            });
+            container.querySelectorAll('[data-not-copied]').forEach(function (el) {
+                el.hidden = copied;
+            });
+        };
+        show(true);
+        clearTimeout(container.copyTimeout);
+        container.copyTimeout = setTimeout(function () {
+            show(false);
+        }, 1500);
+    });
+});
+
+// Select all: a checkbox with data-select-all checks or clears every checkbox in its
+// form with that name.
+document.addEventListener('change', function (event) {
+    const toggle = event.target.closest('[data-select-all]');
+    if (!toggle) {
+        return;
+    }
+    toggle.form.querySelectorAll('input[type=checkbox][name="' + toggle.dataset.selectAll + '"]').forEach(function (el) {
+        el.checked = toggle.checked;
+    });
+});
+
+// Confirmation: a submit button with data-confirm only submits once the message has
+// been confirmed.
+document.addEventListener('click', function (event) {
+    const button = event.target.closest('button[data-confirm]');
+    if (button && !window.confirm(button.dataset.confirm)) {
+        event.preventDefault();
+    }
+});
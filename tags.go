@@ -0,0 +1,61 @@
+package shtnr
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxTagsPerLink limits how many tags one link can have
+const maxTagsPerLink = 20
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+const invalidTagMessage = "Tags may only contain lowercase letters, numbers, - and _, and must start with a letter or number"
+
+// normalizeTags lowercases and trims the tags, drops blank and repeated ones and
+// sorts them, so that the same tags are always stored the same way
+func normalizeTags(tags []string) ([]string, error) {
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || slices.Contains(normalized, tag) {
+			continue
+		}
+		if !tagPattern.MatchString(tag) {
+			return nil, errors.New(invalidTagMessage)
+		}
+		normalized = append(normalized, tag)
+	}
+	if len(normalized) > maxTagsPerLink {
+		return nil, errors.New("A link can have at most " + strconv.Itoa(maxTagsPerLink) + " tags")
+	}
+	slices.Sort(normalized)
+	return normalized, nil
+}
+
+// parseTagList reads the comma separated tags typed into a form
+func parseTagList(s string) ([]string, error) {
+	return normalizeTags(strings.Split(s, ","))
+}
+
+// TagStatsList is every tag in use
+type TagStatsList struct {
+	Tags []TagStats `json:"tags"`
+}
+
+// TagsApi lists every tag in use, with the number of links that have it and the
+// clicks they have had between them
+func (app *App) TagsApi(w http.ResponseWriter, r *http.Request) {
+	stats, err := app.listTagStats()
+	if err != nil {
+		log.Println("Failed to list tags: ", err)
+		writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+		return
+	}
+	writeJSON(w, http.StatusOK, TagStatsList{Tags: stats})
+}
@@ -0,0 +1,100 @@
+package shtnr
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	tags, err := normalizeTags([]string{" Docs", "api", "", "docs", "v2"})
+	if err != nil || !reflect.DeepEqual(tags, []string{"api", "docs", "v2"}) {
+		t.Errorf("Expected sorted, lowercased and unique tags, got %v, %v", tags, err)
+	}
+	for _, bad := range []string{"two words", "-leading", "comma,", strings.Repeat("x", 33)} {
+		if _, err = normalizeTags([]string{bad}); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+	if tags, _ = parseTagList("team, Docs ,"); !reflect.DeepEqual(tags, []string{"docs", "team"}) {
+		t.Errorf("Expected the form's tags to be split on commas, got %v", tags)
+	}
+}
+
+func TestLinkTagsApi(t *testing.T) {
+	clearTable()
+	for body, status := range map[string]int{
+		`{"url": "http://one.com", "short_code": "one", "tags": ["Docs", "team"]}`: http.StatusCreated,
+		`{"url": "http://two.com", "short_code": "two", "tags": ["docs"]}`:         http.StatusCreated,
+		`{"url": "http://three.com", "short_code": "three"}`:                       http.StatusCreated,
+	} {
+		if rr := apiRequest("POST", "/api/v1/links", body); rr.Code != status {
+			t.Fatalf("Expected status %d creating %s, got %d", status, body, rr.Code)
+		}
+	}
+	assertAPIError(t, apiRequest("POST", "/api/v1/links", `{"url": "http://four.com", "tags": ["no spaces"]}`), http.StatusBadRequest, apiErrInvalidTag)
+
+	link, _ := app.getLinkByShortCode("one")
+	if !reflect.DeepEqual(link.Tags, []string{"docs", "team"}) {
+		t.Errorf("Expected the link to be tagged docs and team, got %v", link.Tags)
+	}
+	_ = app.setVisitNumberToLink(link.ID, 5)
+
+	rr := apiRequest("GET", "/api/v1/links?tag=DOCS&sort=short_code", "")
+	var list LinkList
+	_ = json.Unmarshal(rr.Body.Bytes(), &list)
+	if list.Total != 2 || list.Links[0].ShortCode != "one" || list.Links[1].ShortCode != "two" {
+		t.Errorf("Expected the links tagged docs, got %+v", list)
+	}
+
+	rr = apiRequest("PATCH", "/api/v1/links/two", `{"tags": ["team"]}`)
+	var updated Link
+	_ = json.Unmarshal(rr.Body.Bytes(), &updated)
+	if rr.Code != http.StatusOK || !reflect.DeepEqual(updated.Tags, []string{"team"}) || updated.LongLink != "http://two.com" {
+		t.Errorf("Expected the tags to be replaced, got %d %+v", rr.Code, updated)
+	}
+	assertAPIError(t, apiRequest("PATCH", "/api/v1/links/two", `{"tags": ["-"]}`), http.StatusBadRequest, apiErrInvalidTag)
+
+	rr = apiRequest("GET", "/api/v1/tags", "")
+	var stats TagStatsList
+	_ = json.Unmarshal(rr.Body.Bytes(), &stats)
+	want := []TagStats{{Tag: "docs", Links: 1, Clicks: 5}, {Tag: "team", Links: 2, Clicks: 5}}
+	if rr.Code != http.StatusOK || !reflect.DeepEqual(stats.Tags, want) {
+		t.Errorf("Expected tag stats %+v, got %d %+v", want, rr.Code, stats.Tags)
+	}
+
+	// links in the trash don't count
+	_ = app.deleteLink("one")
+	if got, _ := app.listTagStats(); len(got) != 1 || got[0].Clicks != 0 {
+		t.Errorf("Expected only the team tag on the second link, got %+v", got)
+	}
+}
+
+func TestShortLinksHandlerTags(t *testing.T) {
+	clearTable()
+	rr := postForm(app.ShortenURL, "/shorten", url.Values{"url": {"http://tagged.com"}, "shortURL": {"tagged"}, "tags": {"docs, team"}}, nil)
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("Expected status %d, got %d", http.StatusSeeOther, rr.Code)
+	}
+	_, _ = app.insertLink(&Link{ShortCode: "plain", LongLink: "http://plain.com"})
+
+	req, _ := http.NewRequest("GET", "/shortlinks?tag=docs", nil)
+	rr = httptest.NewRecorder()
+	app.ShortLinksHandler(rr, req)
+	body := rr.Body.String()
+	if rr.Code != http.StatusOK || !strings.Contains(body, "http://tagged.com") || strings.Contains(body, "http://plain.com") {
+		t.Errorf("Expected only the tagged link, got status %d", rr.Code)
+	}
+	if !strings.Contains(body, `href="/shortlinks?tag=team"`) {
+		t.Error("Expected the page to link to the other tags")
+	}
+
+	rr = postForm(app.ShortenURL, "/shorten", url.Values{"url": {"http://bad.com"}, "tags": {"not ok"}}, nil)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an invalid tag, got %d", http.StatusBadRequest, rr.Code)
+	}
+}
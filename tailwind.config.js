@@ -0,0 +1,9 @@
+/** @type {import('tailwindcss').Config} */
+module.exports = {
+    content: ['./views/*.html'],
+    darkMode: 'media',
+    theme: {
+        extend: {},
+    },
+    plugins: [],
+}
@@ -0,0 +1,126 @@
+package shtnr
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// A link whose destination has placeholders, such as https://github.com/ourorg/{repo},
+// is a template. Following it fills them in from the path after the short code, in
+// order, and then from query parameters of the same name.
+
+// placeholderPattern matches anything in braces, so that bad names can be reported
+var placeholderPattern = regexp.MustCompile(`\{([^{}]*)\}`)
+
+var placeholderNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,31}$`)
+
+const invalidPlaceholderMessage = "Placeholders look like {name}, where the name starts with a letter and may only contain letters, numbers and _"
+
+// errMissingArgument is returned when a template is followed without a value for
+// one of its placeholders and it has no fallback
+var errMissingArgument = errors.New("this link needs a value for")
+
+// linkPlaceholders returns the names of the placeholders in a destination, in the
+// order they first appear
+func linkPlaceholders(longLink string) []string {
+	var names []string
+	for _, match := range placeholderPattern.FindAllStringSubmatch(longLink, -1) {
+		if !slices.Contains(names, match[1]) {
+			names = append(names, match[1])
+		}
+	}
+	return names
+}
+
+// validatePlaceholders checks every placeholder in a destination has a good name
+// and that there are no braces left over
+func validatePlaceholders(longLink string) error {
+	for _, name := range linkPlaceholders(longLink) {
+		if !placeholderNamePattern.MatchString(name) {
+			return errors.New(invalidPlaceholderMessage)
+		}
+	}
+	if strings.ContainsAny(placeholderPattern.ReplaceAllString(longLink, ""), "{}") {
+		return errors.New(invalidPlaceholderMessage)
+	}
+	return nil
+}
+
+// validateFallbackURL checks where a template goes when it is missing a value. It
+// is optional, and can't be a template itself.
+func validateFallbackURL(fallbackURL string) error {
+	switch {
+	case fallbackURL == "":
+		return nil
+	case !isValidURL(fallbackURL):
+		return errors.New("Invalid fallback URL")
+	case strings.ContainsAny(fallbackURL, "{}"):
+		return errors.New("The fallback URL can't have placeholders")
+	}
+	return nil
+}
+
+// fillPlaceholders gives a template's placeholders values from the escaped path after
+// the short code and then the query string. It returns the destination, the path
+// segments left over and the query parameters that weren't used.
+func fillPlaceholders(l Link, extraPath string, query url.Values) (string, string, url.Values, error) {
+	names := linkPlaceholders(l.LongLink)
+	if len(names) == 0 {
+		return l.LongLink, extraPath, query, nil
+	}
+	var segments []string
+	if extraPath != "" {
+		segments = strings.Split(extraPath, "/")
+	}
+	unused := url.Values{}
+	for name, values := range query {
+		unused[name] = values
+	}
+
+	values := make(map[string]string, len(names))
+	for _, name := range names {
+		var value string
+		if len(segments) > 0 {
+			var err error
+			if value, err = url.PathUnescape(segments[0]); err != nil {
+				return "", "", nil, err
+			}
+			segments = segments[1:]
+		}
+		if value == "" && unused.Get(name) != "" {
+			value = unused.Get(name)
+			unused.Del(name)
+		}
+		if value == "" {
+			if l.FallbackURL != "" {
+				return l.FallbackURL, "", nil, nil
+			}
+			return "", "", nil, fmt.Errorf("%w %s", errMissingArgument, name)
+		}
+		values[name] = value
+	}
+
+	// values in the query string are escaped for it, and everywhere else as a
+	// path segment, so they can't change the destination's host or path
+	queryStart := strings.IndexAny(l.LongLink, "?#")
+	var filled strings.Builder
+	last := 0
+	for _, match := range placeholderPattern.FindAllStringSubmatchIndex(l.LongLink, -1) {
+		filled.WriteString(l.LongLink[last:match[0]])
+		value := values[l.LongLink[match[2]:match[3]]]
+		if queryStart >= 0 && match[0] > queryStart {
+			filled.WriteString(url.QueryEscape(value))
+		} else if isDotSegment(value) {
+			return "", "", nil, errDotSegment
+		} else {
+			filled.WriteString(url.PathEscape(value))
+		}
+		last = match[1]
+	}
+	filled.WriteString(l.LongLink[last:])
+	return filled.String(), strings.Join(segments, "/"), unused, nil
+}
@@ -0,0 +1,98 @@
+package shtnr
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestValidatePlaceholders(t *testing.T) {
+	for _, good := range []string{"https://example.com", "https://github.com/ourorg/{repo}", "https://example.com/{a}/{b_2}?q={a}"} {
+		if err := validatePlaceholders(good); err != nil {
+			t.Errorf("Expected %s to be accepted, got %v", good, err)
+		}
+	}
+	for _, bad := range []string{"https://example.com/{}", "https://example.com/{1st}", "https://example.com/{two words}", "https://example.com/{open", "https://example.com/close}"} {
+		if err := validatePlaceholders(bad); err == nil {
+			t.Errorf("Expected %s to be rejected", bad)
+		}
+	}
+	if names := linkPlaceholders("https://example.com/{a}/{b}?q={a}"); !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("Expected each placeholder once, in order, got %v", names)
+	}
+	if err := validateFallbackURL("https://example.com/{repo}"); err == nil {
+		t.Error("Expected a fallback with placeholders to be rejected")
+	}
+}
+
+func TestRedirectTargetTemplates(t *testing.T) {
+	gh := Link{LongLink: "https://github.com/ourorg/{repo}"}
+	search := Link{LongLink: "https://example.com/search?q={term}&lang=en", QueryPassthrough: queryPassthroughKeep}
+	for _, tc := range []struct {
+		link  Link
+		path  string
+		query url.Values
+		want  string
+	}{
+		{gh, "shtnr", nil, "https://github.com/ourorg/shtnr"},
+		{gh, "", url.Values{"repo": {"shtnr"}}, "https://github.com/ourorg/shtnr"},
+		// values can't escape the part of the destination they are put in
+		{gh, "a%2F..%2Fb", nil, "https://github.com/ourorg/a%2F..%2Fb"},
+		{search, "", url.Values{"term": {"a&b c"}, "ref": {"mail"}}, "https://example.com/search?lang=en&q=a%26b+c&ref=mail"},
+		{Link{LongLink: "https://github.com/ourorg/{repo}", PathPassthrough: true}, "shtnr/issues", nil, "https://github.com/ourorg/shtnr/issues"},
+		{Link{LongLink: "https://github.com/ourorg/{repo}", FallbackURL: "https://github.com/ourorg"}, "", nil, "https://github.com/ourorg"},
+	} {
+		got, err := redirectTarget(tc.link, tc.path, tc.query)
+		if err != nil || got != tc.want {
+			t.Errorf("Expected %s for %s with %q %v, got %s, %v", tc.want, tc.link.LongLink, tc.path, tc.query, got, err)
+		}
+	}
+
+	if _, err := redirectTarget(gh, "", nil); !errors.Is(err, errMissingArgument) {
+		t.Errorf("Expected a missing value to be an error, got %v", err)
+	}
+	if _, err := redirectTarget(gh, "", url.Values{"repo": {".."}}); !errors.Is(err, errDotSegment) {
+		t.Errorf("Expected a value of .. to be refused, got %v", err)
+	}
+	if _, err := redirectTarget(gh, "shtnr/issues", nil); !errors.Is(err, errPathNotForwarded) {
+		t.Errorf("Expected extra segments to need path passthrough, got %v", err)
+	}
+}
+
+func TestFollowTemplateLink(t *testing.T) {
+	clearTable()
+	rr := apiRequest("POST", "/api/v1/links", `{"url": "https://jira.example.com/browse/{id}", "short_code": "jira"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d", http.StatusCreated, rr.Code)
+	}
+	assertAPIError(t, apiRequest("POST", "/api/v1/links", `{"url": "https://example.com/{bad name}"}`), http.StatusBadRequest, apiErrInvalidURL)
+	assertAPIError(t, apiRequest("PATCH", "/api/v1/links/jira", `{"fallback_url": "https://example.com/{id}"}`), http.StatusBadRequest, apiErrInvalidURL)
+
+	router := app.routes()
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/jira/OPS-42", nil))
+	if rr.Code != http.StatusTemporaryRedirect || rr.Header().Get("Location") != "https://jira.example.com/browse/OPS-42" {
+		t.Errorf("Expected a redirect to the issue, got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/jira", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d without an issue, got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	rr = apiRequest("PATCH", "/api/v1/links/jira", `{"fallback_url": "https://jira.example.com"}`)
+	var updated Link
+	_ = json.Unmarshal(rr.Body.Bytes(), &updated)
+	if rr.Code != http.StatusOK || updated.FallbackURL != "https://jira.example.com" {
+		t.Fatalf("Expected the fallback to be set, got %d %+v", rr.Code, updated)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/jira", nil))
+	if rr.Code != http.StatusTemporaryRedirect || rr.Header().Get("Location") != "https://jira.example.com" {
+		t.Errorf("Expected a redirect to the fallback, got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,152 @@
+package shtnr
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// loginAttempts tracks the failed logins seen for a single key (an IP address or a username)
+type loginAttempts struct {
+	failures    int
+	lastFailure time.Time
+	nextAllowed time.Time
+	lockedUntil time.Time
+}
+
+// loginThrottle slows down password guessing. Every failed login doubles the time
+// before the next attempt is accepted, and after maxAttempts failures the key is
+// locked out completely for the lockout duration. Failures are tracked separately
+// per client IP and per username so that neither spraying usernames from one
+// address nor spreading guesses for one account over many addresses gets through.
+type loginThrottle struct {
+	mu          sync.Mutex
+	attempts    map[string]*loginAttempts
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	lockout     time.Duration
+	now         func() time.Time
+}
+
+// maxTrackedLogins is the number of records kept before expired ones are swept out
+const maxTrackedLogins = 1024
+
+func newLoginThrottle(maxAttempts int, lockout time.Duration) *loginThrottle {
+	return &loginThrottle{
+		attempts:    make(map[string]*loginAttempts),
+		maxAttempts: maxAttempts,
+		baseDelay:   time.Second,
+		maxDelay:    time.Minute,
+		lockout:     lockout,
+		now:         time.Now,
+	}
+}
+
+func ipKey(ip string) string             { return "ip:" + ip }
+func usernameKey(username string) string { return "user:" + username }
+
+// check returns how long the caller must wait before a login attempt for this IP and
+// username may be made, and whether the wait is due to a lockout rather than backoff
+func (t *loginThrottle) check(ip, username string) (wait time.Duration, locked bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	for _, key := range []string{ipKey(ip), usernameKey(username)} {
+		a := t.get(key, now)
+		if a == nil {
+			continue
+		}
+		if now.Before(a.lockedUntil) {
+			if d := a.lockedUntil.Sub(now); !locked || d > wait {
+				wait = d
+			}
+			locked = true
+		} else if !locked && now.Before(a.nextAllowed) {
+			if d := a.nextAllowed.Sub(now); d > wait {
+				wait = d
+			}
+		}
+	}
+	return wait, locked
+}
+
+// fail records a failed login and reports which keys (if any) have just been locked out
+func (t *loginThrottle) fail(ip, username string) (lockedKeys []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	if len(t.attempts) > maxTrackedLogins {
+		t.prune(now)
+	}
+	for _, key := range []string{ipKey(ip), usernameKey(username)} {
+		a := t.get(key, now)
+		if a == nil {
+			a = &loginAttempts{}
+			t.attempts[key] = a
+		}
+		a.failures++
+		a.lastFailure = now
+		if a.failures >= t.maxAttempts {
+			a.lockedUntil = now.Add(t.lockout)
+			a.failures = 0
+			lockedKeys = append(lockedKeys, key)
+			continue
+		}
+		a.nextAllowed = now.Add(t.backoff(a.failures))
+	}
+	return lockedKeys
+}
+
+// succeed clears the failure history for the IP and username after a valid login
+func (t *loginThrottle) succeed(ip, username string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.attempts, ipKey(ip))
+	delete(t.attempts, usernameKey(username))
+}
+
+// backoff is the delay enforced after the given number of consecutive failures
+func (t *loginThrottle) backoff(failures int) time.Duration {
+	d := time.Duration(float64(t.baseDelay) * math.Pow(2, float64(failures-1)))
+	if d > t.maxDelay || d < 0 {
+		return t.maxDelay
+	}
+	return d
+}
+
+// get returns the record for a key, dropping it first if it has gone quiet for longer
+// than the lockout period. Must be called with the mutex held.
+func (t *loginThrottle) get(key string, now time.Time) *loginAttempts {
+	a, ok := t.attempts[key]
+	if !ok {
+		return nil
+	}
+	if now.After(a.lockedUntil) && now.Sub(a.lastFailure) > t.lockout {
+		delete(t.attempts, key)
+		return nil
+	}
+	return a
+}
+
+// prune drops every record that get would consider expired. Must be called with the
+// mutex held.
+func (t *loginThrottle) prune(now time.Time) {
+	for key := range t.attempts {
+		t.get(key, now)
+	}
+}
+
+// clientIP returns the IP address of the remote end of the request
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
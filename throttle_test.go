@@ -0,0 +1,73 @@
+package shtnr
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginThrottleBackoff(t *testing.T) {
+	now := time.Now()
+	throttle := newLoginThrottle(5, 15*time.Minute)
+	throttle.now = func() time.Time { return now }
+
+	if wait, _ := throttle.check("10.0.0.1", "alice"); wait != 0 {
+		t.Fatalf("Expected no wait before any failures, got %s", wait)
+	}
+
+	throttle.fail("10.0.0.1", "alice")
+	if wait, locked := throttle.check("10.0.0.1", "alice"); wait != time.Second || locked {
+		t.Errorf("Expected 1s backoff after one failure, got %s (locked=%v)", wait, locked)
+	}
+
+	now = now.Add(time.Second)
+	throttle.fail("10.0.0.1", "alice")
+	if wait, _ := throttle.check("10.0.0.1", "alice"); wait != 2*time.Second {
+		t.Errorf("Expected 2s backoff after two failures, got %s", wait)
+	}
+
+	// The username is throttled from any address
+	if wait, _ := throttle.check("10.0.0.2", "alice"); wait != 2*time.Second {
+		t.Errorf("Expected username to be throttled from another IP, got %s", wait)
+	}
+	// And the address is throttled for any username
+	if wait, _ := throttle.check("10.0.0.1", "bob"); wait != 2*time.Second {
+		t.Errorf("Expected IP to be throttled for another username, got %s", wait)
+	}
+
+	throttle.succeed("10.0.0.1", "alice")
+	if wait, _ := throttle.check("10.0.0.1", "alice"); wait != 0 {
+		t.Errorf("Expected successful login to reset backoff, got %s", wait)
+	}
+}
+
+func TestLoginThrottleLockout(t *testing.T) {
+	now := time.Now()
+	throttle := newLoginThrottle(3, 15*time.Minute)
+	throttle.now = func() time.Time { return now }
+
+	var locked []string
+	for i := 0; i < 3; i++ {
+		locked = throttle.fail("10.0.0.1", "alice")
+		now = now.Add(time.Minute)
+	}
+	if len(locked) != 2 {
+		t.Fatalf("Expected both IP and username to be locked, got %v", locked)
+	}
+
+	wait, isLocked := throttle.check("10.0.0.1", "alice")
+	if !isLocked || wait != 14*time.Minute {
+		t.Errorf("Expected 14m lockout remaining, got %s (locked=%v)", wait, isLocked)
+	}
+
+	now = now.Add(15 * time.Minute)
+	if wait, _ := throttle.check("10.0.0.1", "alice"); wait != 0 {
+		t.Errorf("Expected lockout to expire, got %s", wait)
+	}
+}
+
+func TestLoginThrottleMaxDelay(t *testing.T) {
+	throttle := newLoginThrottle(100, time.Hour)
+	if d := throttle.backoff(30); d != throttle.maxDelay {
+		t.Errorf("Expected backoff to be capped at %s, got %s", throttle.maxDelay, d)
+	}
+}
@@ -0,0 +1,170 @@
+package shtnr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// Limits on the text that describes a link
+const (
+	maxTitleLength       = 200
+	maxDescriptionLength = 1000
+	maxNotesLength       = 10000
+)
+
+// Fetching a destination's title gives up after titleFetchTimeout, and only reads
+// the first titleFetchMaxBytes of the page, which is where the <title> belongs
+const (
+	titleFetchTimeout  = 3 * time.Second
+	titleFetchMaxBytes = 64 << 10
+)
+
+// titleClient fetches titles from public addresses only. Anyone who can shorten a link
+// could otherwise make the server request its own network and read back the title.
+var titleClient = newTitleClient(isPublicAddress)
+
+// errPrivateAddress is returned when fetching a title would connect to an address
+// that isn't on the public internet
+var errPrivateAddress = errors.New("destination is not a public address")
+
+// nonPublicPrefixes are ranges that are neither private nor loopback nor link-local,
+// but still don't reach the public internet
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+}
+
+// isPublicAddress reports whether an IP address is on the public internet
+func isPublicAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// newTitleClient returns a client that only connects to the addresses allow accepts.
+// They are checked once the host name is resolved, for every redirect as well, and no
+// proxy is used so that the check applies to the destination itself.
+func newTitleClient(allow func(netip.Addr) bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: titleFetchTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !allow(addrPort.Addr()) {
+				return errPrivateAddress
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout:   titleFetchTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: titleFetchTimeout},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirected to a %s URL", req.URL.Scheme)
+			}
+			if ip, err := netip.ParseAddr(req.URL.Hostname()); err == nil && !allow(ip) {
+				return errPrivateAddress
+			}
+			return nil
+		},
+	}
+}
+
+var titlePattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+// validateLinkText checks the title, description and notes of a link are not too long
+func validateLinkText(l Link) error {
+	for _, field := range []struct {
+		name  string
+		value string
+		max   int
+	}{
+		{"title", l.Title, maxTitleLength},
+		{"description", l.Description, maxDescriptionLength},
+		{"notes", l.Notes, maxNotesLength},
+	} {
+		if utf8.RuneCountInString(field.value) > field.max {
+			return errors.New(field.name + " must be at most " + strconv.Itoa(field.max) + " characters")
+		}
+	}
+	return nil
+}
+
+// fetchPageTitle returns the contents of the <title> of an HTML page, with the
+// whitespace tidied up, or "" if it has none
+func fetchPageTitle(ctx context.Context, pageURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "text/html")
+	resp, err := titleClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("destination returned status %d", resp.StatusCode)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/html" {
+		return "", nil
+	}
+
+	page, err := io.ReadAll(io.LimitReader(resp.Body, titleFetchMaxBytes))
+	if err != nil {
+		return "", err
+	}
+	match := titlePattern.FindSubmatch(page)
+	if match == nil {
+		return "", nil
+	}
+	title := strings.Join(strings.Fields(html.UnescapeString(string(match[1]))), " ")
+	if runes := []rune(title); len(runes) > maxTitleLength {
+		title = string(runes[:maxTitleLength])
+	}
+	return title, nil
+}
+
+// fillTitle gives a new link without a title the title of its destination page, when
+// fetching titles is turned on. A page that can't be fetched leaves the link without
+// a title rather than stopping it being created. Templates are left alone, as their
+// destination isn't a page until it is filled in.
+func (app *App) fillTitle(r *http.Request, l *Link) {
+	if !app.config.fetchTitles || l.Title != "" || len(linkPlaceholders(l.LongLink)) > 0 {
+		return
+	}
+	title, err := fetchPageTitle(r.Context(), l.LongLink)
+	if err != nil {
+		log.Printf("Failed to fetch the title of %s: %s", l.LongLink, err)
+		return
+	}
+	l.Title = title
+}
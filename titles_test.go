@@ -0,0 +1,163 @@
+package shtnr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// allowLocalTitleFetches lets titles be fetched from the test servers, which listen
+// on loopback addresses
+func allowLocalTitleFetches(t *testing.T) {
+	t.Helper()
+	client := titleClient
+	titleClient = newTitleClient(func(netip.Addr) bool { return true })
+	t.Cleanup(func() { titleClient = client })
+}
+
+func TestFetchPageTitle(t *testing.T) {
+	allowLocalTitleFetches(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = w.Write([]byte("<html><head><TITLE lang=\"en\">\n  Fish &amp; Chips\n  Menu </TITLE></head></html>"))
+		case "/untitled":
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte("<html><body>No title here</body></html>"))
+		case "/data":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"title": "<title>Not a page</title>"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	if title, err := fetchPageTitle(ctx, ts.URL+"/page"); err != nil || title != "Fish & Chips Menu" {
+		t.Errorf("Expected the tidied up title, got %q, %v", title, err)
+	}
+	for _, path := range []string{"/untitled", "/data"} {
+		if title, err := fetchPageTitle(ctx, ts.URL+path); err != nil || title != "" {
+			t.Errorf("Expected no title for %s, got %q, %v", path, title, err)
+		}
+	}
+	if _, err := fetchPageTitle(ctx, ts.URL+"/missing"); err == nil {
+		t.Error("Expected an error for a page that isn't found")
+	}
+}
+
+func TestFetchPageTitleRefusesPrivateAddresses(t *testing.T) {
+	for _, address := range []string{"127.0.0.1", "10.1.2.3", "192.168.0.1", "169.254.169.254", "100.64.0.1", "::1", "fd00::1", "::ffff:127.0.0.1"} {
+		if isPublicAddress(netip.MustParseAddr(address)) {
+			t.Errorf("Expected %s not to be public", address)
+		}
+	}
+	for _, address := range []string{"93.184.215.14", "2606:4700::6810:85e5"} {
+		if !isPublicAddress(netip.MustParseAddr(address)) {
+			t.Errorf("Expected %s to be public", address)
+		}
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<title>Internal</title>"))
+	}))
+	defer ts.Close()
+
+	if title, err := fetchPageTitle(context.Background(), ts.URL); !errors.Is(err, errPrivateAddress) || title != "" {
+		t.Errorf("Expected 127.0.0.1 to be refused, got %q, %v", title, err)
+	}
+
+	// a server that may be reached can't redirect somewhere that may not
+	client := titleClient
+	titleClient = newTitleClient(func(ip netip.Addr) bool { return ip.IsLoopback() })
+	t.Cleanup(func() { titleClient = client })
+	if _, err := fetchPageTitle(context.Background(), ts.URL+"/redirect"); !errors.Is(err, errPrivateAddress) {
+		t.Errorf("Expected the redirect to be refused, got %v", err)
+	}
+}
+
+func TestFillTitle(t *testing.T) {
+	allowLocalTitleFetches(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<title>Fetched</title>"))
+	}))
+	defer ts.Close()
+	req := httptest.NewRequest("POST", "/shorten", nil)
+
+	link := Link{LongLink: ts.URL}
+	app.fillTitle(req, &link)
+	if link.Title != "" {
+		t.Errorf("Expected no title while fetching is turned off, got %q", link.Title)
+	}
+
+	enabled := app.config.fetchTitles
+	app.config.fetchTitles = true
+	t.Cleanup(func() { app.config.fetchTitles = enabled })
+	app.fillTitle(req, &link)
+	if link.Title != "Fetched" {
+		t.Errorf("Expected the page's title, got %q", link.Title)
+	}
+	link.Title = "Mine"
+	app.fillTitle(req, &link)
+	if link.Title != "Mine" {
+		t.Errorf("Expected a title that was given to be kept, got %q", link.Title)
+	}
+}
+
+func TestLinkTextApi(t *testing.T) {
+	clearTable()
+	rr := apiRequest("POST", "/api/v1/links", `{"url": "http://docs.com", "short_code": "docs", "title": "Team docs", "notes": "Owned by the platform team"}`)
+	var created Link
+	_ = json.Unmarshal(rr.Body.Bytes(), &created)
+	if rr.Code != http.StatusCreated || created.Title != "Team docs" || created.Notes != "Owned by the platform team" {
+		t.Fatalf("Expected the link to be created with its title and notes, got %d %+v", rr.Code, created)
+	}
+	long := strings.Repeat("x", maxTitleLength+1)
+	assertAPIError(t, apiRequest("POST", "/api/v1/links", `{"url": "http://long.com", "title": "`+long+`"}`), http.StatusBadRequest, apiErrInvalidBody)
+
+	rr = apiRequest("PATCH", "/api/v1/links/docs", `{"description": "Where everything is written down"}`)
+	var updated Link
+	_ = json.Unmarshal(rr.Body.Bytes(), &updated)
+	if rr.Code != http.StatusOK || updated.Description != "Where everything is written down" || updated.Title != "Team docs" {
+		t.Errorf("Expected only the description to change, got %d %+v", rr.Code, updated)
+	}
+	assertAPIError(t, apiRequest("PATCH", "/api/v1/links/docs", `{"title": "`+long+`"}`), http.StatusBadRequest, apiErrInvalidBody)
+
+	_, _ = app.insertLink(&Link{ShortCode: "other", LongLink: "http://other.com"})
+	for _, search := range []string{"team docs", "PLATFORM", "written down"} {
+		links, total, err := app.listLinks(linkQuery{Search: search, Limit: 10})
+		if err != nil || total != 1 || len(links) != 1 || links[0].ShortCode != "docs" {
+			t.Errorf("Expected searching for %q to find the link, got %d links, %v", search, total, err)
+		}
+	}
+}
+
+func TestShortenURLText(t *testing.T) {
+	clearTable()
+	rr := postForm(app.ShortenURL, "/shorten", url.Values{"url": {"http://form.com"}, "shortURL": {"form"}, "title": {" Form title "}}, nil)
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("Expected status %d, got %d", http.StatusSeeOther, rr.Code)
+	}
+	if link, _ := app.getLinkByShortCode("form"); link.Title != "Form title" {
+		t.Errorf("Expected the title to be saved, got %q", link.Title)
+	}
+
+	rr = postForm(app.ShortenURL, "/shorten", url.Values{"url": {"http://form.com"}, "notes": {strings.Repeat("x", maxNotesLength+1)}}, nil)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for notes that are too long, got %d", http.StatusBadRequest, rr.Code)
+	}
+}
@@ -0,0 +1,113 @@
+package shtnr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA1 test vectors from RFC 6238 appendix B, truncated to six digits
+func TestTOTPCode(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		code, err := totpCode(secret, totpStep(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatalf("totpCode failed: %v", err)
+		}
+		if code != tt.code {
+			t.Errorf("At %d expected %s, got %s", tt.unix, tt.code, code)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatalf("generateTOTPSecret failed: %v", err)
+	}
+	now := time.Now()
+	code, _ := totpCode(secret, totpStep(now))
+
+	step, ok := verifyTOTP(secret, code, now, 0)
+	if !ok || step != totpStep(now) {
+		t.Fatalf("Expected current code to verify, got step %d ok %v", step, ok)
+	}
+
+	// Codes from the previous period are accepted for clock drift
+	previous, _ := totpCode(secret, totpStep(now)-1)
+	if _, ok = verifyTOTP(secret, previous, now, 0); !ok {
+		t.Error("Expected code from previous period to verify")
+	}
+
+	// But not once a later code has been used
+	if _, ok = verifyTOTP(secret, code, now, step); ok {
+		t.Error("Expected a used code to be rejected")
+	}
+
+	old, _ := totpCode(secret, totpStep(now)-5)
+	if _, ok = verifyTOTP(secret, old, now, 0); ok {
+		t.Error("Expected an old code to be rejected")
+	}
+	if _, ok = verifyTOTP(secret, "12345", now, 0); ok {
+		t.Error("Expected a short code to be rejected")
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	uri := totpProvisioningURI("Shtnr", "alice", "JBSWY3DPEHPK3PXP")
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatalf("Failed to parse provisioning URI: %v", err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Shtnr:alice" {
+		t.Errorf("Unexpected provisioning URI: %s", uri)
+	}
+	if u.Query().Get("secret") != "JBSWY3DPEHPK3PXP" || u.Query().Get("issuer") != "Shtnr" {
+		t.Errorf("Unexpected provisioning URI parameters: %s", uri)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatalf("generateRecoveryCodes failed: %v", err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("Expected %d codes, got %d", recoveryCodeCount, len(codes))
+	}
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' {
+			t.Errorf("Unexpected recovery code format: %s", code)
+		}
+		if seen[code] {
+			t.Errorf("Duplicate recovery code: %s", code)
+		}
+		seen[code] = true
+	}
+
+	if hashRecoveryCode(codes[0]) != hashRecoveryCode(" "+strings.ToUpper(codes[0])+" ") {
+		t.Error("Expected recovery code hashing to ignore case and surrounding space")
+	}
+	if hashRecoveryCode(codes[0]) != hashRecoveryCode(strings.ReplaceAll(codes[0], "-", "")) {
+		t.Error("Expected a recovery code typed without its dash to be accepted")
+	}
+	// codes are stored with their dash, so the ones saved before are still accepted
+	sum := sha256.Sum256([]byte("aaaaa-bbbbb"))
+	if hashRecoveryCode("AAAAABBBBB") != hex.EncodeToString(sum[:]) {
+		t.Error("Expected the stored form of a code to keep its dash")
+	}
+}
@@ -0,0 +1,505 @@
+package shtnr
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxImportSize limits the size of an uploaded import file
+const maxImportSize = 10 << 20
+
+// How an import treats a link whose short code is already in use
+const (
+	importModeSkip      = "skip"
+	importModeOverwrite = "overwrite"
+)
+
+const importInvalid = "invalid"
+
+// linkCSVHeader is the header row of a CSV export
+var linkCSVHeader = []string{"id", "short_code", "long_link", "times_accessed", "created_at", "updated_at", "last_accessed_at", "archived_at", "tags", "title", "description", "notes", "query_passthrough", "path_passthrough", "fallback_url"}
+
+// linkCSVTimeFormat is how times are written to a CSV export
+const linkCSVTimeFormat = time.RFC3339
+
+// formatCSVTime writes a time that may not be set, leaving the cell empty if it isn't
+func formatCSVTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(linkCSVTimeFormat)
+}
+
+// csvFormulaPrefixes start a cell that a spreadsheet would run as a formula
+const csvFormulaPrefixes = "=+-@\t\r"
+
+// escapeCSVFormula stops a spreadsheet running a cell as a formula by putting a ' in
+// front of it, as titles fetched from any page could otherwise do
+func escapeCSVFormula(cell string) string {
+	if cell != "" && strings.ContainsRune(csvFormulaPrefixes, rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+// unescapeCSVFormula takes away the ' that escapeCSVFormula adds
+func unescapeCSVFormula(cell string) string {
+	if len(cell) > 1 && cell[0] == '\'' && strings.ContainsRune(csvFormulaPrefixes, rune(cell[1])) {
+		return cell[1:]
+	}
+	return cell
+}
+
+// importRecord is a link read from an import file, or the reason it couldn't be read
+type importRecord struct {
+	row  int
+	link Link
+	err  string
+}
+
+// linkDecoders read import files in each supported format
+var linkDecoders = map[string]func(io.Reader) ([]importRecord, error){
+	"csv":         decodeLinksCSV,
+	"json":        decodeLinksJSON,
+	"yourls-sql":  decodeYOURLSSQL,
+	"yourls-json": decodeYOURLSJSON,
+	"bitly-csv":   decodeBitlyCSV,
+}
+
+// ImportReport describes the outcome of an import, row by row. In a dry run nothing is
+// saved, and the report says what would have happened.
+type ImportReport struct {
+	Mode     string      `json:"mode"`
+	DryRun   bool        `json:"dry_run"`
+	Created  int         `json:"created"`
+	Updated  int         `json:"updated"`
+	Conflict int         `json:"conflict"`
+	Invalid  int         `json:"invalid"`
+	Rows     []ImportRow `json:"rows"`
+}
+
+// ImportRow is what happened to one row of an import file
+type ImportRow struct {
+	Row       int    `json:"row"`
+	ShortCode string `json:"short_code,omitempty"`
+	LongLink  string `json:"long_link,omitempty"`
+	Status    string `json:"status"`
+	Message   string `json:"message,omitempty"`
+}
+
+func encodeLinksCSV(w io.Writer, links []Link) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(linkCSVHeader); err != nil {
+		return err
+	}
+	for _, l := range links {
+		row := []string{
+			strconv.Itoa(l.ID),
+			l.ShortCode,
+			l.LongLink,
+			strconv.Itoa(l.TimesAccessed),
+			l.CreatedAt.UTC().Format(linkCSVTimeFormat),
+			l.UpdatedAt.UTC().Format(linkCSVTimeFormat),
+			formatCSVTime(l.LastAccessedAt),
+			formatCSVTime(l.ArchivedAt),
+			strings.Join(l.Tags, ","),
+			l.Title,
+			l.Description,
+			l.Notes,
+			l.QueryPassthrough,
+			strconv.FormatBool(l.PathPassthrough),
+			l.FallbackURL,
+		}
+		for i := range row {
+			row[i] = escapeCSVFormula(row[i])
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func encodeLinksJSON(w io.Writer, links []Link) error {
+	if links == nil {
+		links = []Link{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(links)
+}
+
+// decodeLinksCSV reads a CSV file with a header row. Only the long_link (or url)
+// column is required; the other columns of an export are optional and any other
+// columns are ignored.
+func decodeLinksCSV(r io.Reader) ([]importRecord, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CSV header: %w", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	urlColumn, ok := columns["long_link"]
+	if !ok {
+		if urlColumn, ok = columns["url"]; !ok {
+			return nil, errors.New("CSV must have a long_link or url column")
+		}
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return unescapeCSVFormula(strings.TrimSpace(record[i]))
+		}
+		return ""
+	}
+
+	var records []importRecord
+	for row := 2; ; row++ {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CSV row %d: %w", row, err)
+		}
+		rec := importRecord{row: row, link: Link{ShortCode: field(record, "short_code")}}
+		if urlColumn < len(record) {
+			rec.link.LongLink = unescapeCSVFormula(strings.TrimSpace(record[urlColumn]))
+		}
+		if clicks := field(record, "times_accessed"); clicks != "" {
+			if rec.link.TimesAccessed, err = strconv.Atoi(clicks); err != nil || rec.link.TimesAccessed < 0 {
+				rec.err = "times_accessed must be a non-negative integer"
+			}
+		}
+		for _, column := range []struct {
+			name string
+			time *time.Time
+		}{{"created_at", &rec.link.CreatedAt}, {"updated_at", &rec.link.UpdatedAt}} {
+			if value := field(record, column.name); value != "" {
+				if *column.time, err = time.Parse(linkCSVTimeFormat, value); err != nil {
+					rec.err = column.name + " must be a time like 2006-01-02T15:04:05Z"
+				}
+			}
+		}
+		for _, column := range []struct {
+			name string
+			time **time.Time
+		}{{"last_accessed_at", &rec.link.LastAccessedAt}, {"archived_at", &rec.link.ArchivedAt}} {
+			if value := field(record, column.name); value != "" {
+				t, err := time.Parse(linkCSVTimeFormat, value)
+				if err != nil {
+					rec.err = column.name + " must be a time like 2006-01-02T15:04:05Z"
+					continue
+				}
+				*column.time = &t
+			}
+		}
+		if rec.link.Tags, err = parseTagList(field(record, "tags")); err != nil {
+			rec.err = err.Error()
+		}
+		rec.link.Title = field(record, "title")
+		rec.link.Description = field(record, "description")
+		rec.link.Notes = field(record, "notes")
+		if err = validateLinkText(rec.link); err != nil {
+			rec.err = err.Error()
+		}
+		if rec.link.QueryPassthrough, err = normalizeQueryPassthrough(field(record, "query_passthrough")); err != nil {
+			rec.err = err.Error()
+		}
+		if passthrough := field(record, "path_passthrough"); passthrough != "" {
+			if rec.link.PathPassthrough, err = strconv.ParseBool(passthrough); err != nil {
+				rec.err = "path_passthrough must be true or false"
+			}
+		}
+		rec.link.FallbackURL = field(record, "fallback_url")
+		if err = validateFallbackURL(rec.link.FallbackURL); err != nil {
+			rec.err = err.Error()
+		}
+		records = append(records, rec)
+	}
+}
+
+// decodeLinksJSON reads an array of links in the format written by the JSON export
+func decodeLinksJSON(r io.Reader) ([]importRecord, error) {
+	var links []struct {
+		ShortCode     string `json:"short_code"`
+		LongLink      string `json:"long_link"`
+		URL           string `json:"url"`
+		TimesAccessed int    `json:"times_accessed"`
+		// CreatedAt and UpdatedAt are left out of files exported before links had them
+		CreatedAt time.Time `json:"created_at"`
+		UpdatedAt time.Time `json:"updated_at"`
+		// LastAccessedAt and ArchivedAt are null for links that were never visited or
+		// aren't archived
+		LastAccessedAt *time.Time `json:"last_accessed_at"`
+		ArchivedAt     *time.Time `json:"archived_at"`
+		Tags           []string   `json:"tags"`
+		Title          string     `json:"title"`
+		Description    string     `json:"description"`
+		Notes          string     `json:"notes"`
+		// QueryPassthrough and PathPassthrough are left out of files exported before
+		// links had them
+		QueryPassthrough string `json:"query_passthrough"`
+		PathPassthrough  bool   `json:"path_passthrough"`
+		FallbackURL      string `json:"fallback_url"`
+	}
+	if err := json.NewDecoder(r).Decode(&links); err != nil {
+		return nil, fmt.Errorf("cannot parse JSON: %w", err)
+	}
+	records := make([]importRecord, len(links))
+	for i, l := range links {
+		records[i] = importRecord{row: i + 1, link: Link{
+			ShortCode:       l.ShortCode,
+			LongLink:        l.LongLink,
+			TimesAccessed:   l.TimesAccessed,
+			CreatedAt:       l.CreatedAt,
+			UpdatedAt:       l.UpdatedAt,
+			LastAccessedAt:  l.LastAccessedAt,
+			ArchivedAt:      l.ArchivedAt,
+			Title:           l.Title,
+			Description:     l.Description,
+			Notes:           l.Notes,
+			PathPassthrough: l.PathPassthrough,
+			FallbackURL:     l.FallbackURL,
+		}}
+		if l.LongLink == "" {
+			records[i].link.LongLink = l.URL
+		}
+		if l.TimesAccessed < 0 {
+			records[i].err = "times_accessed must be a non-negative integer"
+		}
+		var err error
+		if records[i].link.Tags, err = normalizeTags(l.Tags); err != nil {
+			records[i].err = err.Error()
+		}
+		if err = validateLinkText(records[i].link); err != nil {
+			records[i].err = err.Error()
+		}
+		if records[i].link.QueryPassthrough, err = normalizeQueryPassthrough(l.QueryPassthrough); err != nil {
+			records[i].err = err.Error()
+		}
+		if err = validateFallbackURL(l.FallbackURL); err != nil {
+			records[i].err = err.Error()
+		}
+	}
+	return records, nil
+}
+
+// importRecords validates the records and saves the valid ones, unless it is a dry run
+func (app *App) importRecords(records []importRecord, mode string, dryRun bool) (ImportReport, error) {
+	report := ImportReport{Mode: mode, DryRun: dryRun, Rows: make([]ImportRow, len(records))}
+	links := make([]Link, 0, len(records))
+	indexes := make([]int, 0, len(records))
+	for i, rec := range records {
+		report.Rows[i] = ImportRow{Row: rec.row, ShortCode: rec.link.ShortCode, LongLink: rec.link.LongLink}
+		switch {
+		case rec.err != "":
+			report.Rows[i].Message = rec.err
+		case !isValidURL(rec.link.LongLink):
+			report.Rows[i].Message = "Invalid URL"
+		case validatePlaceholders(rec.link.LongLink) != nil:
+			report.Rows[i].Message = invalidPlaceholderMessage
+		case rec.link.ShortCode != "" && !isValidShortCode(rec.link.ShortCode):
+			report.Rows[i].Message = invalidShortCodeMessage
+		default:
+			links = append(links, rec.link)
+			indexes = append(indexes, i)
+			continue
+		}
+		report.Rows[i].Status = importInvalid
+		report.Invalid++
+	}
+
+	outcomes, err := app.importLinks(links, mode == importModeOverwrite, dryRun)
+	if err != nil {
+		return report, err
+	}
+	for j, outcome := range outcomes {
+		row := &report.Rows[indexes[j]]
+		row.ShortCode = links[j].ShortCode
+		row.Status = outcome
+		switch outcome {
+		case importCreated:
+			report.Created++
+		case importUpdated:
+			report.Updated++
+		case importConflict:
+			row.Message = "Short code is already in use"
+			report.Conflict++
+		}
+	}
+	return report, nil
+}
+
+// importFormat works out the format of an import from the format parameter, then
+// the file name, then the content type
+func importFormat(r *http.Request, filename string) string {
+	if format := r.FormValue("format"); format != "" {
+		return strings.ToLower(format)
+	}
+	if ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), "."); ext != "" {
+		return ext
+	}
+	if strings.Contains(r.Header.Get("Content-Type"), "csv") {
+		return "csv"
+	}
+	return "json"
+}
+
+// summary gives the totals of the report without the rows, which can be very long
+func (report ImportReport) summary() map[string]int {
+	return map[string]int{
+		"created":  report.Created,
+		"updated":  report.Updated,
+		"conflict": report.Conflict,
+		"invalid":  report.Invalid,
+	}
+}
+
+// auditImport records an import in the audit log. Dry runs change nothing so they
+// aren't recorded.
+func (app *App) auditImport(r *http.Request, report ImportReport) {
+	if report.DryRun {
+		return
+	}
+	app.audit(r, "link.import", report.Mode, nil, report.summary())
+}
+
+// writeLinksExport downloads every link in the format
+func (app *App) writeLinksExport(w http.ResponseWriter, format string) error {
+	links, err := app.getAllLinks()
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="links.%s"`, format))
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		return encodeLinksCSV(w, links)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return encodeLinksJSON(w, links)
+}
+
+// ExportLinksApi downloads every link, with its visit count, as JSON or CSV
+func (app *App) ExportLinksApi(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidParameter, "format must be json or csv")
+		return
+	}
+	if err := app.writeLinksExport(w, format); err != nil {
+		log.Println("Failed to export links: ", err)
+		writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+	}
+}
+
+// ImportLinksApi imports the links in the request body. Links whose short code is
+// already in use are reported as conflicts, or replaced when mode is overwrite.
+func (app *App) ImportLinksApi(w http.ResponseWriter, r *http.Request) {
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = importModeSkip
+	}
+	if mode != importModeSkip && mode != importModeOverwrite {
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidParameter, "mode must be skip or overwrite")
+		return
+	}
+	decode, ok := linkDecoders[importFormat(r, "")]
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidParameter, "Unsupported import format")
+		return
+	}
+
+	records, err := decode(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidBody, err.Error())
+		return
+	}
+	report, err := app.importRecords(records, mode, r.URL.Query().Get("dry_run") == "true")
+	if err != nil {
+		log.Println("Failed to import links: ", err)
+		writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+		return
+	}
+	app.auditImport(r, report)
+	writeJSON(w, http.StatusOK, report)
+}
+
+// ExportLinksHandler downloads every link from the admin pages
+func (app *App) ExportLinksHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "csv" {
+		format = "json"
+	}
+	if err := app.writeLinksExport(w, format); err != nil {
+		log.Println("Failed to export links:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func (app *App) renderImportPage(w http.ResponseWriter, status int, report *ImportReport, message string) {
+	tmpl := app.template("import.html")
+	type ViewModel struct {
+		Report *ImportReport
+		Error  string
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err := tmpl.Execute(w, ViewModel{Report: report, Error: message})
+	if err != nil {
+		log.Println("Failed to execute template:", err)
+	}
+}
+
+// ImportLinksHandler imports an uploaded file from the admin pages and shows the report
+func (app *App) ImportLinksHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		app.renderImportPage(w, http.StatusBadRequest, nil, "Choose a file to import.")
+		return
+	}
+	defer file.Close()
+
+	mode := importModeSkip
+	if r.FormValue("mode") == importModeOverwrite {
+		mode = importModeOverwrite
+	}
+	decode, ok := linkDecoders[importFormat(r, header.Filename)]
+	if !ok {
+		app.renderImportPage(w, http.StatusBadRequest, nil, "Choose the format of the file to import.")
+		return
+	}
+	records, err := decode(file)
+	if err != nil {
+		app.renderImportPage(w, http.StatusBadRequest, nil, "Cannot read the file: "+err.Error())
+		return
+	}
+	report, err := app.importRecords(records, mode, r.FormValue("dry_run") == "true")
+	if err != nil {
+		log.Println("Failed to import links:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	app.auditImport(r, report)
+	app.renderImportPage(w, http.StatusOK, &report, "")
+}
@@ -0,0 +1,200 @@
+package shtnr
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	for _, format := range []string{"csv", "json"} {
+		clearTable()
+		created := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+		_, _ = app.insertLink(&Link{ShortCode: "popular", LongLink: "http://popular.com", TimesAccessed: 42, CreatedAt: created, UpdatedAt: created.Add(time.Hour)})
+		_, _ = app.insertLink(&Link{ShortCode: "quiet", LongLink: "http://quiet.com?a=1,b=2"})
+
+		rr := apiRequest("GET", "/api/v1/export?format="+format, "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+		if cd := rr.Header().Get("Content-Disposition"); !strings.Contains(cd, "links."+format) {
+			t.Errorf("Expected a links.%s download, got %q", format, cd)
+		}
+		exported := rr.Body.String()
+
+		clearTable()
+		rr = apiRequest("POST", "/api/v1/import?format="+format, exported)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+		var report ImportReport
+		if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+		if report.Created != 2 || report.Invalid != 0 {
+			t.Errorf("%s: expected 2 links to be created, got %+v", format, report)
+		}
+		link, err := app.getLinkByShortCode("popular")
+		if err != nil || link.TimesAccessed != 42 {
+			t.Errorf("%s: expected the visit count to be imported, got %+v, %v", format, link, err)
+		}
+		if !link.CreatedAt.Equal(created) || !link.UpdatedAt.Equal(created.Add(time.Hour)) {
+			t.Errorf("%s: expected the times to be imported, got %s and %s", format, link.CreatedAt, link.UpdatedAt)
+		}
+		if link, _ = app.getLinkByShortCode("quiet"); link.LongLink != "http://quiet.com?a=1,b=2" {
+			t.Errorf("%s: expected the destination to survive the round trip, got %q", format, link.LongLink)
+		}
+	}
+}
+
+func TestImportOverwriteRoundTrip(t *testing.T) {
+	for _, format := range []string{"csv", "json"} {
+		clearTable()
+		created := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+		original := Link{ShortCode: "full", LongLink: "http://full.com", TimesAccessed: 9, CreatedAt: created, UpdatedAt: created.Add(time.Hour), Tags: []string{"docs", "team"},
+			Title: "Full", Description: "A link with everything", Notes: "Line one\nline \"two\", with a comma",
+			QueryPassthrough: queryPassthroughAppend, PathPassthrough: true, FallbackURL: "http://fallback.com"}
+		visited, archived := created.Add(2*time.Hour), created.Add(3*time.Hour)
+		original.LastAccessedAt, original.ArchivedAt = &visited, &archived
+		_, _ = app.insertLink(&original)
+		exported := apiRequest("GET", "/api/v1/export?format="+format, "").Body.String()
+
+		// the link has since been replaced by a different one with the same short code
+		clearTable()
+		now := time.Now()
+		_, _ = app.insertLink(&Link{ShortCode: "full", LongLink: "http://other.com", Tags: []string{"old"}, Title: "Other", LastAccessedAt: &now})
+		rr := apiRequest("POST", "/api/v1/import?mode=overwrite&format="+format, exported)
+		var report ImportReport
+		_ = json.Unmarshal(rr.Body.Bytes(), &report)
+		if report.Updated != 1 {
+			t.Fatalf("%s: expected the link to be overwritten, got %d %s", format, rr.Code, rr.Body.String())
+		}
+		link, _ := app.getLinkByShortCode("full")
+		if link.LongLink != original.LongLink || link.TimesAccessed != original.TimesAccessed ||
+			!link.CreatedAt.Equal(original.CreatedAt) || !link.UpdatedAt.Equal(original.UpdatedAt) ||
+			!slices.Equal(link.Tags, original.Tags) || link.Title != original.Title || link.Description != original.Description ||
+			link.Notes != original.Notes || link.QueryPassthrough != original.QueryPassthrough || link.PathPassthrough != original.PathPassthrough ||
+			link.FallbackURL != original.FallbackURL || link.LastAccessedAt == nil || !link.LastAccessedAt.Equal(visited) ||
+			link.ArchivedAt == nil || !link.ArchivedAt.Equal(archived) {
+			t.Errorf("%s: expected the exported link back, got %+v", format, link)
+		}
+	}
+}
+
+func TestImportKeepsStaleReport(t *testing.T) {
+	staleCodes := func() string {
+		var list LinkList
+		_ = json.Unmarshal(apiRequest("GET", "/api/v1/reports/stale?days=30", "").Body.Bytes(), &list)
+		var codes []string
+		for _, l := range list.Links {
+			codes = append(codes, l.ShortCode)
+		}
+		return strings.Join(codes, " ")
+	}
+	for _, format := range []string{"csv", "json"} {
+		seedStaleLinks(t)
+		exported := apiRequest("GET", "/api/v1/export?format="+format, "").Body.String()
+
+		// popular was visited yesterday and archived is left out, so neither is stale
+		clearTable()
+		apiRequest("POST", "/api/v1/import?format="+format, exported)
+		if got := staleCodes(); got != "unused forgotten" {
+			t.Errorf("%s: expected the same stale links after the import, got %q", format, got)
+		}
+		if link, _ := app.getLinkByShortCode("archived"); link.ArchivedAt == nil {
+			t.Errorf("%s: expected the archived link to stay archived", format)
+		}
+	}
+}
+
+func TestExportCSVFormulas(t *testing.T) {
+	clearTable()
+	_, _ = app.insertLink(&Link{ShortCode: "formula", LongLink: "http://formula.com", Title: `=HYPERLINK("http://evil.com","Click")`,
+		Description: "+1", Notes: "@SUM(A1)"})
+	exported := apiRequest("GET", "/api/v1/export?format=csv", "").Body.String()
+	if !strings.Contains(exported, `"'=HYPERLINK(""http://evil.com"",""Click"")"`) || !strings.Contains(exported, ",'+1,'@SUM(A1),") {
+		t.Fatalf("Expected the cells to be escaped, got %s", exported)
+	}
+
+	clearTable()
+	apiRequest("POST", "/api/v1/import?format=csv", exported)
+	link, _ := app.getLinkByShortCode("formula")
+	if link.Title != `=HYPERLINK("http://evil.com","Click")` || link.Description != "+1" || link.Notes != "@SUM(A1)" {
+		t.Errorf("Expected the import to take the escaping away, got %+v", link)
+	}
+}
+
+func TestImportModes(t *testing.T) {
+	clearTable()
+	_, _ = app.insertLink(&Link{ShortCode: "existing", LongLink: "http://old.com"})
+	body := `[
+		{"short_code": "existing", "long_link": "http://new.com", "times_accessed": 7},
+		{"short_code": "fresh", "url": "http://fresh.com"},
+		{"short_code": "broken", "long_link": "not a url"},
+		{"short_code": "bad/code", "long_link": "http://bad.com"}
+	]`
+
+	rr := apiRequest("POST", "/api/v1/import", body)
+	var report ImportReport
+	_ = json.Unmarshal(rr.Body.Bytes(), &report)
+	if report.Created != 1 || report.Conflict != 1 || report.Invalid != 2 || report.Updated != 0 {
+		t.Errorf("Expected 1 created, 1 conflict and 2 invalid, got %+v", report)
+	}
+	if report.Rows[0].Status != importConflict || report.Rows[2].Status != importInvalid {
+		t.Errorf("Expected each row to be reported, got %+v", report.Rows)
+	}
+	if link, _ := app.getLinkByShortCode("existing"); link.LongLink != "http://old.com" {
+		t.Errorf("Expected skip mode to leave the existing link alone, got %+v", link)
+	}
+
+	rr = apiRequest("POST", "/api/v1/import?mode=overwrite", body)
+	report = ImportReport{}
+	_ = json.Unmarshal(rr.Body.Bytes(), &report)
+	if report.Updated != 2 || report.Created != 0 {
+		t.Errorf("Expected 2 links to be overwritten, got %+v", report)
+	}
+	if link, _ := app.getLinkByShortCode("existing"); link.LongLink != "http://new.com" || link.TimesAccessed != 7 {
+		t.Errorf("Expected overwrite mode to replace the existing link, got %+v", link)
+	}
+
+	assertAPIError(t, apiRequest("POST", "/api/v1/import?mode=merge", body), http.StatusBadRequest, apiErrInvalidParameter)
+	assertAPIError(t, apiRequest("POST", "/api/v1/import?format=csv", "short_code\nonly"), http.StatusBadRequest, apiErrInvalidBody)
+}
+
+func TestImportLinksHandler(t *testing.T) {
+	clearTable()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "links.csv")
+	_, _ = fw.Write([]byte("short_code,long_link,times_accessed\nuploaded,http://uploaded.com,3\n,nope,0\n"))
+	_ = mw.WriteField("mode", "skip")
+	_ = mw.Close()
+
+	req, _ := http.NewRequest("POST", "/shortlinks/import", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.AddCookie(sessionCookie(t, "testadmin"))
+	rr := httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "Invalid URL") {
+		t.Error("Expected the report to show the invalid row")
+	}
+	if link, err := app.getLinkByShortCode("uploaded"); err != nil || link.TimesAccessed != 3 {
+		t.Errorf("Expected the uploaded link to be imported, got %+v, %v", link, err)
+	}
+
+	events, _ := app.listAuditEvents(auditFilter{Action: "link.import", Limit: 1})
+	if len(events) != 1 || events[0].Actor != "testadmin" {
+		t.Errorf("Expected the import to be audited, got %+v", events)
+	}
+}
@@ -0,0 +1,238 @@
+package shtnr
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// trashPurgeInterval is how often the server purges links that have been in the trash
+// for longer than the retention period
+const trashPurgeInterval = time.Hour
+
+// purgeExpiredTrash deletes the links that have been in the trash for longer than the
+// retention period for good, recording how many in the audit log
+func (app *App) purgeExpiredTrash() error {
+	if app.config.trashRetention <= 0 {
+		return nil
+	}
+	n, err := app.purgeTrash(time.Now().Add(-app.config.trashRetention))
+	if err != nil || n == 0 {
+		return err
+	}
+	return app.insertAuditEvent(AuditEvent{
+		Actor:   "system",
+		Action:  "trash.purge",
+		Details: fmt.Sprintf("purged %d links deleted more than %s ago", n, app.config.trashRetention),
+	})
+}
+
+// purgeTrashPeriodically purges expired links from the trash now and then at every
+// interval, until ctx is done
+func (app *App) purgeTrashPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := app.purgeExpiredTrash(); err != nil {
+			log.Println("Failed to purge the trash:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// apiTrashedLink loads the link in the trash named in the URL, writing an error
+// response if it can't
+func (app *App) apiTrashedLink(w http.ResponseWriter, r *http.Request) (Link, bool) {
+	link, err := app.getTrashedLink(chi.URLParam(r, "shortCode"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeAPIError(w, http.StatusNotFound, apiErrNotFound, "Link not found in the trash")
+		return link, false
+	}
+	if err != nil {
+		log.Println("Failed to get trashed Link: ", err)
+		writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+		return link, false
+	}
+	return link, true
+}
+
+// ListTrashApi lists the links in the trash, most recently deleted first. It takes
+// the same q, sort, limit and offset parameters as the list of links.
+func (app *App) ListTrashApi(w http.ResponseWriter, r *http.Request) {
+	if err := app.purgeExpiredTrash(); err != nil {
+		log.Println("Failed to purge the trash: ", err)
+	}
+	q, err := queryLinkPage(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, apiErrInvalidParameter, err.Error())
+		return
+	}
+	q.Search = r.URL.Query().Get("q")
+	q.Trashed = true
+	if q.Sort == "" {
+		q.setSort("-deleted")
+	}
+
+	links, total, err := app.listLinks(q)
+	if err != nil {
+		log.Println("Failed to list trashed links: ", err)
+		writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+		return
+	}
+	writeLinkList(w, q, links, total)
+}
+
+// RestoreLinkApi takes a link back out of the trash
+func (app *App) RestoreLinkApi(w http.ResponseWriter, r *http.Request) {
+	before, ok := app.apiTrashedLink(w, r)
+	if !ok {
+		return
+	}
+	if err := app.restoreLink(before.ShortCode); err != nil {
+		log.Println("Failed to restore Link: ", err)
+		writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+		return
+	}
+	after, err := app.getLinkByID(int64(before.ID))
+	if err != nil {
+		log.Println("Failed to retrieve full Link: ", err)
+		writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+		return
+	}
+	app.audit(r, "link.restore", after.ShortCode, before, after)
+	writeJSON(w, http.StatusOK, after)
+}
+
+// PurgeLinkApi deletes a link in the trash for good
+func (app *App) PurgeLinkApi(w http.ResponseWriter, r *http.Request) {
+	link, ok := app.apiTrashedLink(w, r)
+	if !ok {
+		return
+	}
+	if err := app.purgeLink(link.ShortCode); err != nil {
+		log.Println("Failed to purge Link: ", err)
+		writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+		return
+	}
+	app.audit(r, "link.purge", link.ShortCode, link, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TrashHandler lists the links in the trash a page at a time, most recently deleted
+// first, so they can be restored or deleted for good
+func (app *App) TrashHandler(w http.ResponseWriter, r *http.Request) {
+	if err := app.purgeExpiredTrash(); err != nil {
+		log.Println("Failed to purge the trash:", err)
+	}
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	q := linkQuery{Trashed: true, Limit: linksPageSize, Offset: (page - 1) * linksPageSize}
+	q.setSort("-deleted")
+
+	links, total, err := app.listLinks(q)
+	if err != nil {
+		log.Println("Failed to list trashed links:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	pageURL := func(p int) string {
+		return "/shortlinks/trash?" + url.Values{"page": {strconv.Itoa(p)}}.Encode()
+	}
+	type ViewModel struct {
+		Links   []Link
+		SiteUrl string
+		// RetentionDays is how long links stay in the trash, or 0 if they stay until
+		// they are deleted for good by hand
+		RetentionDays int
+		Total         int
+		Page          int
+		Pages         int
+		PrevURL       string
+		NextURL       string
+		FirstItem     int
+		LastItem      int
+	}
+	vm := ViewModel{
+		Links:         links,
+		SiteUrl:       app.config.siteURL(),
+		RetentionDays: int(app.config.trashRetention / (24 * time.Hour)),
+		Total:         total,
+		Page:          page,
+		Pages:         max(1, (total+linksPageSize-1)/linksPageSize),
+		FirstItem:     q.Offset + 1,
+		LastItem:      q.Offset + len(links),
+	}
+	if page > 1 {
+		vm.PrevURL = pageURL(page - 1)
+	}
+	if q.Offset+len(links) < total {
+		vm.NextURL = pageURL(page + 1)
+	}
+
+	tmpl := app.template("trash.html")
+	err = tmpl.Execute(w, vm)
+	if err != nil {
+		log.Println("Failed to execute template:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// RestoreShortLink takes a link back out of the trash
+func (app *App) RestoreShortLink(w http.ResponseWriter, r *http.Request) {
+	before, err := app.getTrashedLink(chi.URLParam(r, "shortURL"))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = app.restoreLink(before.ShortCode)
+	}
+	if err != nil {
+		log.Println("Failed to restore Link:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	after, err := app.getLinkByID(int64(before.ID))
+	if err != nil {
+		log.Println("Failed to retrieve full Link:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	app.audit(r, "link.restore", after.ShortCode, before, after)
+	http.Redirect(w, r, "/shortlinks/trash", http.StatusSeeOther)
+}
+
+// PurgeShortLink deletes a link in the trash for good
+func (app *App) PurgeShortLink(w http.ResponseWriter, r *http.Request) {
+	link, err := app.getTrashedLink(chi.URLParam(r, "shortURL"))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = app.purgeLink(link.ShortCode)
+	}
+	if err != nil {
+		log.Println("Failed to purge Link:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	app.audit(r, "link.purge", link.ShortCode, link, nil)
+	http.Redirect(w, r, "/shortlinks/trash", http.StatusSeeOther)
+}
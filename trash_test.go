@@ -0,0 +1,160 @@
+package shtnr
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFollowShortURLTrashed(t *testing.T) {
+	clearTable()
+	_, _ = app.insertLink(&Link{ShortCode: "binned", LongLink: "http://example.com"})
+	_ = app.deleteLink("binned")
+
+	rr := httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/binned", nil))
+	if rr.Code != http.StatusGone {
+		t.Errorf("Expected status %d for a link in the trash, got %d", http.StatusGone, rr.Code)
+	}
+	var visits int
+	_ = app.db.QueryRow(`SELECT times_accessed FROM links WHERE short_code = 'binned'`).Scan(&visits)
+	if visits != 0 {
+		t.Errorf("Expected a trashed link not to count visits, got %d", visits)
+	}
+}
+
+func TestTrashApi(t *testing.T) {
+	clearTable()
+	for _, code := range []string{"first", "second", "kept"} {
+		_, _ = app.insertLink(&Link{ShortCode: code, LongLink: "http://example.com/" + code})
+	}
+	for _, code := range []string{"first", "second"} {
+		if rr := apiRequest("DELETE", "/api/v1/links/"+code, ""); rr.Code != http.StatusNoContent {
+			t.Fatalf("Expected status %d deleting %s, got %d", http.StatusNoContent, code, rr.Code)
+		}
+	}
+	_, _ = app.db.Exec(`UPDATE links SET deleted_at = '2020-01-01 00:00:00' WHERE short_code = 'first'`)
+	assertAPIError(t, apiRequest("GET", "/api/v1/links/first", ""), http.StatusNotFound, apiErrNotFound)
+	assertAPIError(t, apiRequest("POST", "/api/v1/links", `{"url": "http://example.org", "short_code": "second"}`), http.StatusConflict, apiErrConflict)
+
+	// the retention period is long past for the first link, so listing purges it
+	rr := apiRequest("GET", "/api/v1/trash", "")
+	var list LinkList
+	_ = json.Unmarshal(rr.Body.Bytes(), &list)
+	if rr.Code != http.StatusOK || list.Total != 1 || list.Links[0].ShortCode != "second" || list.Links[0].DeletedAt == nil {
+		t.Fatalf("Expected the trash to hold the second link only, got %d %+v", rr.Code, list)
+	}
+
+	rr = apiRequest("POST", "/api/v1/trash/second/restore", "")
+	var restored Link
+	_ = json.Unmarshal(rr.Body.Bytes(), &restored)
+	if rr.Code != http.StatusOK || restored.ShortCode != "second" || restored.DeletedAt != nil {
+		t.Errorf("Expected the link to be restored, got %d %+v", rr.Code, restored)
+	}
+	if _, err := app.getLinkByShortLink("second"); err != nil {
+		t.Errorf("Expected the restored link to redirect, got %v", err)
+	}
+	assertAPIError(t, apiRequest("POST", "/api/v1/trash/kept/restore", ""), http.StatusNotFound, apiErrNotFound)
+
+	_ = app.deleteLink("second")
+	if rr = apiRequest("DELETE", "/api/v1/trash/second", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected status %d, got %d", http.StatusNoContent, rr.Code)
+	}
+	assertAPIError(t, apiRequest("DELETE", "/api/v1/trash/second", ""), http.StatusNotFound, apiErrNotFound)
+	if got := countLinks(t); got != 1 {
+		t.Errorf("Expected 1 link left, got %d", got)
+	}
+}
+
+func TestTrashRetention(t *testing.T) {
+	clearTable()
+	_, _ = app.insertLink(&Link{ShortCode: "old", LongLink: "http://example.com"})
+	_ = app.deleteLink("old")
+	_, _ = app.db.Exec(`UPDATE links SET deleted_at = ? WHERE short_code = 'old'`,
+		time.Now().AddDate(0, 0, -60).UTC().Format(sqliteTimeFormat))
+
+	keep := app.config.trashRetention
+	t.Cleanup(func() { app.config.trashRetention = keep })
+
+	app.config.trashRetention = 0
+	if err := app.purgeExpiredTrash(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.getTrashedLink("old"); err != nil {
+		t.Errorf("Expected links to stay in the trash without a retention period, got %v", err)
+	}
+
+	app.config.trashRetention = 90 * 24 * time.Hour
+	_ = app.purgeExpiredTrash()
+	if _, err := app.getTrashedLink("old"); err != nil {
+		t.Errorf("Expected the link to stay in the trash for 90 days, got %v", err)
+	}
+
+	app.config.trashRetention = 30 * 24 * time.Hour
+	_ = app.purgeExpiredTrash()
+	var count int
+	_ = app.db.QueryRow(`SELECT COUNT(*) FROM links`).Scan(&count)
+	if count != 0 {
+		t.Errorf("Expected the link to be purged after 30 days, got %d links", count)
+	}
+}
+
+func TestTrashHandler(t *testing.T) {
+	clearTable()
+	for _, code := range []string{"binned", "purged", "live"} {
+		_, _ = app.insertLink(&Link{ShortCode: code, LongLink: "http://example.com/" + code})
+		if code != "live" {
+			_ = app.deleteLink(code)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/shortlinks/trash", nil)
+	rr := httptest.NewRecorder()
+	app.TrashHandler(rr, req)
+	body := rr.Body.String()
+	if rr.Code != http.StatusOK || !strings.Contains(body, ">binned<") || strings.Contains(body, ">live<") {
+		t.Errorf("Expected the trash to list the deleted links only, got status %d", rr.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/shortlinks", nil)
+	rr = httptest.NewRecorder()
+	app.ShortLinksHandler(rr, req)
+	if strings.Contains(rr.Body.String(), ">binned<") {
+		t.Error("Expected the links page to leave out links in the trash")
+	}
+
+	for _, action := range []string{"/binned/restore", "/purged/purge"} {
+		req, _ = http.NewRequest("POST", action, nil)
+		req.AddCookie(sessionCookie(t, "testadmin"))
+		rr = httptest.NewRecorder()
+		app.routes().ServeHTTP(rr, req)
+		if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/shortlinks/trash" {
+			t.Errorf("%s: expected a redirect back to the trash, got %d %s", action, rr.Code, rr.Header().Get("Location"))
+		}
+	}
+	if _, err := app.getLinkByShortCode("binned"); err != nil {
+		t.Errorf("Expected the link to be restored, got %v", err)
+	}
+	if got := countLinks(t); got != 2 {
+		t.Errorf("Expected 2 links left, got %d", got)
+	}
+}
+
+func TestPurgeTrashPeriodicallyStops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		app.purgeTrashPeriodically(ctx, time.Hour)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Expected purging to stop once the context is done")
+	}
+}
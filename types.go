@@ -1,15 +1,28 @@
-package main
+package shtnr
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"fmt"
 	"github.com/gorilla/securecookie"
+	"html/template"
+	"net/url"
+	"time"
 )
 
+// App is an instance of the link shortener. Any number of them can run in one
+// process, each with its own store and settings.
 type App struct {
-	config       *Config
-	db           *sql.DB
-	hashPassword string
-	sc           *securecookie.SecureCookie
+	config        *Config
+	db            *sql.DB
+	hashPassword  string
+	sc            *securecookie.SecureCookie
+	loginThrottle *loginThrottle
+	oidc          *oidcProvider
+	templates     map[string]*template.Template
+	// ctx ends the app's background work, such as purging the trash, when it is done
+	ctx context.Context
 }
 
 type Config struct {
@@ -19,19 +32,125 @@ type Config struct {
 	defaultAdminUser     string
 	defaultAdminPassword string
 	apiKey               string
+	loginMaxAttempts     int
+	loginLockout         time.Duration
+	mfaRequiredRoles     []string
+	oidcIssuer           string
+	oidcClientID         string
+	oidcClientSecret     string
+	oidcRedirectURL      string
+	oidcScopes           []string
+	oidcGroupRoles       []oidcGroupRole
+	oidcDefaultRole      string
+	idempotencyWindow    time.Duration
+	assetsDir            string
+	// trashRetention is how long deleted links stay in the trash. Zero keeps them
+	// until they are purged by hand.
+	trashRetention time.Duration
+	// fetchTitles gives links created without a title the title of their
+	// destination page
+	fetchTitles bool
 }
 
 type user struct {
 	id             int
 	username       string
-	password       string
 	passwordHashed string
-	salt           string
+	role           string
+	totpSecret     string
+	totpEnabled    bool
+	totpLastStep   int64
 }
 
 type Link struct {
-	ID            int    `json:"id"`
-	ShortCode     string `json:"short_code"`
-	LongLink      string `json:"long_link"`
-	TimesAccessed int    `json:"times_accessed"`
+	ID            int       `json:"id"`
+	ShortCode     string    `json:"short_code"`
+	LongLink      string    `json:"long_link"`
+	TimesAccessed int       `json:"times_accessed"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	// LastAccessedAt is nil until the link is next visited
+	LastAccessedAt *time.Time `json:"last_accessed_at"`
+	// ArchivedAt is set while the link is archived
+	ArchivedAt *time.Time `json:"archived_at"`
+	// DeletedAt is set while the link is in the trash
+	DeletedAt *time.Time `json:"deleted_at"`
+	// Tags group related links, in alphabetical order
+	Tags []string `json:"tags"`
+	// Title, Description and Notes say what the link is for. They are all optional.
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Notes       string `json:"notes"`
+	// QueryPassthrough is how the query string a link is followed with is passed on
+	// to the destination: off, keep, override or append
+	QueryPassthrough string `json:"query_passthrough"`
+	// PathPassthrough appends any path after the short code to the destination
+	PathPassthrough bool `json:"path_passthrough"`
+	// FallbackURL is where a template goes when it is followed without a value for
+	// one of its placeholders. Without one that is an error.
+	FallbackURL string `json:"fallback_url"`
+}
+
+// TagStats is how much the links with a tag are used between them
+type TagStats struct {
+	Tag    string `json:"tag"`
+	Links  int    `json:"links"`
+	Clicks int    `json:"clicks"`
+}
+
+// CampaignStats is how much the links of a UTM campaign are used between them
+type CampaignStats struct {
+	Campaign string `json:"campaign"`
+	Links    int    `json:"links"`
+	Clicks   int    `json:"clicks"`
+	// Sources and Mediums are the utm_source and utm_medium values the campaign's
+	// links use, in alphabetical order
+	Sources []string `json:"sources"`
+	Mediums []string `json:"mediums"`
+}
+
+// LinkRevision is a version of everything about a link that can be edited. A link
+// starts at revision 1 and every change to it adds the next one.
+type LinkRevision struct {
+	Revision         int       `json:"revision"`
+	ShortCode        string    `json:"short_code"`
+	LongLink         string    `json:"long_link"`
+	Tags             []string  `json:"tags"`
+	Title            string    `json:"title"`
+	Description      string    `json:"description"`
+	Notes            string    `json:"notes"`
+	QueryPassthrough string    `json:"query_passthrough"`
+	PathPassthrough  bool      `json:"path_passthrough"`
+	FallbackURL      string    `json:"fallback_url"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// siteURL is the public address that short links are served from
+func (c *Config) siteURL() string {
+	// in development mode the server is reached on its port, unless the base URL
+	// already says which one
+	if c.isDevelopment && !hasPort(c.baseUrl) {
+		return fmt.Sprintf("%s:%s", c.baseUrl, c.port)
+	}
+	return c.baseUrl
+}
+
+// hasPort reports whether an address such as http://localhost:3001 has a port
+func hasPort(address string) bool {
+	u, err := url.Parse(address)
+	return err == nil && u.Port() != ""
+}
+
+// AuditEvent is an entry in the append-only audit log. Before and After hold JSON
+// snapshots of the changed record, when there is one.
+type AuditEvent struct {
+	ID        int             `json:"id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Actor     string          `json:"actor"`
+	Action    string          `json:"action"`
+	Target    string          `json:"target,omitempty"`
+	IP        string          `json:"ip,omitempty"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	Details   string          `json:"details,omitempty"`
 }
@@ -0,0 +1,240 @@
+package shtnr
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// utmParams are the UTM parameters that can be added to a new link's destination, so
+// that analytics tools can tell which campaign brought a visitor
+type utmParams struct {
+	Source   string `json:"utm_source"`
+	Medium   string `json:"utm_medium"`
+	Campaign string `json:"utm_campaign"`
+	Term     string `json:"utm_term"`
+	Content  string `json:"utm_content"`
+}
+
+// utmValuePattern only allows characters that never need escaping in a URL
+var utmValuePattern = regexp.MustCompile(`^[A-Za-z0-9._~-]{1,100}$`)
+
+const invalidUTMMessage = "UTM parameters may only contain letters, numbers, ., _, ~ and -, and must be at most 100 characters"
+
+// utmParamsFromForm reads the UTM parameters typed into a form
+func utmParamsFromForm(r *http.Request) utmParams {
+	return utmParams{
+		Source:   strings.TrimSpace(r.FormValue("utm_source")),
+		Medium:   strings.TrimSpace(r.FormValue("utm_medium")),
+		Campaign: strings.TrimSpace(r.FormValue("utm_campaign")),
+		Term:     strings.TrimSpace(r.FormValue("utm_term")),
+		Content:  strings.TrimSpace(r.FormValue("utm_content")),
+	}
+}
+
+// pairs returns the parameters that are set, in the order they are added to a URL
+func (p utmParams) pairs() [][2]string {
+	var pairs [][2]string
+	for _, pair := range [][2]string{
+		{"utm_source", p.Source},
+		{"utm_medium", p.Medium},
+		{"utm_campaign", p.Campaign},
+		{"utm_term", p.Term},
+		{"utm_content", p.Content},
+	} {
+		if pair[1] != "" {
+			pairs = append(pairs, pair)
+		}
+	}
+	return pairs
+}
+
+// validate checks the UTM parameters. None of them have to be given, but the source,
+// medium and campaign go together, as analytics tools expect all three.
+func (p utmParams) validate() error {
+	pairs := p.pairs()
+	if len(pairs) == 0 {
+		return nil
+	}
+	for _, pair := range pairs {
+		if !utmValuePattern.MatchString(pair[1]) {
+			return errors.New(invalidUTMMessage)
+		}
+	}
+	if p.Source == "" || p.Medium == "" || p.Campaign == "" {
+		return errors.New("utm_source, utm_medium and utm_campaign are needed when any UTM parameter is given")
+	}
+	return nil
+}
+
+// addTo adds the UTM parameters to the query string of a destination, replacing any
+// it already has. The rest of the URL is left as it is, placeholders included.
+func (p utmParams) addTo(longLink string) string {
+	pairs := p.pairs()
+	if len(pairs) == 0 {
+		return longLink
+	}
+	base, fragment, hasFragment := strings.Cut(longLink, "#")
+	base, query, _ := strings.Cut(base, "?")
+
+	var params []string
+	for _, param := range strings.Split(query, "&") {
+		name, _, _ := strings.Cut(param, "=")
+		if param != "" && !slices.ContainsFunc(pairs, func(pair [2]string) bool { return pair[0] == name }) {
+			params = append(params, param)
+		}
+	}
+	for _, pair := range pairs {
+		params = append(params, pair[0]+"="+pair[1])
+	}
+
+	longLink = base + "?" + strings.Join(params, "&")
+	if hasFragment {
+		longLink += "#" + fragment
+	}
+	return longLink
+}
+
+// destinationQuery returns the decoded query string of a link's destination, or
+// nothing if it can't be parsed
+func destinationQuery(longLink string) url.Values {
+	u, err := url.Parse(longLink)
+	if err != nil {
+		return nil
+	}
+	return u.Query()
+}
+
+// campaignLinkIDs returns the IDs of the links outside the trash whose destination
+// has exactly this utm_campaign, found the same way as by listCampaignStats
+func (app *App) campaignLinkIDs(campaign string) ([]int, error) {
+	rows, err := app.db.Query(`SELECT id, long_link FROM links WHERE deleted_at IS NULL AND long_link LIKE '%utm_campaign=%'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		var longLink string
+		if err = rows.Scan(&id, &longLink); err != nil {
+			return nil, err
+		}
+		if destinationQuery(longLink).Get("utm_campaign") == campaign {
+			ids = append(ids, id)
+		}
+	}
+	return ids, rows.Err()
+}
+
+// CampaignStatsList is every campaign links are tagged with
+type CampaignStatsList struct {
+	Campaigns []CampaignStats `json:"campaigns"`
+}
+
+// listCampaignStats adds up the clicks on the links for each utm_campaign found in
+// their destinations, whether it was added by the UTM builder or typed in, most
+// clicked first. Links in the trash are left out.
+func (app *App) listCampaignStats() ([]CampaignStats, error) {
+	rows, err := app.db.Query(`SELECT long_link, times_accessed FROM links WHERE deleted_at IS NULL AND long_link LIKE '%utm_campaign=%'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []CampaignStats{}
+	index := map[string]int{}
+	for rows.Next() {
+		var longLink string
+		var clicks int
+		if err = rows.Scan(&longLink, &clicks); err != nil {
+			return nil, err
+		}
+		query := destinationQuery(longLink)
+		campaign := query.Get("utm_campaign")
+		if campaign == "" {
+			continue
+		}
+		i, ok := index[campaign]
+		if !ok {
+			i = len(stats)
+			index[campaign] = i
+			stats = append(stats, CampaignStats{Campaign: campaign, Sources: []string{}, Mediums: []string{}})
+		}
+		s := &stats[i]
+		s.Links++
+		s.Clicks += clicks
+		if source := query.Get("utm_source"); source != "" && !slices.Contains(s.Sources, source) {
+			s.Sources = append(s.Sources, source)
+		}
+		if medium := query.Get("utm_medium"); medium != "" && !slices.Contains(s.Mediums, medium) {
+			s.Mediums = append(s.Mediums, medium)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range stats {
+		slices.Sort(stats[i].Sources)
+		slices.Sort(stats[i].Mediums)
+	}
+	slices.SortFunc(stats, func(a, b CampaignStats) int {
+		if a.Clicks != b.Clicks {
+			return b.Clicks - a.Clicks
+		}
+		return strings.Compare(a.Campaign, b.Campaign)
+	})
+	return stats, nil
+}
+
+// CampaignsApi reports the clicks on the links of each campaign
+func (app *App) CampaignsApi(w http.ResponseWriter, r *http.Request) {
+	stats, err := app.listCampaignStats()
+	if err != nil {
+		log.Println("Failed to list campaigns: ", err)
+		writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+		return
+	}
+	writeJSON(w, http.StatusOK, CampaignStatsList{Campaigns: stats})
+}
+
+// campaignLinksURL lists the links of a campaign
+func campaignLinksURL(campaign string) string {
+	return "/shortlinks?" + url.Values{"campaign": {campaign}}.Encode()
+}
+
+// CampaignsHandler shows the clicks on the links of each campaign
+func (app *App) CampaignsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := app.listCampaignStats()
+	if err != nil {
+		log.Println("Failed to list campaigns:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	type campaignRow struct {
+		CampaignStats
+		LinksURL string
+	}
+	type ViewModel struct {
+		Campaigns []campaignRow
+	}
+	vm := ViewModel{Campaigns: make([]campaignRow, len(stats))}
+	for i, s := range stats {
+		vm.Campaigns[i] = campaignRow{CampaignStats: s, LinksURL: campaignLinksURL(s.Campaign)}
+	}
+
+	tmpl := app.template("campaigns.html")
+	err = tmpl.Execute(w, vm)
+	if err != nil {
+		log.Println("Failed to execute template:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,148 @@
+package shtnr
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/dmt195/go-shtnr/client"
+)
+
+func TestUTMParams(t *testing.T) {
+	spring := utmParams{Source: "newsletter", Medium: "email", Campaign: "spring_sale"}
+	for _, tc := range []struct {
+		longLink string
+		params   utmParams
+		want     string
+	}{
+		{"https://example.com/shop", utmParams{}, "https://example.com/shop"},
+		{"https://example.com/shop", spring, "https://example.com/shop?utm_source=newsletter&utm_medium=email&utm_campaign=spring_sale"},
+		{"https://example.com/shop?b=1&utm_source=old&a=2#top", spring, "https://example.com/shop?b=1&a=2&utm_source=newsletter&utm_medium=email&utm_campaign=spring_sale#top"},
+		// placeholders are left for the template to fill in
+		{"https://example.com/{item}?ref={ref}", utmParams{Source: "ads", Medium: "cpc", Campaign: "launch", Term: "shoes"}, "https://example.com/{item}?ref={ref}&utm_source=ads&utm_medium=cpc&utm_campaign=launch&utm_term=shoes"},
+	} {
+		if got := tc.params.addTo(tc.longLink); got != tc.want {
+			t.Errorf("Expected %s, got %s", tc.want, got)
+		}
+	}
+
+	if err := spring.validate(); err != nil {
+		t.Errorf("Expected the parameters to be valid, got %v", err)
+	}
+	for _, bad := range []utmParams{
+		{Source: "newsletter"},
+		{Source: "news letter", Medium: "email", Campaign: "spring"},
+		{Source: "newsletter", Medium: "email", Campaign: strings.Repeat("x", 101)},
+	} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestCampaignsApi(t *testing.T) {
+	clearTable()
+	for body, status := range map[string]int{
+		`{"url": "https://example.com/a", "short_code": "a", "utm_source": "newsletter", "utm_medium": "email", "utm_campaign": "spring"}`: http.StatusCreated,
+		`{"url": "https://example.com/b", "short_code": "b", "utm_source": "ads", "utm_medium": "cpc", "utm_campaign": "spring"}`:          http.StatusCreated,
+		`{"url": "https://example.com/c?utm_campaign=autumn&utm_source=blog", "short_code": "c"}`:                                          http.StatusCreated,
+		`{"url": "https://example.com/d", "short_code": "d"}`:                                                                              http.StatusCreated,
+	} {
+		if rr := apiRequest("POST", "/api/v1/links", body); rr.Code != status {
+			t.Fatalf("Expected status %d creating %s, got %d", status, body, rr.Code)
+		}
+	}
+	assertAPIError(t, apiRequest("POST", "/api/v1/links", `{"url": "https://example.com/e", "utm_campaign": "spring"}`), http.StatusBadRequest, apiErrInvalidUTM)
+
+	link, _ := app.getLinkByShortCode("a")
+	if link.LongLink != "https://example.com/a?utm_source=newsletter&utm_medium=email&utm_campaign=spring" {
+		t.Errorf("Expected the UTM parameters to be added to the destination, got %s", link.LongLink)
+	}
+	_ = app.setVisitNumberToLink(link.ID, 3)
+	link, _ = app.getLinkByShortCode("b")
+	_ = app.setVisitNumberToLink(link.ID, 4)
+	link, _ = app.getLinkByShortCode("c")
+	_ = app.setVisitNumberToLink(link.ID, 10)
+
+	rr := apiRequest("GET", "/api/v1/reports/campaigns", "")
+	var list CampaignStatsList
+	_ = json.Unmarshal(rr.Body.Bytes(), &list)
+	want := []CampaignStats{
+		{Campaign: "autumn", Links: 1, Clicks: 10, Sources: []string{"blog"}, Mediums: []string{}},
+		{Campaign: "spring", Links: 2, Clicks: 7, Sources: []string{"ads", "newsletter"}, Mediums: []string{"cpc", "email"}},
+	}
+	if rr.Code != http.StatusOK || !reflect.DeepEqual(list.Campaigns, want) {
+		t.Errorf("Expected campaigns %+v, got %d %+v", want, rr.Code, list.Campaigns)
+	}
+
+	// links in the trash don't count
+	_ = app.deleteLink("c")
+	campaigns, err := newTestClient(t, nil, "testapikey").Campaigns(context.Background())
+	if err != nil || len(campaigns) != 1 || campaigns[0].Campaign != "spring" {
+		t.Errorf("Expected only the spring campaign, got %+v, %v", campaigns, err)
+	}
+}
+
+func TestBatchUTMParams(t *testing.T) {
+	clearTable()
+	rr := apiRequest("POST", "/api/v1/links/batch", `{"links": [{"url": "https://example.com", "short_code": "batch", "utm_source": "partner", "utm_medium": "referral", "utm_campaign": "launch", "utm_content": "banner"}]}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d", http.StatusCreated, rr.Code)
+	}
+	if link, _ := app.getLinkByShortCode("batch"); link.LongLink != "https://example.com?utm_source=partner&utm_medium=referral&utm_campaign=launch&utm_content=banner" {
+		t.Errorf("Expected the UTM parameters to be added, got %s", link.LongLink)
+	}
+
+	c := newTestClient(t, nil, "testapikey")
+	created, err := c.CreateLink(context.Background(), client.CreateLinkParams{URL: "https://example.org", UTMSource: "sdk", UTMMedium: "api", UTMCampaign: "launch"})
+	if err != nil || created.LongLink != "https://example.org?utm_source=sdk&utm_medium=api&utm_campaign=launch" {
+		t.Errorf("Expected the client to send the UTM parameters, got %+v, %v", created, err)
+	}
+}
+
+func TestCampaignsHandler(t *testing.T) {
+	clearTable()
+	rr := postForm(app.ShortenURL, "/shorten", url.Values{"url": {"https://example.com"}, "shortURL": {"form"}, "utm_source": {"flyer"}, "utm_medium": {"print"}, "utm_campaign": {"open_day"}}, nil)
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("Expected status %d, got %d", http.StatusSeeOther, rr.Code)
+	}
+	rr = postForm(app.ShortenURL, "/shorten", url.Values{"url": {"https://example.com"}, "utm_source": {"flyer"}}, nil)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d without a medium and campaign, got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	req, _ := http.NewRequest("GET", "/shortlinks/campaigns", nil)
+	rr = httptest.NewRecorder()
+	app.CampaignsHandler(rr, req)
+	body := rr.Body.String()
+	if rr.Code != http.StatusOK || !strings.Contains(body, "open_day") || !strings.Contains(body, `href="/shortlinks?campaign=open_day"`) {
+		t.Errorf("Expected the campaign with a link to its links, got status %d", rr.Code)
+	}
+}
+
+func TestCampaignLinks(t *testing.T) {
+	clearTable()
+	_, _ = app.insertLink(&Link{ShortCode: "plain", LongLink: "https://example.com?utm_campaign=spring"})
+	_, _ = app.insertLink(&Link{ShortCode: "encoded", LongLink: "https://example.com?utm_campaign=spr%69ng"})
+	_, _ = app.insertLink(&Link{ShortCode: "longer", LongLink: "https://example.com?utm_campaign=spring_sale"})
+	_, _ = app.insertLink(&Link{ShortCode: "mention", LongLink: "https://example.com?ref=utm_campaign%3Dspring"})
+
+	links, total, err := app.listLinks(linkQuery{Campaign: "spring", Limit: 10})
+	var got []string
+	for _, l := range links {
+		got = append(got, l.ShortCode)
+	}
+	slices.Sort(got)
+	if err != nil || total != 2 || !slices.Equal(got, []string{"encoded", "plain"}) {
+		t.Errorf("Expected only the links of the spring campaign, got %v (%d), %v", got, total, err)
+	}
+	if _, total, _ = app.listLinks(linkQuery{Campaign: "winter", Limit: 10}); total != 0 {
+		t.Errorf("Expected no links for an unknown campaign, got %d", total)
+	}
+}